@@ -1,6 +1,6 @@
 @echo off
 echo Пересборка Go клиента...
 cd src\go_client
-go build -o ..\..\bin\client.exe main.go
+go build -o ..\..\bin\client.exe .
 echo Готово!
 pause 
\ No newline at end of file
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"airchat/protocol/flagfile"
+
+	"github.com/gordonklaus/portaudio"
+)
+
+// Config - настройки клиента. Переменные окружения SERVER_IP и USERNAME,
+// которые передает Electron, служат значениями по умолчанию; их перекрывает
+// файл конфигурации (-config), а его - флаги. Сессионный токен берется
+// только из SESSION_TOKEN: флаг был бы виден в списке процессов.
+type Config struct {
+	Server       string // Хост или host:port управляющего канала сервера
+	VoicePort    int    // Порт голосового трафика сервера
+	Username     string
+	SessionToken string // Без токена сервер отклонит вход
+	ServerKey    string // Ожидаемый отпечаток ключа сервера, пустой - доверие при первом подключении
+	KnownServers string // Файл с отпечатками серверов, к которым уже подключались
+	IdentityKey  string // Файл с ключом сквозного шифрования, создается при первом запуске
+
+	InputDevice  string // Часть имени микрофона, пустое - устройство по умолчанию
+	OutputDevice string // Часть имени динамиков, пустое - устройство по умолчанию
+	ListDevices  bool   // Вывести список устройств и выйти
+
+	Bitrate    int  // Битрейт Opus, бит/с
+	Complexity int  // Сложность кодировщика Opus, 0-10
+	PacketLoss int  // Ожидаемые потери для FEC, %
+	FEC        bool // Встроенная коррекция ошибок Opus
+
+	JitterMin int // Минимальная задержка джиттер-буфера в кадрах
+	JitterMax int // Максимальная задержка джиттер-буфера в кадрах
+
+	VAD        bool // Мягкий гейт по голосовой активности
+	HighPass   bool // Фильтр высоких частот
+	Compressor bool // Компрессия пиков выше compressionThreshold
+	Normalize  bool // Нормализация амплитуды
+}
+
+// defaultControlPort - порт сервера, если в -server он не указан
+const defaultControlPort = 6000
+
+// config - действующие настройки, задаются в main до подключения
+var config = defaultConfig()
+
+func defaultConfig() Config {
+	return Config{
+		Server:       os.Getenv("SERVER_IP"),
+		VoicePort:    6001,
+		Username:     os.Getenv("USERNAME"),
+		SessionToken: os.Getenv("SESSION_TOKEN"),
+		KnownServers: defaultKnownServers(),
+		IdentityKey:  defaultIdentityKey(),
+		Bitrate:      32000,
+		Complexity:   8,
+		PacketLoss:   30,
+		FEC:          true,
+		JitterMin:    2,  // 40мс
+		JitterMax:    20, // 400мс
+		VAD:          true,
+		HighPass:     true,
+		Compressor:   true,
+		Normalize:    true,
+	}
+}
+
+// newFlagSet описывает параметры клиента, они же ключи файла конфигурации:
+// -input-device задается в файле как input_device.
+func newFlagSet(cfg *Config) *flag.FlagSet {
+	fs := flag.NewFlagSet("client", flag.ContinueOnError)
+	fs.StringVar(&cfg.Server, "server", cfg.Server, "адрес сервера: хост или host:port (SERVER_IP)")
+	fs.IntVar(&cfg.VoicePort, "voice-port", cfg.VoicePort, "порт голосового трафика сервера")
+	fs.StringVar(&cfg.Username, "username", cfg.Username, "имя пользователя (USERNAME)")
+	fs.StringVar(&cfg.ServerKey, "server-key", cfg.ServerKey, "отпечаток ключа сервера из его лога, пустой - запомнить при первом подключении")
+	fs.StringVar(&cfg.KnownServers, "known-servers", cfg.KnownServers, "файл с отпечатками ключей известных серверов")
+	fs.StringVar(&cfg.IdentityKey, "identity-key", cfg.IdentityKey, "файл с ключом сквозного шифрования сообщений")
+	fs.StringVar(&cfg.InputDevice, "input-device", cfg.InputDevice, "микрофон: часть имени устройства, пустое - по умолчанию")
+	fs.StringVar(&cfg.OutputDevice, "output-device", cfg.OutputDevice, "динамики: часть имени устройства, пустое - по умолчанию")
+	fs.BoolVar(&cfg.ListDevices, "list-devices", cfg.ListDevices, "вывести список аудиоустройств и выйти")
+	fs.IntVar(&cfg.Bitrate, "bitrate", cfg.Bitrate, "битрейт Opus, бит/с")
+	fs.IntVar(&cfg.Complexity, "complexity", cfg.Complexity, "сложность кодировщика Opus, 0-10")
+	fs.IntVar(&cfg.PacketLoss, "packet-loss", cfg.PacketLoss, "ожидаемые потери для FEC, %")
+	fs.BoolVar(&cfg.FEC, "fec", cfg.FEC, "встроенная коррекция ошибок Opus")
+	fs.IntVar(&cfg.JitterMin, "jitter-min", cfg.JitterMin, "минимальная задержка джиттер-буфера, кадров по 20мс")
+	fs.IntVar(&cfg.JitterMax, "jitter-max", cfg.JitterMax, "максимальная задержка джиттер-буфера, кадров по 20мс")
+	fs.BoolVar(&cfg.VAD, "vad", cfg.VAD, "приглушать микрофон, когда голоса нет")
+	fs.BoolVar(&cfg.HighPass, "highpass", cfg.HighPass, "фильтр высоких частот")
+	fs.BoolVar(&cfg.Compressor, "compressor", cfg.Compressor, "компрессия громких пиков")
+	fs.BoolVar(&cfg.Normalize, "normalize", cfg.Normalize, "нормализация амплитуды")
+	return fs
+}
+
+// loadConfig разбирает аргументы командной строки и файл конфигурации
+// из -config. Флаги, заданные явно, важнее значений из файла.
+func loadConfig(args []string) (Config, error) {
+	cfg := defaultConfig()
+	fs := newFlagSet(&cfg)
+	fs.String("config", "", "файл конфигурации (подмножество TOML, см. client.example.toml)")
+	if err := flagfile.Parse(fs, args, "config"); err != nil {
+		return cfg, err
+	}
+	if cfg.ListDevices {
+		return cfg, nil
+	}
+	return cfg, cfg.validate()
+}
+
+func (c Config) validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	check(c.Server != "", "не указан адрес сервера (-server или переменная окружения SERVER_IP)")
+	check(c.Username != "", "не указано имя пользователя (-username или переменная окружения USERNAME)")
+	if c.Server != "" {
+		_, err := c.ServerAddr()
+		check(err == nil, "некорректный адрес сервера %q: %v", c.Server, err)
+	}
+	check(c.VoicePort > 0 && c.VoicePort <= 65535, "voice_port %d вне диапазона 1-65535", c.VoicePort)
+	check(c.Bitrate >= 6000 && c.Bitrate <= 510000, "bitrate %d вне диапазона Opus 6000-510000", c.Bitrate)
+	check(c.Complexity >= 0 && c.Complexity <= 10, "complexity %d вне диапазона 0-10", c.Complexity)
+	check(c.PacketLoss >= 0 && c.PacketLoss <= 100, "packet_loss %d вне диапазона 0-100", c.PacketLoss)
+	check(c.JitterMin > 0 && c.JitterMin <= c.JitterMax,
+		"jitter_min (%d) должен быть больше 0 и не больше jitter_max (%d)", c.JitterMin, c.JitterMax)
+	return errors.Join(errs...)
+}
+
+// ServerAddr возвращает host:port управляющего канала. IPv6 адрес можно
+// указать как есть (::1) или в квадратных скобках, с портом или без.
+func (c Config) ServerAddr() (string, error) {
+	if host, port, err := net.SplitHostPort(c.Server); err == nil {
+		p, err := strconv.Atoi(port)
+		if err != nil || p <= 0 || p > 65535 {
+			return "", fmt.Errorf("некорректный порт %q", port)
+		}
+		return net.JoinHostPort(host, port), nil
+	}
+
+	host := strings.TrimSuffix(strings.TrimPrefix(c.Server, "["), "]")
+	if host == "" {
+		return "", errors.New("пустой хост")
+	}
+	return net.JoinHostPort(host, strconv.Itoa(defaultControlPort)), nil
+}
+
+// VoiceAddr возвращает host:port голосового трафика: тот же хост, что у
+// управляющего канала, и порт VoicePort
+func (c Config) VoiceAddr() (string, error) {
+	addr, err := c.ServerAddr()
+	if err != nil {
+		return "", err
+	}
+	host, _, _ := net.SplitHostPort(addr)
+	return net.JoinHostPort(host, strconv.Itoa(c.VoicePort)), nil
+}
+
+// findDevice ищет устройство по части имени. Пустое имя - устройство по
+// умолчанию из fallback.
+func findDevice(name string, input bool, fallback func() (*portaudio.DeviceInfo, error)) (*portaudio.DeviceInfo, error) {
+	if name == "" {
+		return fallback()
+	}
+
+	devices, err := portaudio.Devices()
+	if err != nil {
+		return nil, err
+	}
+	for _, device := range devices {
+		if input && device.MaxInputChannels < channels || !input && device.MaxOutputChannels < channels {
+			continue
+		}
+		if strings.Contains(strings.ToLower(device.Name), strings.ToLower(name)) {
+			return device, nil
+		}
+	}
+	return nil, fmt.Errorf("устройство %q не найдено, список выводит -list-devices", name)
+}
+
+// printDevices выводит аудиоустройства для -list-devices
+func printDevices() error {
+	devices, err := portaudio.Devices()
+	if err != nil {
+		return err
+	}
+	for _, device := range devices {
+		var kinds []string
+		if device.MaxInputChannels > 0 {
+			kinds = append(kinds, "ввод")
+		}
+		if device.MaxOutputChannels > 0 {
+			kinds = append(kinds, "вывод")
+		}
+		fmt.Printf("🎧 %s (%s)\n", device.Name, strings.Join(kinds, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadConfigEnvFileAndFlags(t *testing.T) {
+	t.Setenv("SERVER_IP", "10.0.0.1")
+	t.Setenv("USERNAME", "alice")
+	t.Setenv("SESSION_TOKEN", "token")
+
+	path := filepath.Join(t.TempDir(), "client.toml")
+	content := `
+server = "[::1]:7000"
+jitter_max = 10
+vad = false
+`
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := loadConfig([]string{"-config", path, "-jitter-max", "8", "-voice-port", "7001"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := defaultConfig()
+	want.Server = "[::1]:7000" // файл важнее переменной окружения
+	want.VoicePort = 7001
+	want.JitterMax = 8 // флаг важнее файла
+	want.VAD = false
+	if cfg != want {
+		t.Errorf("получено %+v\nожидалось %+v", cfg, want)
+	}
+	if cfg.Username != "alice" || cfg.SessionToken != "token" {
+		t.Errorf("переменные окружения не использованы: %+v", cfg)
+	}
+
+	// Токен не задается ни флагом, ни файлом, чтобы не попасть в список
+	// процессов
+	if _, err := loadConfig([]string{"-session-token", "other"}); err == nil {
+		t.Error("токен принят флагом")
+	}
+
+	voice, err := cfg.VoiceAddr()
+	if err != nil || voice != "[::1]:7001" {
+		t.Errorf("VoiceAddr() = %q, %v", voice, err)
+	}
+}
+
+func TestServerAddr(t *testing.T) {
+	tests := []struct{ server, want string }{
+		{"192.168.1.5", "192.168.1.5:6000"},
+		{"192.168.1.5:7000", "192.168.1.5:7000"},
+		{"::1", "[::1]:6000"},
+		{"[::1]", "[::1]:6000"},
+		{"[::1]:7000", "[::1]:7000"},
+		{"localhost", "localhost:6000"},
+	}
+	for _, tt := range tests {
+		got, err := Config{Server: tt.server}.ServerAddr()
+		if err != nil || got != tt.want {
+			t.Errorf("ServerAddr(%q) = %q, %v, ожидалось %q", tt.server, got, err, tt.want)
+		}
+	}
+
+	for _, bad := range []string{"[]", "host:port", "host:70000"} {
+		if got, err := (Config{Server: bad}).ServerAddr(); err == nil {
+			t.Errorf("ServerAddr(%q) = %q, ожидалась ошибка", bad, got)
+		}
+	}
+}
+
+func TestLoadConfigValidation(t *testing.T) {
+	t.Setenv("SERVER_IP", "")
+	t.Setenv("USERNAME", "alice")
+
+	_, err := loadConfig([]string{"-jitter-min", "30", "-complexity", "11"})
+	if err == nil {
+		t.Fatal("некорректная конфигурация принята")
+	}
+	for _, want := range []string{"SERVER_IP", "jitter_min", "complexity"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("в ошибке нет %q: %v", want, err)
+		}
+	}
+}
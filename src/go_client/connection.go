@@ -0,0 +1,400 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"airchat/protocol"
+	"airchat/protocol/reliable"
+	"airchat/protocol/secure"
+)
+
+// Подключение к серверу и переподключение после потери связи. Клиент
+// шлет keepalive каждые protocol.KeepaliveInterval, сервер отвечает на
+// каждый. Если от сервера дольше serverTimeout ничего не приходит, клиент
+// переподключается с растущей задержкой, заново входит, возвращается в
+// голосовой чат и досылает сообщения, которые сервер не подтвердил.
+
+const (
+	// Через сколько без сообщений от сервера связь считается потерянной
+	serverTimeout = 3 * protocol.KeepaliveInterval
+
+	// Задержка перед попыткой переподключения удваивается от
+	// reconnectMinDelay до reconnectMaxDelay
+	reconnectMinDelay = time.Second
+	reconnectMaxDelay = 30 * time.Second
+
+	// Сколько сообщений (или фрагментов изображений) ждут связи
+	maxOutbox = 8192
+)
+
+// Состояния подключения, Electron получает их строкой CONNECTION:<состояние>
+const (
+	stateConnecting   = "connecting"
+	stateConnected    = "connected"
+	stateReconnecting = "reconnecting"
+)
+
+var (
+	// Текущее подключение, nil пока идет переподключение. Меняется только
+	// в главном цикле.
+	current *session
+
+	// Сообщения, которые уйдут после переподключения
+	pending outbox
+
+	// Вернуться в голосовой чат после переподключения
+	restoreVoice bool
+
+	errOutboxFull = errors.New("нет связи с сервером, очередь отправки заполнена")
+)
+
+func reportState(state string) {
+	fmt.Println("CONNECTION:" + state)
+}
+
+// disconnectError - отказ, после которого переподключаться бессмысленно:
+// сервер не пускает нас или его ключ не тот, что мы знаем
+type disconnectError struct{ err error }
+
+func (e *disconnectError) Error() string { return e.err.Error() }
+
+func (e *disconnectError) Unwrap() error { return e.err }
+
+// tokenError - сервер не принял сессионный токен. При переподключении это
+// почти всегда истекший срок: Electron выпускает новый токен и передает
+// его командой /token.
+type tokenError struct{ err error }
+
+func (e *tokenError) Error() string { return e.err.Error() }
+
+func (e *tokenError) Unwrap() error { return e.err }
+
+// sessionToken - действующий токен, если Electron обновлял его после
+// запуска. Пишется главным циклом, читается при переподключении.
+var sessionToken atomic.Value
+
+// currentToken возвращает токен для входа на сервер
+func currentToken() string {
+	if token, ok := sessionToken.Load().(string); ok {
+		return token
+	}
+	return config.SessionToken
+}
+
+// session - одно подключение к серверу: от входа до потери связи
+type session struct {
+	udp    *net.UDPConn
+	secure *secure.ClientConn
+	conn   *reliable.Conn
+	server *net.UDPAddr
+
+	// Токен голосовой сессии из JoinResult
+	voiceToken [protocol.VoiceTokenSize]byte
+
+	lastHeard atomic.Int64 // Время последнего сообщения от сервера, UnixNano
+	lost      chan struct{}
+	lostOnce  sync.Once
+
+	// Через сколько сервер обещал вернуться после Shutdown, либо причина
+	// окончательного отключения, если возвращаться он не собирается.
+	// Пишутся до закрытия lost, читаются после.
+	restartIn  time.Duration
+	disconnect string
+}
+
+// dial подключается к серверу и входит в чат. При переподключении
+// localPort - порт прежнего сокета: с того же адреса сервер примет вход,
+// даже если еще не удалил прежнюю сессию.
+func dial(localPort int) (*session, error) {
+	controlAddr, _ := config.ServerAddr() // Проверен в loadConfig
+	serverAddr, err := net.ResolveUDPAddr("udp", controlAddr)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка разрешения адреса: %w", err)
+	}
+
+	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{Port: localPort})
+	if err != nil && localPort != 0 {
+		// Порт уже занят, входим с нового
+		udpConn, err = net.ListenUDP("udp", nil)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("ошибка подключения: %w", err)
+	}
+
+	// Рукопожатие до входа: имя и токен уходят уже зашифрованными.
+	// Подмененный ключ сервера - повод остановиться, а не повторять.
+	verify := verifyServerKey(controlAddr, config.ServerKey, config.KnownServers)
+	var keyErr error
+	secureConn, err := secure.Dial(udpConn, serverAddr, func(key ed25519.PublicKey) error {
+		keyErr = verify(key)
+		return keyErr
+	}, joinTimeout)
+	if err != nil {
+		udpConn.Close()
+		err = fmt.Errorf("не удалось установить защищенное соединение: %w", err)
+		if keyErr != nil {
+			return nil, &disconnectError{err}
+		}
+		return nil, err
+	}
+
+	// Управляющий канал с надежной упорядоченной доставкой поверх шифрования
+	s := &session{
+		udp:    udpConn,
+		secure: secureConn,
+		conn:   reliable.New(secureConn),
+		server: serverAddr,
+		lost:   make(chan struct{}),
+	}
+	err = sendMessage(s.conn, serverAddr, &protocol.Join{
+		Username:    config.Username,
+		Token:       currentToken(),
+		IdentityKey: identity.PublicKey(),
+	})
+	if err == nil {
+		err = s.awaitJoin()
+	}
+	if err != nil {
+		s.conn.Close()
+		return nil, err
+	}
+
+	s.lastHeard.Store(time.Now().UnixNano())
+	go s.readLoop()
+	go s.keepalive()
+	return s, nil
+}
+
+// awaitJoin ждет ответа сервера на вход, он приходит первым
+func (s *session) awaitJoin() error {
+	defer s.conn.SetReadDeadline(time.Time{})
+	s.conn.SetReadDeadline(time.Now().Add(joinTimeout))
+
+	buffer := make([]byte, 64*1024)
+	for {
+		n, _, err := s.conn.ReadFrom(buffer)
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return errors.New("сервер не отвечает")
+		}
+		if err != nil {
+			return err
+		}
+		msg, err := protocol.Unmarshal(buffer[:n])
+		if err != nil {
+			continue
+		}
+		result, ok := msg.(*protocol.JoinResult)
+		if !ok {
+			continue
+		}
+
+		if !result.Accepted {
+			return rejectError(result.Reason)
+		}
+		s.voiceToken = result.VoiceToken
+		return nil
+	}
+}
+
+// readLoop разбирает сообщения сервера, пока соединение не закроется
+func (s *session) readLoop() {
+	defer s.markLost()
+
+	// Изображения приходят фрагментами, поэтому хватает буфера на один датаграм
+	buffer := make([]byte, 64*1024)
+	images := protocol.NewReassembler(imageTransferTimeout)
+	for {
+		n, addr, err := s.conn.ReadFrom(buffer)
+		if err != nil {
+			return
+		}
+		if addr.String() != s.server.String() {
+			continue
+		}
+		s.lastHeard.Store(time.Now().UnixNano())
+
+		msg, err := protocol.Unmarshal(buffer[:n])
+		if err != nil {
+			// Некорректные кадры не показываем в чате
+			continue
+		}
+		if shutdown, ok := msg.(*protocol.Shutdown); ok {
+			s.handleShutdown(shutdown)
+			return
+		}
+		handleServerMessage(msg, images)
+	}
+}
+
+// handleShutdown завершает сессию по уведомлению сервера об остановке.
+// Если сервер обещал вернуться, переподключаемся не раньше срока, иначе
+// главный цикл завершит клиент и Electron вернет пользователя на страницу
+// входа.
+func (s *session) handleShutdown(m *protocol.Shutdown) {
+	if m.RestartIn == 0 {
+		s.disconnect = "сервер завершил работу" + reasonSuffix(m.Reason)
+		return
+	}
+	s.restartIn = time.Duration(m.RestartIn) * time.Second
+	printLinef("🛑 Сервер перезапускается%s. Переподключимся через %v", reasonSuffix(m.Reason), s.restartIn)
+}
+
+// keepalive подтверждает серверу, что мы на связи, и замечает, что
+// перестал отвечать сервер
+func (s *session) keepalive() {
+	ticker := time.NewTicker(protocol.KeepaliveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.lost:
+			return
+		case now := <-ticker.C:
+			if now.Sub(time.Unix(0, s.lastHeard.Load())) > serverTimeout {
+				s.markLost()
+				return
+			}
+			sendMessage(s.conn, s.server, &protocol.Keepalive{})
+		}
+	}
+}
+
+func (s *session) markLost() {
+	s.lostOnce.Do(func() { close(s.lost) })
+}
+
+// leave сообщает серверу о выходе, чтобы участники сразу увидели, что мы
+// ушли, и ждет подтверждения доставки
+func (s *session) leave() {
+	if sendMessage(s.conn, s.server, &protocol.Leave{}) == nil {
+		s.conn.Flush(leaveTimeout)
+	}
+}
+
+func (s *session) localPort() int {
+	return s.udp.LocalAddr().(*net.UDPAddr).Port
+}
+
+// unackedMessages возвращает сообщения пользователя, которые сервер не
+// подтвердил до потери связи. Служебные сообщения после переподключения
+// отправляются заново сами.
+func (s *session) unackedMessages() []protocol.Message {
+	var msgs []protocol.Message
+	for _, frame := range s.conn.Unacked(s.server) {
+		msg, err := protocol.Unmarshal(frame)
+		if err != nil {
+			continue
+		}
+		switch msg.(type) {
+		case *protocol.Chat, *protocol.ImageChunk, *protocol.Room:
+			msgs = append(msgs, msg)
+		}
+	}
+	return msgs
+}
+
+// send отправляет сообщения на сервер. Пока связи нет, они ждут в очереди
+// и уйдут после переподключения.
+func send(msgs ...protocol.Message) error {
+	if current == nil {
+		if !pending.Add(msgs...) {
+			return errOutboxFull
+		}
+		return nil
+	}
+	for _, m := range msgs {
+		if err := sendMessage(current.conn, current.server, m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// outbox - очередь сообщений на время без связи. Используется только
+// главным циклом.
+type outbox struct {
+	msgs []protocol.Message
+}
+
+// Add ставит сообщения в очередь целиком или, если места не хватает, не
+// ставит ни одного: изображение без части фрагментов бесполезно
+func (o *outbox) Add(msgs ...protocol.Message) bool {
+	if len(o.msgs)+len(msgs) > maxOutbox {
+		return false
+	}
+	o.msgs = append(o.msgs, msgs...)
+	return true
+}
+
+// Take забирает все сообщения из очереди
+func (o *outbox) Take() []protocol.Message {
+	msgs := o.msgs
+	o.msgs = nil
+	return msgs
+}
+
+// rejectError превращает отказ сервера во вход в ошибку, по типу которой
+// reconnect решает, пробовать ли снова
+func rejectError(reason protocol.RejectReason) error {
+	err := errors.New(reason.String())
+	switch reason {
+	case protocol.RejectNameTaken, protocol.RejectServerFull, protocol.RejectShuttingDown:
+		// Имя может быть занято нашей же прежней сессией, пока сервер не
+		// удалил ее по таймауту, место на сервере - освободиться, а сервер -
+		// перезапуститься
+		return err
+	case protocol.RejectUnauthorized:
+		return &tokenError{err}
+	}
+	return &disconnectError{err}
+}
+
+// reconnectDelay - задержка перед попыткой переподключения с номером
+// attempt, считая с нуля
+func reconnectDelay(attempt int) time.Duration {
+	delay := reconnectMinDelay
+	for i := 0; i < attempt && delay < reconnectMaxDelay; i++ {
+		delay *= 2
+	}
+	return min(delay, reconnectMaxDelay)
+}
+
+// reconnect переподключается, пока не получится, и отдает новое
+// подключение в done. Первая попытка - не раньше wait. Если сервер больше
+// не пускает нас, сообщает Electron и завершает клиент. Если не принят
+// токен, просит Electron выпустить новый строкой TOKEN_EXPIRED и
+// продолжает попытки.
+func reconnect(localPort int, wait time.Duration, done chan<- *session) {
+	time.Sleep(wait)
+	reportedToken := ""
+	for attempt := 0; ; attempt++ {
+		time.Sleep(reconnectDelay(attempt))
+
+		s, err := dial(localPort)
+		if err == nil {
+			done <- s
+			return
+		}
+		var disconnect *disconnectError
+		if errors.As(err, &disconnect) {
+			printLine("DISCONNECTED:" + err.Error())
+			os.Exit(0)
+		}
+		var expired *tokenError
+		if errors.As(err, &expired) {
+			// О каждом токене сообщаем один раз
+			if token := currentToken(); token != reportedToken {
+				reportedToken = token
+				printLine("TOKEN_EXPIRED")
+			}
+		}
+		printLinef("⚠️ Не удалось переподключиться: %v. Следующая попытка через %v", err, reconnectDelay(attempt+1))
+	}
+}
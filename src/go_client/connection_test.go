@@ -0,0 +1,67 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"airchat/protocol"
+)
+
+func TestReconnectDelay(t *testing.T) {
+	want := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 16 * time.Second, 30 * time.Second, 30 * time.Second}
+	for attempt, delay := range want {
+		if got := reconnectDelay(attempt); got != delay {
+			t.Errorf("попытка %d: задержка %v, ожидалось %v", attempt, got, delay)
+		}
+	}
+	if got := reconnectDelay(1000); got != reconnectMaxDelay {
+		t.Errorf("задержка после многих попыток %v, ожидалось %v", got, reconnectMaxDelay)
+	}
+}
+
+func TestRejectError(t *testing.T) {
+	for _, reason := range []protocol.RejectReason{protocol.RejectNameTaken, protocol.RejectServerFull, protocol.RejectShuttingDown} {
+		err := rejectError(reason)
+		var disconnect *disconnectError
+		var expired *tokenError
+		if errors.As(err, &disconnect) || errors.As(err, &expired) {
+			t.Errorf("%v: %T, ожидалась повторная попытка", reason, err)
+		}
+	}
+	var expired *tokenError
+	if err := rejectError(protocol.RejectUnauthorized); !errors.As(err, &expired) {
+		t.Errorf("отказ в токене: %T, ожидался tokenError", err)
+	}
+	for _, reason := range []protocol.RejectReason{protocol.RejectBanned, protocol.RejectInvalidName, protocol.RejectNoIdentity} {
+		var disconnect *disconnectError
+		if err := rejectError(reason); !errors.As(err, &disconnect) {
+			t.Errorf("%v: %T, ожидался disconnectError", reason, err)
+		}
+	}
+}
+
+func TestSendQueuesWithoutConnection(t *testing.T) {
+	defer pending.Take()
+
+	if err := send(&protocol.Room{Action: protocol.RoomActionList}, &protocol.Chat{Ciphertext: []byte{1}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Изображение, которое не помещается целиком, не ставится вовсе
+	chunks := make([]protocol.Message, maxOutbox)
+	for i := range chunks {
+		chunks[i] = &protocol.ImageChunk{}
+	}
+	if err := send(chunks...); err != errOutboxFull {
+		t.Errorf("переполнение очереди: %v", err)
+	}
+
+	msgs := pending.Take()
+	if len(msgs) != 2 || msgs[0].Type() != protocol.TypeRoom || msgs[1].Type() != protocol.TypeChat {
+		t.Errorf("в очереди %v", msgs)
+	}
+	if len(pending.Take()) != 0 {
+		t.Error("очередь не опустела")
+	}
+}
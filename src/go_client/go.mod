@@ -3,6 +3,14 @@ module airchat/client
 go 1.21
 
 require (
+	airchat/protocol v0.0.0
 	github.com/gordonklaus/portaudio v0.0.0-20250206071425-98a94950218b
 	github.com/hraban/opus v0.0.0-20230925203106-0188a62cb302
 )
+
+require (
+	golang.org/x/crypto v0.32.0 // indirect
+	golang.org/x/sys v0.29.0 // indirect
+)
+
+replace airchat/protocol => ../go_protocol
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"airchat/protocol"
+)
+
+// FrameStatus - что джиттер-буфер выдал на очередной такт воспроизведения
+type FrameStatus int
+
+const (
+	FrameEmpty  FrameStatus = iota // Буфер набирает задержку или опустел, играем тишину
+	FramePacket                    // Пакет с ожидаемым номером
+	FrameLost                      // Пакет с ожидаемым номером так и не пришел
+)
+
+// JitterStats - статистика джиттер-буфера
+type JitterStats struct {
+	Delay     time.Duration // Текущая задержка: сколько кадров ждет воспроизведения
+	Target    time.Duration // Целевая задержка по измеренному джиттеру
+	Jitter    time.Duration // Оценка джиттера по RFC 3550
+	Received  uint64        // Принято пакетов
+	Late      uint64        // Пришли после того, как их номер уже проигран
+	Discarded uint64        // Отброшены: дубликаты и сброс лишней задержки
+	Lost      uint64        // Не пришли к моменту воспроизведения
+	Recovered uint64        // Потерянные кадры, восстановленные по FEC
+	Concealed uint64        // Потерянные кадры, замаскированные PLC
+}
+
+// JitterBuffer упорядочивает пакеты Opus по номеру из заголовка и выдает
+// их по одному на каждый кадр воспроизведения. Целевая задержка
+// подстраивается под измеренный джиттер в пределах от minFrames до
+// maxFrames кадров: при опустошении буфер заново набирает задержку, а
+// лишнюю задержку сбрасывает, отбрасывая самые старые кадры.
+type JitterBuffer struct {
+	mutex sync.Mutex
+
+	packets map[uint16][]byte // Ожидающие воспроизведения пакеты по номеру
+	nextSeq uint16            // Номер следующего воспроизводимого кадра
+	newest  uint16            // Самый новый принятый номер
+	started bool              // Принят ли хотя бы один пакет
+	playing bool              // Набрана ли задержка для воспроизведения
+
+	minFrames int
+	maxFrames int
+	target    int // Целевая задержка в кадрах
+
+	// Оценка джиттера по RFC 3550 в сэмплах
+	jitter      float64
+	lastTransit int64
+	haveTransit bool
+	epoch       time.Time // Точка отсчета времени прихода
+
+	stats JitterStats
+}
+
+func NewJitterBuffer(minFrames, maxFrames int) *JitterBuffer {
+	return &JitterBuffer{
+		packets:   make(map[uint16][]byte),
+		minFrames: minFrames,
+		maxFrames: maxFrames,
+		target:    minFrames,
+	}
+}
+
+// Add кладет пакет в буфер. arrival - время прихода пакета.
+func (jb *JitterBuffer) Add(h protocol.VoiceHeader, payload []byte, arrival time.Time) {
+	jb.mutex.Lock()
+	defer jb.mutex.Unlock()
+
+	jb.stats.Received++
+	jb.updateJitterLocked(h.Timestamp, arrival)
+
+	if !jb.started {
+		jb.started = true
+		jb.nextSeq = h.Seq
+		jb.newest = h.Seq
+	}
+
+	diff := protocol.SeqDiff(h.Seq, jb.nextSeq)
+	switch {
+	case diff < 0 && jb.playing:
+		// Номер уже проигран
+		jb.stats.Late++
+		return
+	case diff < 0:
+		// До начала воспроизведения начинаем с самого раннего номера
+		jb.nextSeq = h.Seq
+	case diff >= 2*jb.maxFrames:
+		// Поток перескочил далеко вперед: начинаем заново с этого пакета
+		jb.stats.Discarded += uint64(len(jb.packets))
+		jb.packets = make(map[uint16][]byte)
+		jb.nextSeq = h.Seq
+		jb.newest = h.Seq
+		jb.playing = false
+	}
+
+	if _, dup := jb.packets[h.Seq]; dup {
+		jb.stats.Discarded++
+		return
+	}
+
+	// Нагрузка ссылается на буфер приема, поэтому копируем
+	frame := make([]byte, len(payload))
+	copy(frame, payload)
+	jb.packets[h.Seq] = frame
+
+	if protocol.SeqDiff(h.Seq, jb.newest) > 0 {
+		jb.newest = h.Seq
+	}
+}
+
+// Pop выдает кадр на очередной такт воспроизведения
+func (jb *JitterBuffer) Pop() ([]byte, FrameStatus) {
+	jb.mutex.Lock()
+	defer jb.mutex.Unlock()
+
+	if !jb.playing {
+		if !jb.started || jb.spanLocked() < jb.target {
+			return nil, FrameEmpty
+		}
+		jb.playing = true
+	}
+
+	if len(jb.packets) == 0 {
+		// Буфер опустел: снова набираем задержку
+		jb.playing = false
+		return nil, FrameEmpty
+	}
+
+	// Задержка заметно выше целевой: сбрасываем самый старый кадр
+	if jb.spanLocked() > jb.target+2 {
+		if _, ok := jb.packets[jb.nextSeq]; ok {
+			delete(jb.packets, jb.nextSeq)
+			jb.stats.Discarded++
+		} else {
+			jb.stats.Lost++
+		}
+		jb.nextSeq++
+	}
+
+	seq := jb.nextSeq
+	jb.nextSeq++
+	if payload, ok := jb.packets[seq]; ok {
+		delete(jb.packets, seq)
+		return payload, FramePacket
+	}
+	jb.stats.Lost++
+	return nil, FrameLost
+}
+
+// PeekNext возвращает пакет, который будет выдан следующим, не забирая
+// его. После FrameLost это пакет сразу за потерянным: в нем лежит FEC
+// потерянного кадра.
+func (jb *JitterBuffer) PeekNext() ([]byte, bool) {
+	jb.mutex.Lock()
+	defer jb.mutex.Unlock()
+
+	payload, ok := jb.packets[jb.nextSeq]
+	return payload, ok
+}
+
+// NoteConcealed учитывает потерянный кадр, восстановленный по FEC
+// (fec) или замаскированный PLC
+func (jb *JitterBuffer) NoteConcealed(fec bool) {
+	jb.mutex.Lock()
+	defer jb.mutex.Unlock()
+
+	if fec {
+		jb.stats.Recovered++
+	} else {
+		jb.stats.Concealed++
+	}
+}
+
+// Stats возвращает текущую статистику
+func (jb *JitterBuffer) Stats() JitterStats {
+	jb.mutex.Lock()
+	defer jb.mutex.Unlock()
+
+	stats := jb.stats
+	stats.Delay = framesToDuration(jb.spanLocked())
+	stats.Target = framesToDuration(jb.target)
+	stats.Jitter = time.Duration(jb.jitter / sampleRate * float64(time.Second))
+	return stats
+}
+
+// spanLocked - число кадров от следующего воспроизводимого до самого нового
+func (jb *JitterBuffer) spanLocked() int {
+	if len(jb.packets) == 0 {
+		return 0
+	}
+	return protocol.SeqDiff(jb.newest, jb.nextSeq) + 1
+}
+
+// updateJitterLocked обновляет оценку джиттера (RFC 3550, 6.4.1) и
+// целевую задержку: три джиттера плюс один кадр запаса
+func (jb *JitterBuffer) updateJitterLocked(timestamp uint32, arrival time.Time) {
+	if jb.epoch.IsZero() {
+		jb.epoch = arrival
+	}
+	arrivalSamples := arrival.Sub(jb.epoch).Nanoseconds() * sampleRate / int64(time.Second)
+	transit := arrivalSamples - int64(timestamp)
+
+	if jb.haveTransit {
+		d := math.Abs(float64(transit - jb.lastTransit))
+		// Скачок метки времени больше секунды - новый поток, а не джиттер
+		if d < sampleRate {
+			jb.jitter += (d - jb.jitter) / 16
+		}
+	}
+	jb.lastTransit = transit
+	jb.haveTransit = true
+
+	target := int(math.Ceil(3*jb.jitter/frameSize)) + 1
+	if target < jb.minFrames {
+		target = jb.minFrames
+	} else if target > jb.maxFrames {
+		target = jb.maxFrames
+	}
+	jb.target = target
+}
+
+func framesToDuration(frames int) time.Duration {
+	return time.Duration(frames) * frameSize * time.Second / sampleRate
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"airchat/protocol"
+)
+
+// feed кладет пакеты с номерами seqs, как будто они пришли вовремя
+func feed(jb *JitterBuffer, start time.Time, seqs ...uint16) {
+	for _, seq := range seqs {
+		h := protocol.VoiceHeader{Kind: protocol.VoiceAudio, Seq: seq, Timestamp: uint32(seq) * frameSize}
+		jb.Add(h, []byte{byte(seq)}, start.Add(framesToDuration(int(seq))))
+	}
+}
+
+func TestJitterBufferReorders(t *testing.T) {
+	jb := NewJitterBuffer(2, 20)
+	feed(jb, time.Now(), 1, 0, 3, 2)
+
+	for want := 0; want < 4; want++ {
+		payload, status := jb.Pop()
+		if status != FramePacket || payload[0] != byte(want) {
+			t.Fatalf("кадр %d: получено %v %v", want, payload, status)
+		}
+	}
+	if _, status := jb.Pop(); status != FrameEmpty {
+		t.Errorf("пустой буфер выдал %v", status)
+	}
+}
+
+func TestJitterBufferLateAndLost(t *testing.T) {
+	jb := NewJitterBuffer(2, 20)
+	start := time.Now()
+	feed(jb, start, 0, 1, 3)
+
+	jb.Pop() // 0
+	jb.Pop() // 1
+	if _, status := jb.Pop(); status != FrameLost {
+		t.Fatalf("пропуск 2: получено %v", status)
+	}
+	feed(jb, start, 2) // уже поздно
+	if payload, status := jb.Pop(); status != FramePacket || payload[0] != 3 {
+		t.Fatalf("кадр 3: получено %v %v", payload, status)
+	}
+
+	stats := jb.Stats()
+	if stats.Late != 1 || stats.Lost != 1 || stats.Received != 4 {
+		t.Errorf("статистика %+v", stats)
+	}
+}
+
+func TestJitterBufferWaitsForTarget(t *testing.T) {
+	jb := NewJitterBuffer(3, 20)
+	feed(jb, time.Now(), 10, 11)
+	if _, status := jb.Pop(); status != FrameEmpty {
+		t.Fatalf("воспроизведение до набора задержки: %v", status)
+	}
+	feed(jb, time.Now(), 12)
+	if _, status := jb.Pop(); status != FramePacket {
+		t.Fatalf("после набора задержки: %v", status)
+	}
+}
+
+func TestJitterBufferAdaptsToJitter(t *testing.T) {
+	jb := NewJitterBuffer(2, 20)
+	start := time.Now()
+
+	// Пакеты приходят то вовремя, то с опозданием на 60мс
+	for seq := uint16(0); seq < 200; seq++ {
+		arrival := start.Add(framesToDuration(int(seq)))
+		if seq%2 == 1 {
+			arrival = arrival.Add(60 * time.Millisecond)
+		}
+		h := protocol.VoiceHeader{Kind: protocol.VoiceAudio, Seq: seq, Timestamp: uint32(seq) * frameSize}
+		jb.Add(h, []byte{0}, arrival)
+	}
+
+	stats := jb.Stats()
+	if stats.Target <= framesToDuration(2) || stats.Target > framesToDuration(20) {
+		t.Errorf("целевая задержка %v не подстроилась под джиттер %v", stats.Target, stats.Jitter)
+	}
+}
+
+func TestJitterBufferDuplicate(t *testing.T) {
+	jb := NewJitterBuffer(2, 20)
+	feed(jb, time.Now(), 5, 5)
+	if stats := jb.Stats(); stats.Discarded != 1 {
+		t.Errorf("дубликат не отброшен: %+v", stats)
+	}
+}
+
+func TestJitterBufferPeekNextAfterLoss(t *testing.T) {
+	jb := NewJitterBuffer(2, 20)
+	feed(jb, time.Now(), 0, 2)
+
+	jb.Pop() // 0
+	if _, status := jb.Pop(); status != FrameLost {
+		t.Fatalf("пропуск 1: получено %v", status)
+	}
+
+	// Пакет 2 несет FEC потерянного кадра 1 и остается в буфере
+	next, ok := jb.PeekNext()
+	if !ok || next[0] != 2 {
+		t.Fatalf("PeekNext: %v %v", next, ok)
+	}
+	jb.NoteConcealed(true)
+
+	if payload, status := jb.Pop(); status != FramePacket || payload[0] != 2 {
+		t.Fatalf("кадр 2: получено %v %v", payload, status)
+	}
+	if stats := jb.Stats(); stats.Recovered != 1 || stats.Lost != 1 {
+		t.Errorf("статистика %+v", stats)
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"airchat/protocol/secure"
+)
+
+// defaultKnownServers - файл с отпечатками ключей серверов, к которым
+// клиент уже подключался
+func defaultKnownServers() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "known_servers"
+	}
+	return filepath.Join(dir, "AirChat", "known_servers")
+}
+
+// verifyServerKey проверяет ключ сервера server (host:port). Если отпечаток
+// задан в конфигурации, ключ должен с ним совпасть. Иначе ключ сверяется
+// с сохраненным в known_servers, а при первом подключении запоминается.
+func verifyServerKey(server, pinned, knownServers string) secure.VerifyFunc {
+	return func(key ed25519.PublicKey) error {
+		fingerprint := secure.Fingerprint(key)
+		if pinned != "" {
+			if !strings.EqualFold(pinned, fingerprint) {
+				return fmt.Errorf("ключ сервера %s не совпадает с заданным в server_key: получен %s", server, fingerprint)
+			}
+			return nil
+		}
+
+		known, err := readKnownServers(knownServers)
+		if err != nil {
+			return err
+		}
+		if saved, ok := known[server]; ok {
+			if saved != fingerprint {
+				return fmt.Errorf("ключ сервера %s изменился: сохранен %s, получен %s. Если сервер сменил ключ, удалите строку из %s",
+					server, saved, fingerprint, knownServers)
+			}
+			return nil
+		}
+
+		if err := appendKnownServer(knownServers, server, fingerprint); err != nil {
+			return err
+		}
+		fmt.Printf("🔑 Новый сервер %s, отпечаток ключа %s\n", server, fingerprint)
+		return nil
+	}
+}
+
+// readKnownServers читает строки вида "host:port отпечаток"
+func readKnownServers(path string) (map[string]string, error) {
+	known := make(map[string]string)
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return known, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && !strings.HasPrefix(fields[0], "#") {
+			known[fields[0]] = fields[1]
+		}
+	}
+	return known, scanner.Err()
+}
+
+func appendKnownServer(path, server, fingerprint string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(f, "%s %s\n", server, fingerprint); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
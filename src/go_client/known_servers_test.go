@@ -0,0 +1,61 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"airchat/protocol/secure"
+)
+
+func newServerKey(t *testing.T) ed25519.PublicKey {
+	t.Helper()
+	public, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return public
+}
+
+func TestVerifyServerKeyTrustOnFirstUse(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "AirChat", "known_servers")
+	key, other := newServerKey(t), newServerKey(t)
+
+	verify := verifyServerKey("chat.example.com:6000", "", path)
+	if err := verify(key); err != nil {
+		t.Fatalf("первое подключение: %v", err)
+	}
+	if err := verify(key); err != nil {
+		t.Errorf("повторное подключение с тем же ключом: %v", err)
+	}
+	if err := verify(other); err == nil || !strings.Contains(err.Error(), "изменился") {
+		t.Errorf("подмененный ключ: %v", err)
+	}
+
+	// Другой сервер запоминается отдельно
+	if err := verifyServerKey("[::1]:6000", "", path)(other); err != nil {
+		t.Errorf("второй сервер: %v", err)
+	}
+	known, err := readKnownServers(path)
+	if err != nil || len(known) != 2 {
+		t.Errorf("known_servers: %v, %v", known, err)
+	}
+}
+
+func TestVerifyServerKeyPinned(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "known_servers")
+	key := newServerKey(t)
+	pinned := strings.ToUpper(secure.Fingerprint(key))
+
+	if err := verifyServerKey("host:6000", pinned, path)(key); err != nil {
+		t.Errorf("совпадающий отпечаток: %v", err)
+	}
+	if err := verifyServerKey("host:6000", pinned, path)(newServerKey(t)); err == nil {
+		t.Error("несовпадающий отпечаток принят")
+	}
+	if known, _ := readKnownServers(path); len(known) != 0 {
+		t.Errorf("заданный отпечаток не должен сохраняться: %v", known)
+	}
+}
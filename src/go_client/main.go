@@ -2,24 +2,34 @@ package main
 
 import (
 	"bufio"
+	"errors"
+	"flag"
 	"fmt"
 	"math"
 	"net"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
+	"airchat/protocol"
+	"airchat/protocol/e2e"
+	"airchat/protocol/secure"
+
 	"github.com/gordonklaus/portaudio"
 	"github.com/hraban/opus"
 )
 
 const (
-	sampleRate       = 48000
-	channels         = 1
-	frameSize        = 960  // 20мс при 48кГц
-	maxBytes         = 1275 // Максимальный размер пакета Opus
-	jitterBufferSize = 20   // 400мс буфер для большей стабильности
-	noiseThreshold   = 0.02 // Порог шумоподавления (возможно, стоит также пересмотреть)
+	sampleRate     = 48000
+	channels       = 1
+	frameSize      = 960  // 20мс при 48кГц
+	maxBytes       = 1275 // Максимальный размер пакета Opus
+	noiseThreshold = 0.02 // Порог шумоподавления (возможно, стоит также пересмотреть)
 
 	// Константы обработки аудио
 	vadThreshold         = 0.005 // Порог определения голосовой активности
@@ -30,7 +40,20 @@ const (
 
 	// Константы буферизации
 	inputBufferMultiplier = 3 // Размер входного буфера относительно frameSize
-	minBufferThreshold    = 7 // Минимальное количество фреймов для начала воспроизведения
+	maxConcealFrames      = 5 // Сколько потерянных подряд кадров маскировать PLC, дальше тишина
+
+	// Время на получение всех фрагментов изображения
+	imageTransferTimeout = 30 * time.Second
+
+	// Время ожидания ответа сервера на вход
+	joinTimeout = 10 * time.Second
+
+	// Сколько при выходе ждать, пока сервер подтвердит Leave
+	leaveTimeout = time.Second
+
+	// VoiceHello при входе в войс шлем несколько раз подряд на случай потерь
+	voiceHelloBurst    = 5
+	voiceHelloInterval = 100 * time.Millisecond
 )
 
 var (
@@ -39,6 +62,16 @@ var (
 	audioWg       sync.WaitGroup
 	paInitialized bool = false
 
+	// Идентификатор последней передачи изображения
+	nextTransferID atomic.Uint32
+
+	// Ключ сквозного шифрования клиента и ключи участников комнаты
+	identity *e2e.Identity
+	peers    = newPeerKeys()
+
+	// Потоки говорящих, их громкость и статистика
+	voiceMixer = NewStreamMixer()
+
 	// Вычисляем количество кадров для удержания VAD
 	// Длительность одного фрейма = frameSize / sampleRate = 960 / 48000 = 0.02 сек = 20 мс
 	vadHangoverFrames = vadHangoverTimeMs / 20
@@ -59,62 +92,7 @@ type AudioBuffer struct {
 	InputBuffer   []float32
 	OutputBuffer  []float32
 	OpusInputBuf  []int16
-	OpusOutputBuf []int16
 	Encoder       *opus.Encoder
-	Decoder       *opus.Decoder
-	JitterBuffer  [][]float32 // Буфер для сглаживания воспроизведения
-}
-
-// JitterBuffer управляет временем пакетов аудио
-type JitterBuffer struct {
-	buffer    [][]float32
-	maxSize   int
-	frameSize int
-	mutex     sync.RWMutex
-}
-
-func NewJitterBuffer(size int, frameSize int) *JitterBuffer {
-	return &JitterBuffer{
-		buffer:    make([][]float32, 0, size),
-		maxSize:   size,
-		frameSize: frameSize,
-	}
-}
-
-func (jb *JitterBuffer) Add(data []float32) {
-	jb.mutex.Lock()
-	defer jb.mutex.Unlock()
-
-	if len(jb.buffer) >= jb.maxSize {
-		// Буфер полон, удаляем самый старый фрейм
-		jb.buffer = jb.buffer[1:]
-	}
-
-	// Создаем копию данных
-	frame := make([]float32, len(data))
-	copy(frame, data)
-
-	jb.buffer = append(jb.buffer, frame)
-}
-
-func (jb *JitterBuffer) Get() []float32 {
-	jb.mutex.Lock()
-	defer jb.mutex.Unlock()
-
-	if len(jb.buffer) == 0 {
-		return make([]float32, jb.frameSize) // Возвращаем тишину если буфер пуст
-	}
-
-	// Получаем самый старый фрейм
-	frame := jb.buffer[0]
-	jb.buffer = jb.buffer[1:]
-	return frame
-}
-
-func (jb *JitterBuffer) Available() int {
-	jb.mutex.RLock()
-	defer jb.mutex.RUnlock()
-	return len(jb.buffer)
 }
 
 // Enhanced audio processing
@@ -126,17 +104,25 @@ type AudioProcessor struct {
 	noiseFloor           float32
 	framesSinceLastVoice int // Счетчик кадров с момента последнего обнаружения голоса
 	vadHangoverFrames    int // Количество кадров для удержания VAD
+
+	// Этапы обработки, включаемые в конфигурации
+	highPassEnabled   bool
+	compressorEnabled bool
+	normalizeEnabled  bool
 }
 
 func NewAudioProcessor() *AudioProcessor {
 	return &AudioProcessor{
-		vadEnabled:           true,
+		vadEnabled:           config.VAD,
 		lastVadState:         false,
 		energyThreshold:      vadThreshold,
 		smoothingFactor:      0.95,
 		noiseFloor:           0.001,
 		framesSinceLastVoice: 0,                 // Инициализация счетчика
 		vadHangoverFrames:    vadHangoverFrames, // Инициализация из вычисленной глобальной переменной
+		highPassEnabled:      config.HighPass,
+		compressorEnabled:    config.Compressor,
+		normalizeEnabled:     config.Normalize,
 	}
 }
 
@@ -160,7 +146,7 @@ func (ap *AudioProcessor) ProcessInput(buffer []float32) []float32 {
 	}
 
 	// Мягкий гейт с учетом времени удержания
-	if ap.framesSinceLastVoice > ap.vadHangoverFrames {
+	if ap.vadEnabled && ap.framesSinceLastVoice > ap.vadHangoverFrames {
 		for i := range processed {
 			processed[i] *= softGateFactor // Ослабляем сигнал, а не обнуляем
 		}
@@ -168,13 +154,19 @@ func (ap *AudioProcessor) ProcessInput(buffer []float32) []float32 {
 	}
 
 	// Фильтр высоких частот
-	applyHighPassFilter(processed)
+	if ap.highPassEnabled {
+		applyHighPassFilter(processed)
+	}
 
 	// Динамическая компрессия диапазона
-	ap.applyCompression(processed)
+	if ap.compressorEnabled {
+		ap.applyCompression(processed)
+	}
 
 	// Финальная нормализация амплитуды
-	normalizeAmplitude(processed)
+	if ap.normalizeEnabled {
+		normalizeAmplitude(processed)
+	}
 
 	return processed
 }
@@ -272,47 +264,38 @@ func initAudio() (*AudioBuffer, error) {
 		return nil, fmt.Errorf("failed to create encoder: %v", err)
 	}
 
-	// Оптимальные настройки для голосового чата
-	encoder.SetBitrate(32000)     // 32 kbps для голоса
-	encoder.SetComplexity(8)      // Баланс между качеством и нагрузкой
-	encoder.SetInBandFEC(true)    // Включаем коррекцию ошибок
-	encoder.SetPacketLossPerc(30) // Агрессивная коррекция ошибок
-
-	decoder, err := opus.NewDecoder(sampleRate, channels)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create decoder: %v", err)
-	}
+	// Настройки кодировщика из конфигурации, по умолчанию 32 кбит/с,
+	// сложность 8 и FEC в расчете на 30% потерь
+	encoder.SetBitrate(config.Bitrate)
+	encoder.SetComplexity(config.Complexity)
+	encoder.SetInBandFEC(config.FEC)
+	encoder.SetPacketLossPerc(config.PacketLoss)
 
 	return &AudioBuffer{
 		InputBuffer:   make([]float32, frameSize),
 		OutputBuffer:  make([]float32, frameSize),
 		OpusInputBuf:  make([]int16, frameSize),
-		OpusOutputBuf: make([]int16, frameSize),
 		Encoder:       encoder,
-		Decoder:       decoder,
-		JitterBuffer:  make([][]float32, 0, jitterBufferSize),
 	}, nil
 }
 
-func startAudioStream(conn *net.UDPConn, buffer *AudioBuffer) error {
-	// Увеличиваем буферы UDP
-	conn.SetWriteBuffer(32768) // Увеличиваем буфер отправки
-	conn.SetReadBuffer(32768)  // Увеличиваем буфер приема
-
+// startAudioStream запускает захват и воспроизведение. Исходящие пакеты
+// нумеруются в потоке stream.
+func startAudioStream(conn net.Conn, buffer *AudioBuffer, stream *protocol.VoiceStream, token [protocol.VoiceTokenSize]byte) error {
 	audioState := &AudioState{
 		buffer:      buffer,
 		lastLogTime: time.Now(),
 	}
 
-	// Инициализация устройств
-	defaultOutputDevice, err := portaudio.DefaultOutputDevice()
+	// Инициализация устройств: из конфигурации или по умолчанию
+	defaultOutputDevice, err := findDevice(config.OutputDevice, false, portaudio.DefaultOutputDevice)
 	if err != nil {
-		return fmt.Errorf("ошибка получения устройства вывода по умолчанию: %v", err)
+		return fmt.Errorf("ошибка получения устройства вывода: %v", err)
 	}
 
-	defaultInputDevice, err := portaudio.DefaultInputDevice()
+	defaultInputDevice, err := findDevice(config.InputDevice, true, portaudio.DefaultInputDevice)
 	if err != nil {
-		return fmt.Errorf("ошибка получения устройства ввода по умолчанию: %v", err)
+		return fmt.Errorf("ошибка получения устройства ввода: %v", err)
 	}
 
 	// Открываем входной поток (микрофон)
@@ -375,7 +358,7 @@ func startAudioStream(conn *net.UDPConn, buffer *AudioBuffer) error {
 
 	// Инициализируем аудио процессор и джиттер буфер
 	processor := NewAudioProcessor()
-	jitterBuffer := NewJitterBuffer(jitterBufferSize, frameSize)
+	voiceMixer.Reset()
 
 	// Модифицируем горутину записи
 	audioWg.Add(1)
@@ -386,6 +369,7 @@ func startAudioStream(conn *net.UDPConn, buffer *AudioBuffer) error {
 
 		inputAccumulator := make([]float32, 0, frameSize*inputBufferMultiplier)
 		encodedData := make([]byte, maxBytes)
+		packet := make([]byte, 0, protocol.VoiceHeaderSize+maxBytes)
 
 		for {
 			select {
@@ -421,8 +405,9 @@ func startAudioStream(conn *net.UDPConn, buffer *AudioBuffer) error {
 					}
 					
 					if n > 0 && n <= maxBytes {
-						// Отправляем данные без шифрования
-						_, writeErr := conn.Write(encodedData[:n])
+						// Отправляем данные с заголовком потока, шифрует их voiceConn сессии
+						packet = protocol.AppendVoicePacket(packet[:0], stream.Next(frameSize), encodedData[:n])
+						_, writeErr := conn.Write(packet)
 						if writeErr != nil {
 							// Логируем ошибки отправки, но не останавливаемся
 							continue
@@ -435,32 +420,40 @@ func startAudioStream(conn *net.UDPConn, buffer *AudioBuffer) error {
 		}
 	}()
 
-	// Добавляем горутину для отправки heartbeat
+	// Горутина VoiceHello: по токену сервер узнает адрес нашего сокета.
+	// Повторяем его вместо heartbeat, чтобы пережить смену адреса в NAT.
 	audioWg.Add(1)
 	go func() {
 		defer audioWg.Done()
+
+		hello := protocol.AppendVoicePacket(nil, stream.Hello(), token[:])
+		for i := 0; i < voiceHelloBurst; i++ {
+			conn.Write(hello)
+			select {
+			case <-stopAudio:
+				return
+			case <-time.After(voiceHelloInterval):
+			}
+		}
+
 		ticker := time.NewTicker(1 * time.Second)
 		defer ticker.Stop()
-
-		heartbeat := []byte{0}
 		for {
 			select {
 			case <-stopAudio:
 				return
 			case <-ticker.C:
-				conn.Write(heartbeat)
+				conn.Write(hello)
 			}
 		}
 	}()
 
-	// Модифицируем горутину воспроизведения
+	// Горутина приема: пакеты раскладываются по джиттер-буферам потоков
 	audioWg.Add(1)
 	go func() {
 		defer audioWg.Done()
-		defer audioState.outputStream.Stop()
-		defer audioState.outputStream.Close()
 
-		receiveBuf := make([]byte, maxBytes)
+		receiveBuf := make([]byte, protocol.VoiceHeaderSize+maxBytes)
 
 		for {
 			select {
@@ -468,51 +461,47 @@ func startAudioStream(conn *net.UDPConn, buffer *AudioBuffer) error {
 				return
 			default:
 				conn.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
-				n, _, err := conn.ReadFromUDP(receiveBuf)
+				n, err := conn.Read(receiveBuf)
 				if err != nil {
-					if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
-						continue
-					}
 					continue
 				}
 
-				// Пропускаем heartbeat пакеты
-				if n == 1 && receiveBuf[0] == 0 {
+				header, payload, err := protocol.ParseVoicePacket(receiveBuf[:n])
+				if err != nil {
 					continue
 				}
 
-				// Декодируем полученные данные без расшифровки
-				samplesRead, err := buffer.Decoder.Decode(receiveBuf[:n], buffer.OpusOutputBuf)
-				if err != nil || samplesRead != frameSize {
-					// Логируем ошибки декодирования
-					fmt.Printf("❌ Ошибка декодирования Opus: err=%v, samples=%d, expected=%d, packetSize=%d\n", 
-						err, samplesRead, frameSize, n)
+				// Пропускаем heartbeat пакеты
+				if header.Kind == protocol.VoiceHeartbeat {
 					continue
 				}
 
-				// Конвертируем в float32
-				audioFloat := int16ToFloat32(buffer.OpusOutputBuf)
-
-				// Временно отключаем обработку для выходного аудио
-				// processed := processor.ProcessInput(audioFloat)
-				processed := audioFloat
-
-				// Добавляем в джиттер буфер
-				jitterBuffer.Add(processed)
+				if err := voiceMixer.Add(header, payload, time.Now()); err != nil {
+					printLine("❌ " + err.Error())
+				}
+			}
+		}
+	}()
 
-				// Воспроизводим только если есть достаточно данных в джиттер-буфере
-				if jitterBuffer.Available() >= minBufferThreshold {
-					// Получаем следующий фрейм из джиттер буфера
-					playbackData := jitterBuffer.Get()
+	// Горутина воспроизведения: каждый кадр сводит очередные кадры всех
+	// потоков. Запись в PortAudio блокируется до освобождения места,
+	// поэтому темп задает устройство вывода.
+	audioWg.Add(1)
+	go func() {
+		defer audioWg.Done()
+		defer audioState.outputStream.Stop()
+		defer audioState.outputStream.Close()
 
-					// Копируем в выходной буфер PortAudio
-					copy(buffer.OutputBuffer, playbackData)
+		for {
+			select {
+			case <-stopAudio:
+				return
+			default:
+				voiceMixer.Mix(buffer.OutputBuffer, time.Now())
 
-					// Воспроизводим
-					err = audioState.outputStream.Write()
-					if err != nil {
-						continue
-					}
+				// Воспроизводим
+				if err := audioState.outputStream.Write(); err != nil {
+					time.Sleep(10 * time.Millisecond)
 				}
 			}
 		}
@@ -521,7 +510,119 @@ func startAudioStream(conn *net.UDPConn, buffer *AudioBuffer) error {
 	return nil
 }
 
+// concealLostFrame восстанавливает потерянный кадр в pcm: по FEC из
+// следующего пакета, если он уже в буфере, иначе PLC декодера для первых
+// maxConcealFrames потерь подряд. Возвращает false, если играть тишину.
+func concealLostFrame(decoder *opus.Decoder, jb *JitterBuffer, lostRun int, pcm []int16) bool {
+	if next, ok := jb.PeekNext(); ok {
+		if err := decoder.DecodeFEC(next, pcm); err == nil {
+			jb.NoteConcealed(true)
+			return true
+		}
+	}
+	if lostRun > maxConcealFrames {
+		return false
+	}
+	if err := decoder.DecodePLC(pcm); err != nil {
+		return false
+	}
+	jb.NoteConcealed(false)
+	return true
+}
+
+// cutLast делит s по последнему пробелу
+func cutLast(s string) (before, after string, found bool) {
+	i := strings.LastIndexByte(s, ' ')
+	if i < 0 {
+		return s, "", false
+	}
+	return strings.TrimSpace(s[:i]), s[i+1:], true
+}
+
+// sendMessage упаковывает сообщение в кадр и отправляет его на сервер
+func sendMessage(conn net.PacketConn, serverAddr net.Addr, m protocol.Message) error {
+	frame, err := protocol.Marshal(m)
+	if err != nil {
+		return err
+	}
+	_, err = conn.WriteTo(frame, serverAddr)
+	return err
+}
+
+// sendImage шифрует изображение для участников комнаты, режет конверт на
+// фрагменты и отправляет их на сервер
+func sendImage(data []byte) error {
+	envelope, err := sealMessage("image", data)
+	if err != nil {
+		return err
+	}
+	chunks, err := protocol.SplitImage(nextTransferID.Add(1), envelope)
+	if err != nil {
+		return err
+	}
+	msgs := make([]protocol.Message, len(chunks))
+	for i, chunk := range chunks {
+		msgs[i] = chunk
+	}
+	return send(msgs...)
+}
+
+// reasonSuffix дописывает причину к уведомлению, если она есть
+func reasonSuffix(reason string) string {
+	if reason == "" {
+		return ""
+	}
+	return ": " + reason
+}
+
+// printMessage выводит сообщение сервера в stdout в текстовом формате,
+// который разбирает Electron
+func printMessage(msg protocol.Message) {
+	switch m := msg.(type) {
+	case *protocol.Join:
+		printLine(m.Username + " joined the chat")
+	case *protocol.Leave:
+		printLine(m.Username + " left the chat")
+	case *protocol.VoiceState:
+		if m.Connected {
+			printLine(m.Username + " подключился к голосовому чату")
+		} else {
+			printLine(m.Username + " отключился от голосового чата")
+		}
+	case *protocol.RoomList:
+		names := make([]string, 0, len(m.Rooms))
+		for _, room := range m.Rooms {
+			names = append(names, fmt.Sprintf("%s (%d)", room.Name, room.Members))
+		}
+		printLine("📁 Комнаты: " + strings.Join(names, ", "))
+	case *protocol.RoomJoined:
+		printLine("📁 Вы в комнате «" + m.Name + "»")
+	case *protocol.Error:
+		printLine("❌ " + m.Message)
+	case *protocol.Notice:
+		switch m.Kind {
+		case protocol.NoticeMuted:
+			printLine("🔇 Администратор заглушил ваш голос на сервере" + reasonSuffix(m.Text))
+		case protocol.NoticeUnmuted:
+			printLine("🔊 Администратор вернул ваш голос")
+		case protocol.NoticeAnnouncement:
+			printLine("📢 Объявление сервера: " + m.Text)
+		}
+	}
+}
+
 func main() {
+	// Флаги и файл конфигурации, по умолчанию - переменные окружения от Electron
+	var err error
+	config, err = loadConfig(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		fmt.Printf("Ошибка: %v\n", err)
+		return
+	}
+
 	// Инициализируем PortAudio в начале программы
 	if err := initPortAudio(); err != nil {
 		fmt.Printf("Ошибка инициализации PortAudio: %v\n", err)
@@ -530,173 +631,389 @@ func main() {
 	// Гарантируем завершение работы PortAudio при выходе
 	defer terminatePortAudio()
 
-	// Получаем IP сервера и имя пользователя из переменных окружения
-	serverIP := os.Getenv("SERVER_IP")
-	username := os.Getenv("USERNAME")
+	if config.ListDevices {
+		if err := printDevices(); err != nil {
+			fmt.Printf("Ошибка получения списка устройств: %v\n", err)
+		}
+		return
+	}
 
-	// Проверяем, что переменные окружения установлены
-	if serverIP == "" {
-		fmt.Println("Ошибка: Не указан IP сервера (переменная окружения SERVER_IP).")
+	identity, err = e2e.LoadOrCreateIdentity(config.IdentityKey)
+	if err != nil {
+		fmt.Printf("Ошибка загрузки ключа сквозного шифрования: %v\n", err)
 		return
 	}
+	// Свои сообщения сервер возвращает отправителю, поэтому свой ключ
+	// тоже среди получателей
+	peers.Add(config.Username, identity.PublicKey())
 
-	if username == "" {
-		fmt.Println("Ошибка: Не указано имя пользователя (переменная окружения USERNAME).")
-		return	
+	// Подключаемся и сообщаем результат входа Electron
+	reportState(stateConnecting)
+	current, err = dial(0)
+	if err != nil {
+		printLine("JOIN_REJECTED:" + err.Error())
+		return
 	}
+	fmt.Println("JOIN_ACCEPTED")
+	reportState(stateConnected)
+	own := identity.PublicKey()
+	fmt.Println("🔑 Отпечаток вашего ключа: " + secure.Fingerprint(own[:]))
+
+	// Команды из стандартного ввода (от Electron) читаем отдельно, чтобы
+	// главный цикл тем временем следил за связью с сервером
+	lines := make(chan string)
+	go func() {
+		defer close(lines)
+		scanner := bufio.NewScanner(os.Stdin)
+		// Увеличиваем буфер для поддержки больших изображений в base64
+		scanner.Buffer(make([]byte, 64*1024), 10*1024*1024) // 10MB максимум для изображений
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+		// Проверяем ошибки сканера
+		if err := scanner.Err(); err != nil {
+			fmt.Printf("❌ Ошибка чтения stdin: %v\n", err)
+		}
+	}()
 
-	serverAddr, err := net.ResolveUDPAddr("udp", serverIP+":6000")
+	// Electron при закрытии приложения завершает клиент через SIGTERM
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	reconnected := make(chan *session)
+	for {
+		var lost <-chan struct{}
+		if current != nil {
+			lost = current.lost
+		}
+
+		select {
+		case text, ok := <-lines:
+			if ok && !handleCommand(text) {
+				continue
+			}
+			// /exit или Electron закрыл stdin
+			stopVoice()
+			if current != nil {
+				current.leave()
+				current.conn.Close()
+			}
+			return
+
+		case <-signals:
+			stopVoice()
+			if current != nil {
+				current.leave()
+				current.conn.Close()
+			}
+			return
+
+		case <-lost:
+			if current.disconnect != "" {
+				stopVoice()
+				current.conn.Close()
+				printLine("DISCONNECTED:" + current.disconnect)
+				return
+			}
+			// Об остановке сервера уже сообщил handleShutdown
+			if current.restartIn == 0 {
+				fmt.Println("⚠️ Связь с сервером потеряна, переподключаемся...")
+			}
+			reportState(stateReconnecting)
+			// Что сервер не успел подтвердить, отправим заново
+			pending.Add(current.unackedMessages()...)
+			port, wait := current.localPort(), current.restartIn
+			current.conn.Close()
+			current = nil
+
+			// Голосовой токен прежнего подключения не действует, голос
+			// подключим заново
+			restoreVoice = voiceConn != nil
+			stopVoice()
+			go reconnect(port, wait, reconnected)
+
+		case s := <-reconnected:
+			current = s
+			reportState(stateConnected)
+			fmt.Println("✅ Связь с сервером восстановлена")
+			for _, m := range pending.Take() {
+				if err := send(m); err != nil {
+					fmt.Printf("❌ Ошибка отправки: %v\n", err)
+					break
+				}
+			}
+			if restoreVoice {
+				restoreVoice = false
+				startVoice(current)
+			}
+		}
+	}
+}
+
+// handleServerMessage выводит сообщение сервера и обновляет ключи и
+// голосовые потоки участников. Вызывается из читающей горутины.
+func handleServerMessage(msg protocol.Message, images *protocol.Reassembler) {
+	// Исключенного клиента сервер уже удалил, Electron вернет
+	// пользователя на страницу входа с причиной. Переподключаться не нужно.
+	if notice, ok := msg.(*protocol.Notice); ok &&
+		(notice.Kind == protocol.NoticeKicked || notice.Kind == protocol.NoticeBanned) {
+		reason := "вас исключил администратор"
+		if notice.Kind == protocol.NoticeBanned {
+			reason = "вас заблокировал администратор"
+		}
+		printLine("DISCONNECTED:" + reason + reasonSuffix(notice.Text))
+		os.Exit(0)
+	}
+
+	if chunk, ok := msg.(*protocol.ImageChunk); ok {
+		image, done, err := images.Add(chunk)
+		if err != nil {
+			printLinef("❌ Ошибка получения изображения от %s: %v", chunk.Sender, err)
+			return
+		}
+		if !done {
+			return
+		}
+		image, err = openMessage("image", chunk.Sender, image)
+		if errors.Is(err, e2e.ErrReplay) {
+			// Уже показанное сообщение, например повторно отправленное
+			// после переподключения
+			return
+		}
+		if err != nil {
+			printLinef("❌ Не удалось расшифровать изображение от %s: %v", chunk.Sender, err)
+			return
+		}
+		printLine("[" + chunk.Sender + "]: IMAGE_DATA:" + string(image))
+		return
+	}
+
+	if chat, ok := msg.(*protocol.Chat); ok {
+		text, err := openMessage("chat", chat.Sender, chat.Ciphertext)
+		if errors.Is(err, e2e.ErrReplay) {
+			return
+		}
+		if err != nil {
+			printLinef("❌ Не удалось расшифровать сообщение от %s: %v", chat.Sender, err)
+			return
+		}
+		printLine("[" + chat.Sender + "]: " + string(text))
+		return
+	}
+	// Сопоставляем голосовые потоки с участниками
+	switch m := msg.(type) {
+	case *protocol.VoiceState:
+		if m.Connected {
+			if err := voiceMixer.SetOwner(m.StreamID, m.Username); err != nil {
+				printLine("⚠️ Голосовой поток не принят: " + err.Error())
+			}
+		} else {
+			voiceMixer.ForgetUser(m.Username)
+		}
+	case *protocol.Join:
+		if peers.Add(m.Username, m.IdentityKey) {
+			printLinef("⚠️ Ключ участника %s изменился, новый отпечаток %s. Сверьте его с собеседником: /keys",
+				m.Username, secure.Fingerprint(m.IdentityKey[:]))
+		}
+	case *protocol.Leave:
+		voiceMixer.ForgetUser(m.Username)
+		peers.Remove(m.Username)
+	}
+
+	printMessage(msg) // Основной вывод для Electron - только сообщения от сервера
+}
+
+// startVoice подключает голосовой чат через подключение s
+func startVoice(s *session) {
+	// Проверяем, что PortAudio инициализирован
+	if !paInitialized {
+		if err := initPortAudio(); err != nil {
+			fmt.Printf("❌ Ошибка инициализации PortAudio: %v\n", err)
+			return
+		}
+	}
+
+	// Подключаемся к голосовому чату
+	voiceHostPort, _ := config.VoiceAddr()
+	voiceAddr, err := net.ResolveUDPAddr("udp", voiceHostPort)
 	if err != nil {
-		fmt.Println("Ошибка разрешения адреса:", err)
+		fmt.Printf("❌ Ошибка разрешения голосового адреса: %v\n", err)
 		return
 	}
 
-	conn, err := net.DialUDP("udp", nil, serverAddr)
+	voiceConn, err = net.DialUDP("udp", nil, voiceAddr)
 	if err != nil {
-		fmt.Println("Ошибка подключения:", err)
+		fmt.Printf("❌ Ошибка подключения к голосовому чату: %v\n", err)
+		voiceConn = nil
 		return
 	}
-	defer conn.Close()
 
-	// Отправляем сообщение о подключении
-	_, err = conn.Write([]byte(username + " joined the chat"))
+	// Увеличиваем буферы UDP
+	voiceConn.SetWriteBuffer(32768) // Увеличиваем буфер отправки
+	voiceConn.SetReadBuffer(32768)  // Увеличиваем буфер приема
+
+	// Инициализируем аудио
+	audioBuffer, err := initAudio()
 	if err != nil {
-		fmt.Println("Ошибка отправки:", err)
+		fmt.Printf("❌ Ошибка инициализации аудио: %v\n", err)
+		voiceConn.Close()
+		voiceConn = nil
 		return
 	}
 
-	// Горутина для чтения входящих сообщений
-	go func() {
-		buffer := make([]byte, 12*1024*1024) // Увеличиваем буфер до 12MB для изображений
-		for {
-			n, _, err := conn.ReadFromUDP(buffer)
-			if err != nil {
-				return
-			}
-			// Выводим полученное сообщение в stdout только если оно не служебное
-			receivedMessage := string(buffer[:n])
-			fmt.Println(receivedMessage) // Основной вывод для Electron - только сообщения от сервера
+	// Создаем канал для остановки аудио
+	stopAudio = make(chan struct{})
+
+	// Запускаем аудио потоки
+	stream := protocol.NewVoiceStream(protocol.NewStreamID())
+	err = startAudioStream(s.secure.Voice(voiceConn), audioBuffer, stream, s.voiceToken)
+	if err != nil {
+		fmt.Printf("❌ Ошибка запуска аудио потока: %v\n", err)
+		voiceConn.Close()
+		voiceConn = nil
+		return
+	}
+
+	// Отправляем уведомление о подключении к голосовому чату
+	send(&protocol.VoiceState{Connected: true, StreamID: stream.ID()})
+	// Сообщение о подключении придет от сервера
+}
+
+// stopVoice останавливает аудио потоки и отключает голосовой чат
+func stopVoice() {
+	if voiceConn == nil {
+		return
+	}
+	close(stopAudio)
+	audioWg.Wait()
+
+	if current != nil {
+		send(&protocol.VoiceState{Connected: false})
+	}
+	voiceConn.Close()
+	voiceConn = nil
+}
+
+// handleCommand выполняет команду или отправляет сообщение из stdin.
+// Возвращает true на /exit.
+func handleCommand(text string) (exit bool) {
+	command, arg, _ := strings.Cut(text, " ")
+
+	switch command {
+	case "/voice":
+		switch {
+		case voiceConn != nil || restoreVoice:
+			fmt.Println("⚠️ Вы уже подключены к голосовому чату")
+		case current == nil:
+			restoreVoice = true
+			fmt.Println("🎤 Подключим голосовой чат, когда восстановится связь с сервером")
+		default:
+			startVoice(current)
 		}
-	}()
 
-	// Чтение команд из стандартного ввода (теперь от Electron)
-	scanner := bufio.NewScanner(os.Stdin)
-	// Увеличиваем буфер для поддержки больших изображений в base64
-	scanner.Buffer(make([]byte, 64*1024), 10*1024*1024) // 10MB максимум для изображений
-	for scanner.Scan() {
-		text := scanner.Text()
-
-		switch text {
-		case "/voice":
-			if voiceConn == nil {
-				// fmt.Println("🎤 Начинаем подключение к голосовому чату...")
-				
-				// Проверяем, что PortAudio инициализирован
-				if !paInitialized {
-					// fmt.Println("⚙️ Инициализация PortAudio...")
-					if err := initPortAudio(); err != nil {
-						fmt.Printf("❌ Ошибка инициализации PortAudio: %v\n", err)
-						continue
-					}
-					// fmt.Println("✅ PortAudio инициализирован")
-				}
+	case "/leave":
+		switch {
+		case voiceConn != nil:
+			stopVoice()
+			// Сообщение об отключении придет от сервера
+		case restoreVoice:
+			restoreVoice = false
+		default:
+			fmt.Println("Вы не подключены к голосовому чату")
+		}
 
-				// Подключаемся к голосовому чату
-				voiceAddr, err := net.ResolveUDPAddr("udp", serverIP+":6001")
-				if err != nil {
-					fmt.Printf("❌ Ошибка разрешения голосового адреса: %v\n", err)
-					continue
-				}
-				
-				// fmt.Printf("🌐 Подключаемся к голосовому серверу %s\n", voiceAddr.String())
-				voiceConn, err = net.DialUDP("udp", nil, voiceAddr)
-				if err != nil {
-					fmt.Printf("❌ Ошибка подключения к голосовому чату: %v\n", err)
-					continue
-				}
-				// fmt.Println("✅ UDP соединение для голоса установлено")
+	case "/stats":
+		if voiceConn == nil {
+			fmt.Println("Вы не подключены к голосовому чату")
+			return false
+		}
+		for _, stats := range voiceMixer.Stats() {
+			printLinef("📊 %s: задержка %v (цель %v), джиттер %v, принято %d, опоздало %d, отброшено %d, потеряно %d (FEC %d, PLC %d)",
+				stats.Name, stats.Delay, stats.Target, stats.Jitter.Round(100*time.Microsecond),
+				stats.Received, stats.Late, stats.Discarded, stats.Lost, stats.Recovered, stats.Concealed)
+		}
 
-				// Инициализируем аудио
-				// fmt.Println("🔧 Инициализация аудио буферов...")
-				audioBuffer, err := initAudio()
-				if err != nil {
-					fmt.Printf("❌ Ошибка инициализации аудио: %v\n", err)
-					voiceConn.Close()
-					voiceConn = nil
-					continue
-				}
-				// fmt.Println("✅ Аудио буферы инициализированы")
+	case "/volume":
+		// /volume <участник> <0-200>, имя может содержать пробелы
+		name, level, found := cutLast(strings.TrimSpace(arg))
+		percent, err := strconv.Atoi(level)
+		if !found || name == "" || err != nil {
+			fmt.Printf("⚠️ Использование: /volume <участник> <0-%d>\n", maxVolume)
+			return false
+		}
+		if err := voiceMixer.SetVolume(name, percent); err != nil {
+			fmt.Println("⚠️ " + err.Error())
+			return false
+		}
+		fmt.Printf("🔊 Громкость %s: %d%%\n", name, percent)
 
-				// Создаем канал для остановки аудио
-				stopAudio = make(chan struct{})
+	case "/mute":
+		name := strings.TrimSpace(arg)
+		if name == "" {
+			fmt.Println("⚠️ Использование: /mute <участник>")
+			return false
+		}
+		if voiceMixer.ToggleMute(name) {
+			fmt.Printf("🔇 %s заглушен только у вас\n", name)
+		} else {
+			fmt.Printf("🔊 %s снова слышен\n", name)
+		}
 
-				// Запускаем аудио потоки
-				// fmt.Println("🎵 Запуск аудио потоков...")
-				err = startAudioStream(voiceConn, audioBuffer)
-				if err != nil {
-					fmt.Printf("❌ Ошибка запуска аудио потока: %v\n", err)
-					voiceConn.Close()
-					voiceConn = nil
-					continue
-				}
-				// fmt.Println("✅ Аудио потоки запущены")
+	case "/exit":
+		return true
 
-				// Отправляем уведомление о подключении к голосовому чату
-				conn.Write([]byte("VOICE_CONNECT"))
-				// Сообщение о подключении придет от сервера
-			} else {
-				fmt.Println("⚠️ Вы уже подключены к голосовому чату")
-			}
+	case "/rooms":
+		send(&protocol.Room{Action: protocol.RoomActionList})
 
-		case "/leave":
-			if voiceConn != nil {
-				// Останавливаем аудио потоки
-				close(stopAudio)
-				audioWg.Wait()
-
-				// Отправляем уведомление об отключении от голосового чата
-				conn.Write([]byte("VOICE_DISCONNECT"))
-				voiceConn.Close()
-				voiceConn = nil
-				// Сообщение об отключении придет от сервера
-			} else {
-				fmt.Println("Вы не подключены к голосовому чату")
-			}
+	case "/join", "/create":
+		name := strings.TrimSpace(arg)
+		if name == "" {
+			fmt.Println("⚠️ Укажите название комнаты: " + command + " <комната>")
+			return false
+		}
+		action := protocol.RoomActionJoin
+		if command == "/create" {
+			action = protocol.RoomActionCreate
+		}
+		send(&protocol.Room{Action: action, Name: name})
+
+	case "/keys":
+		// Отпечатки сверяются с собеседником по другому каналу
+		for _, line := range peers.Fingerprints() {
+			printLine("🔑 " + line)
+		}
 
-		case "/exit":
-			if voiceConn != nil {
-				// Останавливаем аудио потоки
-				close(stopAudio)
-				audioWg.Wait()
+	case "/part":
+		// Возврат в общую комнату
+		send(&protocol.Room{Action: protocol.RoomActionLeave})
 
-				conn.Write([]byte("VOICE_DISCONNECT"))
-				voiceConn.Close()
-			}
-			return
+	case "/token":
+		// Новый токен от Electron взамен истекшего, для следующих
+		// переподключений
+		if token := strings.TrimSpace(arg); token != "" {
+			sessionToken.Store(token)
+		}
 
-		default:
-			// Проверяем, является ли это сообщением с изображением
-			if len(text) > 11 && text[:11] == "IMAGE_DATA:" {
-				imageData := text[11:] // Извлекаем данные изображения
-				// Отправляем изображение как специальное сообщение
-				message := "[" + username + "]: IMAGE_DATA:" + imageData
-				_, err := conn.Write([]byte(message))
-				if err != nil {
-					return
-				}
-			} else {
-				// Отправляем обычное сообщение
-				message := "[" + username + "]: " + text
-				_, err := conn.Write([]byte(message))
-				if err != nil {
-					return
-				}
+	default:
+		// Проверяем, является ли это сообщением с изображением
+		if len(text) > 11 && text[:11] == "IMAGE_DATA:" {
+			imageData := text[11:] // Извлекаем данные изображения
+			// Отправляем изображение фрагментами
+			if err := sendImage([]byte(imageData)); err != nil {
+				fmt.Printf("❌ Ошибка отправки изображения: %v\n", err)
 			}
+			return false
+		}
+
+		// Отправляем обычное сообщение, имя отправителя проставит сервер
+		envelope, err := sealMessage("chat", []byte(text))
+		if err != nil {
+			fmt.Printf("❌ Ошибка шифрования сообщения: %v\n", err)
+			return false
+		}
+		if err := send(&protocol.Chat{Ciphertext: envelope}); err != nil {
+			fmt.Printf("❌ Ошибка отправки сообщения: %v\n", err)
 		}
 	}
-	
-	// Проверяем ошибки сканера
-	if err := scanner.Err(); err != nil {
-		fmt.Printf("❌ Ошибка чтения stdin: %v\n", err)
-	}
+	return false
 }
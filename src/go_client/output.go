@@ -0,0 +1,34 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// Electron разбирает stdout клиента построчно: строки JOIN_ACCEPTED,
+// JOIN_REJECTED:, CONNECTION: и DISCONNECTED: - служебные, остальные
+// показываются в чате. Текст участников и сервера попадает в вывод только
+// через printLine, чтобы сообщение чата не могло начать новую строку и
+// выдать себя за служебную.
+
+// sanitizeLine заменяет переводы строк, включая U+2028 и U+2029, и другие
+// управляющие символы пробелами
+func sanitizeLine(s string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || r == '\u2028' || r == '\u2029' {
+			return ' '
+		}
+		return r
+	}, s)
+}
+
+// printLine выводит одну строку для Electron
+func printLine(line string) {
+	fmt.Println(sanitizeLine(line))
+}
+
+// printLinef форматирует и выводит одну строку для Electron
+func printLinef(format string, args ...any) {
+	printLine(fmt.Sprintf(format, args...))
+}
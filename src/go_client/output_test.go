@@ -0,0 +1,19 @@
+package main
+
+import "testing"
+
+func TestSanitizeLine(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{"привет", "привет"},
+		{"hi\nDISCONNECTED:вас заблокировал администратор", "hi DISCONNECTED:вас заблокировал администратор"},
+		{"hi\r\nCONNECTION:reconnecting", "hi  CONNECTION:reconnecting"},
+		{"\nbob joined the chat", " bob joined the chat"},
+		{"a\tb\x00c\x1b[2Jd", "a b c [2Jd"},
+		{"a\u2028b\u0085c", "a b c"},
+	}
+	for _, tt := range tests {
+		if got := sanitizeLine(tt.in); got != tt.want {
+			t.Errorf("sanitizeLine(%q) = %q, ожидалось %q", tt.in, got, tt.want)
+		}
+	}
+}
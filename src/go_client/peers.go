@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"airchat/protocol/e2e"
+	"airchat/protocol/secure"
+)
+
+// defaultIdentityKey - файл с ключом сквозного шифрования клиента
+func defaultIdentityKey() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "identity_key"
+	}
+	return filepath.Join(dir, "AirChat", "identity_key")
+}
+
+// peerKeys - открытые ключи участников текущей комнаты. Ключи приходят
+// в Join от сервера, сообщения шифруются для всех, кто сейчас в списке.
+type peerKeys struct {
+	mu   sync.Mutex
+	keys map[string][e2e.KeySize]byte
+	seen map[string][e2e.KeySize]byte // Все ключи за сессию, чтобы заметить смену
+}
+
+func newPeerKeys() *peerKeys {
+	return &peerKeys{
+		keys: make(map[string][e2e.KeySize]byte),
+		seen: make(map[string][e2e.KeySize]byte),
+	}
+}
+
+// Add запоминает ключ участника. changed - за эту сессию участник уже
+// входил с другим ключом.
+func (p *peerKeys) Add(username string, key [e2e.KeySize]byte) (changed bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	old, ok := p.seen[username]
+	p.keys[username] = key
+	p.seen[username] = key
+	return ok && old != key
+}
+
+// Remove убирает участника из получателей
+func (p *peerKeys) Remove(username string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.keys, username)
+}
+
+func (p *peerKeys) Key(username string) ([e2e.KeySize]byte, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	key, ok := p.keys[username]
+	return key, ok
+}
+
+// Recipients возвращает ключи всех участников комнаты
+func (p *peerKeys) Recipients() [][e2e.KeySize]byte {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	recipients := make([][e2e.KeySize]byte, 0, len(p.keys))
+	for _, key := range p.keys {
+		recipients = append(recipients, key)
+	}
+	return recipients
+}
+
+// Fingerprints возвращает строки "имя: отпечаток", отсортированные по имени
+func (p *peerKeys) Fingerprints() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	lines := make([]string, 0, len(p.keys))
+	for username, key := range p.keys {
+		lines = append(lines, username+": "+secure.Fingerprint(key[:]))
+	}
+	sort.Strings(lines)
+	return lines
+}
+
+// sealMessage шифрует сообщение вида context для участников комнаты.
+// Свой ключ тоже в списке, поэтому сервер вернет отправителю сообщение,
+// которое он сможет прочитать.
+func sealMessage(context string, plaintext []byte) ([]byte, error) {
+	return identity.Seal(context, plaintext, peers.Recipients())
+}
+
+// openMessage расшифровывает конверт от участника sender
+func openMessage(context, sender string, envelope []byte) ([]byte, error) {
+	key, ok := peers.Key(sender)
+	if !ok {
+		return nil, fmt.Errorf("неизвестен ключ участника %s", sender)
+	}
+	return identity.Open(context, envelope, key)
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"airchat/protocol/e2e"
+)
+
+func TestPeerKeys(t *testing.T) {
+	p := newPeerKeys()
+	alice, bob := [e2e.KeySize]byte{1}, [e2e.KeySize]byte{2}
+
+	if p.Add("alice", alice) || p.Add("bob", bob) {
+		t.Fatal("первый ключ участника считается сменой")
+	}
+	if p.Add("alice", alice) {
+		t.Error("тот же ключ считается сменой")
+	}
+	if len(p.Recipients()) != 2 {
+		t.Errorf("получателей %d, ожидалось 2", len(p.Recipients()))
+	}
+
+	// Участник вышел и вернулся с другим ключом
+	p.Remove("bob")
+	if _, ok := p.Key("bob"); ok {
+		t.Error("ключ вышедшего участника остался")
+	}
+	if !p.Add("bob", alice) {
+		t.Error("смена ключа не замечена")
+	}
+
+	lines := p.Fingerprints()
+	if len(lines) != 2 || !strings.HasPrefix(lines[0], "alice: ") || !strings.HasPrefix(lines[1], "bob: ") {
+		t.Errorf("отпечатки %q", lines)
+	}
+}
+
+func TestSealOpenMessage(t *testing.T) {
+	defer func(id *e2e.Identity, p *peerKeys) { identity, peers = id, p }(identity, peers)
+
+	alice, err := e2e.NewIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err := e2e.NewIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	identity, peers = alice, newPeerKeys()
+	peers.Add("alice", alice.PublicKey())
+	peers.Add("bob", bob.PublicKey())
+
+	envelope, err := sealMessage("chat", []byte("привет"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Отправитель читает свое сообщение, вернувшееся от сервера
+	if got, err := openMessage("chat", "alice", envelope); err != nil || !bytes.Equal(got, []byte("привет")) {
+		t.Fatalf("свое сообщение: %q, %v", got, err)
+	}
+	if _, err := openMessage("chat", "carol", envelope); err == nil {
+		t.Error("сообщение от участника без ключа принято")
+	}
+
+	// Получатель со своим списком ключей
+	identity, peers = bob, newPeerKeys()
+	peers.Add("alice", alice.PublicKey())
+	if got, err := openMessage("chat", "alice", envelope); err != nil || !bytes.Equal(got, []byte("привет")) {
+		t.Fatalf("получатель: %q, %v", got, err)
+	}
+}
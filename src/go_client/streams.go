@@ -0,0 +1,239 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"airchat/protocol"
+
+	"github.com/hraban/opus"
+)
+
+const (
+	streamIdleTimeout = 5 * time.Second // Поток без пакетов дольше этого забывается
+	defaultVolume     = 100             // Громкость участника в процентах
+	maxVolume         = 200
+)
+
+// remoteStream - голосовой поток одного говорящего (или микс сервера в
+// режиме MCU) со своим декодером и джиттер-буфером
+type remoteStream struct {
+	decoder    *opus.Decoder
+	jitter     *JitterBuffer
+	pcm        []int16
+	lostRun    int // Сколько кадров подряд потеряно
+	lastPacket time.Time
+}
+
+// StreamMixer декодирует потоки всех говорящих и сводит их в один кадр
+// воспроизведения. Поток определяется идентификатором из заголовка
+// пакета, а имя владельца приходит от сервера в VoiceState. Пакеты
+// потоков без владельца, кроме микса сервера, не играются, иначе они
+// обходили бы /mute и /volume. Громкость и заглушение задаются по имени и
+// сохраняются между подключениями к войсу.
+type StreamMixer struct {
+	mutex   sync.Mutex
+	streams map[uint32]*remoteStream
+	owners  map[uint32]string // Поток -> имя участника
+	volumes map[string]int    // Имя -> громкость в процентах
+	muted   map[string]bool
+}
+
+func NewStreamMixer() *StreamMixer {
+	return &StreamMixer{
+		streams: make(map[uint32]*remoteStream),
+		owners:  make(map[uint32]string),
+		volumes: make(map[string]int),
+		muted:   make(map[string]bool),
+	}
+}
+
+// SetOwner запоминает, кому принадлежит поток. Прежний поток участника
+// забывается. Поток, который уже принадлежит другому участнику, не
+// переходит к username: сервер таких не допускает.
+func (sm *StreamMixer) SetOwner(streamID uint32, username string) error {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+
+	if owner, ok := sm.owners[streamID]; ok && owner != username {
+		return fmt.Errorf("поток %d уже принадлежит %s", streamID, owner)
+	}
+	if streamID == protocol.MixStreamID {
+		return fmt.Errorf("поток микса сервера не может принадлежать %s", username)
+	}
+	sm.forgetUserLocked(username)
+	sm.owners[streamID] = username
+	return nil
+}
+
+// ForgetUser забывает потоки участника, покинувшего войс или комнату
+func (sm *StreamMixer) ForgetUser(username string) {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+	sm.forgetUserLocked(username)
+}
+
+func (sm *StreamMixer) forgetUserLocked(username string) {
+	for id, owner := range sm.owners {
+		if owner == username {
+			delete(sm.owners, id)
+			delete(sm.streams, id)
+		}
+	}
+}
+
+// Reset сбрасывает декодеры и буферы всех потоков, например при
+// переподключении к войсу. Владельцы и громкости сохраняются.
+func (sm *StreamMixer) Reset() {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+	sm.streams = make(map[uint32]*remoteStream)
+}
+
+// SetVolume задает громкость участника от 0 до maxVolume процентов
+func (sm *StreamMixer) SetVolume(username string, percent int) error {
+	if percent < 0 || percent > maxVolume {
+		return fmt.Errorf("громкость должна быть от 0 до %d", maxVolume)
+	}
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+	sm.volumes[username] = percent
+	return nil
+}
+
+// ToggleMute заглушает участника или снимает заглушение и возвращает
+// новое состояние
+func (sm *StreamMixer) ToggleMute(username string) bool {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+	sm.muted[username] = !sm.muted[username]
+	return sm.muted[username]
+}
+
+// Add кладет пакет в джиттер-буфер его потока, создавая поток при
+// первом пакете. Пакеты потока без владельца отбрасываются.
+func (sm *StreamMixer) Add(h protocol.VoiceHeader, payload []byte, arrival time.Time) error {
+	sm.mutex.Lock()
+	stream, ok := sm.streams[h.StreamID]
+	if !ok {
+		if _, owned := sm.owners[h.StreamID]; !owned && h.StreamID != protocol.MixStreamID {
+			sm.mutex.Unlock()
+			return nil
+		}
+		decoder, err := opus.NewDecoder(sampleRate, channels)
+		if err != nil {
+			sm.mutex.Unlock()
+			return fmt.Errorf("декодер Opus для потока %d не создан: %w", h.StreamID, err)
+		}
+		stream = &remoteStream{
+			decoder: decoder,
+			jitter:  NewJitterBuffer(config.JitterMin, config.JitterMax),
+			pcm:     make([]int16, frameSize),
+		}
+		sm.streams[h.StreamID] = stream
+	}
+	stream.lastPacket = arrival
+	sm.mutex.Unlock()
+
+	stream.jitter.Add(h, payload, arrival)
+	return nil
+}
+
+// Mix заполняет out сведенным кадром всех потоков с учетом громкости
+func (sm *StreamMixer) Mix(out []float32, now time.Time) {
+	clear(out)
+
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+
+	for id, stream := range sm.streams {
+		if now.Sub(stream.lastPacket) > streamIdleTimeout {
+			delete(sm.streams, id)
+			continue
+		}
+
+		// Кадр забираем даже у заглушенного, чтобы буфер не копился
+		if !stream.nextFrame() {
+			continue
+		}
+
+		gain := float32(sm.volumeLocked(id)) / 100
+		if gain == 0 {
+			continue
+		}
+		for i, sample := range stream.pcm {
+			out[i] += float32(sample) / 32767.0 * gain
+		}
+	}
+
+	// Сумма нескольких голосов может выйти за пределы диапазона
+	for i, sample := range out {
+		if sample > 1 {
+			out[i] = 1
+		} else if sample < -1 {
+			out[i] = -1
+		}
+	}
+}
+
+// volumeLocked - громкость потока в процентах. У микса сервера владельца
+// нет, он всегда звучит на 100%.
+func (sm *StreamMixer) volumeLocked(streamID uint32) int {
+	owner, ok := sm.owners[streamID]
+	if !ok {
+		return defaultVolume
+	}
+	if sm.muted[owner] {
+		return 0
+	}
+	if volume, ok := sm.volumes[owner]; ok {
+		return volume
+	}
+	return defaultVolume
+}
+
+// nextFrame декодирует в pcm очередной кадр потока. false - играть нечего.
+func (s *remoteStream) nextFrame() bool {
+	payload, status := s.jitter.Pop()
+	switch status {
+	case FrameLost:
+		s.lostRun++
+		return concealLostFrame(s.decoder, s.jitter, s.lostRun, s.pcm)
+	case FramePacket:
+		s.lostRun = 0
+		// Пакет уже расшифрован при приеме, декодируем
+		samplesRead, err := s.decoder.Decode(payload, s.pcm)
+		if err != nil || samplesRead != frameSize {
+			fmt.Printf("❌ Ошибка декодирования Opus: err=%v, samples=%d, expected=%d, packetSize=%d\n",
+				err, samplesRead, frameSize, len(payload))
+			return false
+		}
+		return true
+	}
+	return false
+}
+
+// StreamStats - статистика одного потока для команды /stats
+type StreamStats struct {
+	Name string
+	JitterStats
+}
+
+// Stats возвращает статистику всех потоков, отсортированную по имени
+func (sm *StreamMixer) Stats() []StreamStats {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+
+	stats := make([]StreamStats, 0, len(sm.streams))
+	for id, stream := range sm.streams {
+		name, ok := sm.owners[id]
+		if !ok {
+			name = "микс сервера"
+		}
+		stats = append(stats, StreamStats{Name: name, JitterStats: stream.jitter.Stats()})
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Name < stats[j].Name })
+	return stats
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"airchat/protocol"
+)
+
+func TestStreamMixerVolume(t *testing.T) {
+	sm := NewStreamMixer()
+	sm.SetOwner(1, "alice")
+	sm.SetOwner(2, "bob")
+
+	if err := sm.SetVolume("alice", 150); err != nil {
+		t.Fatal(err)
+	}
+	if err := sm.SetVolume("alice", maxVolume+1); err == nil {
+		t.Error("громкость выше максимума принята")
+	}
+	if !sm.ToggleMute("bob") {
+		t.Fatal("bob не заглушен")
+	}
+
+	tests := []struct {
+		stream uint32
+		want   int
+	}{
+		{1, 150},                    // своя громкость
+		{2, 0},                      // заглушен
+		{protocol.MixStreamID, 100}, // микс сервера без владельца
+		{3, defaultVolume},          // неизвестный поток
+	}
+	for _, tt := range tests {
+		if got := sm.volumeLocked(tt.stream); got != tt.want {
+			t.Errorf("поток %d: громкость %d, ожидалось %d", tt.stream, got, tt.want)
+		}
+	}
+
+	if sm.ToggleMute("bob") {
+		t.Error("повторный /mute не снял заглушение")
+	}
+	if got := sm.volumeLocked(2); got != defaultVolume {
+		t.Errorf("после снятия заглушения громкость %d", got)
+	}
+}
+
+func TestStreamMixerSeparateStreams(t *testing.T) {
+	sm := NewStreamMixer()
+	sm.SetOwner(1, "alice")
+	sm.SetOwner(2, "bob")
+
+	now := time.Now()
+	for _, id := range []uint32{1, 2} {
+		for seq := uint16(0); seq < 3; seq++ {
+			h := protocol.VoiceHeader{Kind: protocol.VoiceAudio, Seq: seq, Timestamp: uint32(seq) * frameSize, StreamID: id}
+			if err := sm.Add(h, []byte{0xF8}, now); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	stats := sm.Stats()
+	if len(stats) != 2 || stats[0].Name != "alice" || stats[1].Name != "bob" {
+		t.Fatalf("потоки %+v", stats)
+	}
+	for _, s := range stats {
+		if s.Received != 3 {
+			t.Errorf("%s: принято %d, ожидалось 3 - потоки смешались", s.Name, s.Received)
+		}
+	}
+
+	// Поток без владельца не играется
+	h := protocol.VoiceHeader{Kind: protocol.VoiceAudio, StreamID: 3}
+	if err := sm.Add(h, []byte{0xF8}, now); err != nil {
+		t.Fatal(err)
+	}
+	if stats := sm.Stats(); len(stats) != 2 {
+		t.Errorf("принят поток без владельца: %+v", stats)
+	}
+
+	// Вышедший участник забывается вместе с потоком
+	sm.ForgetUser("bob")
+	if stats := sm.Stats(); len(stats) != 1 {
+		t.Errorf("после ухода bob осталось %d потоков", len(stats))
+	}
+
+	// Поток без пакетов дольше таймаута удаляется при сведении
+	sm.Mix(make([]float32, frameSize), now.Add(streamIdleTimeout+time.Second))
+	if stats := sm.Stats(); len(stats) != 0 {
+		t.Errorf("неактивный поток не удален: %+v", stats)
+	}
+}
+
+func TestStreamMixerOwners(t *testing.T) {
+	sm := NewStreamMixer()
+	if err := sm.SetOwner(1, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	sm.ToggleMute("alice")
+
+	// Чужой поток не переходит к другому участнику, alice остается
+	// заглушенной
+	if err := sm.SetOwner(1, "mallory"); err == nil {
+		t.Error("поток alice отдан mallory")
+	}
+	if err := sm.SetOwner(protocol.MixStreamID, "mallory"); err == nil {
+		t.Error("поток микса отдан участнику")
+	}
+	if got := sm.volumeLocked(1); got != 0 {
+		t.Errorf("громкость потока alice %d, ожидалось 0", got)
+	}
+
+	// Новый поток участника заменяет прежний, настройки сохраняются
+	if err := sm.SetOwner(2, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := sm.owners[1]; ok {
+		t.Error("прежний поток alice не забыт")
+	}
+	if got := sm.volumeLocked(2); got != 0 {
+		t.Errorf("громкость нового потока alice %d, ожидалось 0", got)
+	}
+	if err := sm.SetOwner(1, "mallory"); err != nil {
+		t.Errorf("освободившийся поток не принят: %v", err)
+	}
+}
+
+func TestCutLast(t *testing.T) {
+	tests := []struct {
+		in, before, after string
+		found             bool
+	}{
+		{"bob 150", "bob", "150", true},
+		{"Иван Петров 80", "Иван Петров", "80", true},
+		{"bob", "bob", "", false},
+	}
+	for _, tt := range tests {
+		before, after, found := cutLast(tt.in)
+		if before != tt.before || after != tt.after || found != tt.found {
+			t.Errorf("cutLast(%q) = %q, %q, %v", tt.in, before, after, found)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package protocol
+
+import (
+	"crypto/sha256"
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	// ImageChunkSize - размер данных в одном фрагменте. Вместе с заголовками
+	// фрагмент укладывается в один датаграм UDP с запасом.
+	ImageChunkSize = 16 * 1024
+
+	// MaxImageSize - максимальный размер изображения (base64 от Electron)
+	MaxImageSize = 12 * 1024 * 1024
+
+	maxImageChunks = (MaxImageSize + ImageChunkSize - 1) / ImageChunkSize
+)
+
+var (
+	ErrImageTooLarge  = errors.New("protocol: изображение превышает допустимый размер")
+	ErrChunkInvalid   = errors.New("protocol: некорректный фрагмент изображения")
+	ErrChunkMismatch  = errors.New("protocol: фрагмент не совпадает с описанием передачи")
+	ErrChecksumFailed = errors.New("protocol: контрольная сумма изображения не совпала")
+)
+
+// SplitImage режет изображение на фрагменты передачи transferID.
+// Отправителя во фрагментах проставляет сервер.
+func SplitImage(transferID uint32, data []byte) ([]*ImageChunk, error) {
+	if len(data) > MaxImageSize {
+		return nil, ErrImageTooLarge
+	}
+
+	count := (len(data) + ImageChunkSize - 1) / ImageChunkSize
+	if count == 0 {
+		count = 1
+	}
+	checksum := sha256.Sum256(data)
+
+	chunks := make([]*ImageChunk, 0, count)
+	for i := 0; i < count; i++ {
+		start := i * ImageChunkSize
+		end := start + ImageChunkSize
+		if end > len(data) {
+			end = len(data)
+		}
+		chunks = append(chunks, &ImageChunk{
+			TransferID: transferID,
+			Index:      uint32(i),
+			Count:      uint32(count),
+			TotalSize:  uint32(len(data)),
+			Checksum:   checksum,
+			Data:       data[start:end],
+		})
+	}
+	return chunks, nil
+}
+
+// transfer - незавершенная сборка одного изображения
+type transfer struct {
+	first    *ImageChunk // описание передачи из первого пришедшего фрагмента
+	parts    [][]byte
+	received uint32
+	size     int
+	started  time.Time
+}
+
+type transferKey struct {
+	sender string
+	id     uint32
+}
+
+// Reassembler собирает изображения из фрагментов. Передачи, не
+// завершившиеся за timeout, отбрасываются.
+type Reassembler struct {
+	timeout   time.Duration
+	mutex     sync.Mutex
+	transfers map[transferKey]*transfer
+}
+
+func NewReassembler(timeout time.Duration) *Reassembler {
+	return &Reassembler{
+		timeout:   timeout,
+		transfers: make(map[transferKey]*transfer),
+	}
+}
+
+// Add добавляет фрагмент. Когда пришел последний фрагмент и контрольная
+// сумма сошлась, возвращает изображение целиком и true.
+func (r *Reassembler) Add(c *ImageChunk) ([]byte, bool, error) {
+	if c.Count == 0 || c.Count > maxImageChunks || c.Index >= c.Count ||
+		c.TotalSize > MaxImageSize || len(c.Data) > ImageChunkSize {
+		return nil, false, ErrChunkInvalid
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	now := time.Now()
+	r.expireLocked(now)
+
+	key := transferKey{sender: c.Sender, id: c.TransferID}
+	t, ok := r.transfers[key]
+	if !ok {
+		t = &transfer{
+			first:   c,
+			parts:   make([][]byte, c.Count),
+			started: now,
+		}
+		r.transfers[key] = t
+	}
+
+	if c.Count != t.first.Count || c.TotalSize != t.first.TotalSize || c.Checksum != t.first.Checksum {
+		delete(r.transfers, key)
+		return nil, false, ErrChunkMismatch
+	}
+
+	if t.parts[c.Index] != nil {
+		return nil, false, nil // Повтор уже полученного фрагмента
+	}
+	t.parts[c.Index] = c.Data
+	t.received++
+	t.size += len(c.Data)
+
+	if t.size > int(t.first.TotalSize) {
+		delete(r.transfers, key)
+		return nil, false, ErrChunkMismatch
+	}
+	if t.received < t.first.Count {
+		return nil, false, nil
+	}
+
+	delete(r.transfers, key)
+
+	data := make([]byte, 0, t.size)
+	for _, part := range t.parts {
+		data = append(data, part...)
+	}
+	if len(data) != int(t.first.TotalSize) {
+		return nil, false, ErrChunkMismatch
+	}
+	if sha256.Sum256(data) != t.first.Checksum {
+		return nil, false, ErrChecksumFailed
+	}
+	return data, true, nil
+}
+
+// Expire отбрасывает незавершенные передачи старше таймаута и
+// возвращает их количество
+func (r *Reassembler) Expire(now time.Time) int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.expireLocked(now)
+}
+
+func (r *Reassembler) expireLocked(now time.Time) int {
+	expired := 0
+	for key, t := range r.transfers {
+		if now.Sub(t.started) > r.timeout {
+			delete(r.transfers, key)
+			expired++
+		}
+	}
+	return expired
+}
@@ -0,0 +1,112 @@
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+)
+
+func testImage(size int) []byte {
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	return data
+}
+
+func TestSplitAndReassemble(t *testing.T) {
+	for _, size := range []int{0, 1, ImageChunkSize, ImageChunkSize + 1, 5*ImageChunkSize + 123} {
+		data := testImage(size)
+		chunks, err := SplitImage(7, data)
+		if err != nil {
+			t.Fatalf("SplitImage(%d): %v", size, err)
+		}
+
+		// Фрагменты приходят в обратном порядке и через кодек
+		r := NewReassembler(time.Minute)
+		var got []byte
+		for i := len(chunks) - 1; i >= 0; i-- {
+			frame, err := Marshal(chunks[i])
+			if err != nil {
+				t.Fatal(err)
+			}
+			msg, err := Unmarshal(frame)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			image, done, err := r.Add(msg.(*ImageChunk))
+			if err != nil {
+				t.Fatalf("size %d: Add(%d): %v", size, i, err)
+			}
+			if done != (i == 0) {
+				t.Fatalf("size %d: сборка завершена на фрагменте %d", size, i)
+			}
+			got = image
+		}
+		if !bytes.Equal(got, data) {
+			t.Errorf("size %d: собранное изображение отличается от исходного", size)
+		}
+	}
+}
+
+func TestReassembleDuplicateChunk(t *testing.T) {
+	chunks, _ := SplitImage(1, testImage(2*ImageChunkSize))
+	r := NewReassembler(time.Minute)
+
+	for _, c := range []*ImageChunk{chunks[0], chunks[0]} {
+		if _, done, err := r.Add(c); err != nil || done {
+			t.Fatalf("повтор фрагмента: done=%v err=%v", done, err)
+		}
+	}
+	if _, done, err := r.Add(chunks[1]); err != nil || !done {
+		t.Fatalf("последний фрагмент: done=%v err=%v", done, err)
+	}
+}
+
+func TestReassembleChecksum(t *testing.T) {
+	chunks, _ := SplitImage(1, testImage(ImageChunkSize+10))
+	chunks[1].Data = bytes.Clone(chunks[1].Data)
+	chunks[1].Data[0] ^= 0xFF
+
+	r := NewReassembler(time.Minute)
+	r.Add(chunks[0])
+	if _, _, err := r.Add(chunks[1]); !errors.Is(err, ErrChecksumFailed) {
+		t.Fatalf("получено %v, ожидалось %v", err, ErrChecksumFailed)
+	}
+}
+
+func TestReassembleExpire(t *testing.T) {
+	chunks, _ := SplitImage(1, testImage(3*ImageChunkSize))
+	r := NewReassembler(time.Second)
+	r.Add(chunks[0])
+
+	if n := r.Expire(time.Now()); n != 0 {
+		t.Fatalf("отброшено %d свежих передач", n)
+	}
+	if n := r.Expire(time.Now().Add(2 * time.Second)); n != 1 {
+		t.Fatalf("отброшено %d передач, ожидалась 1", n)
+	}
+
+	// После отбрасывания оставшиеся фрагменты не собираются в изображение
+	r.Add(chunks[1])
+	if _, done, _ := r.Add(chunks[2]); done {
+		t.Fatal("собрана отброшенная передача")
+	}
+}
+
+func TestReassembleInvalid(t *testing.T) {
+	r := NewReassembler(time.Minute)
+	bad := []*ImageChunk{
+		{Count: 0},
+		{Index: 2, Count: 2},
+		{Count: 1, TotalSize: MaxImageSize + 1},
+		{Count: 1, Data: make([]byte, ImageChunkSize+1)},
+	}
+	for i, c := range bad {
+		if _, _, err := r.Add(c); !errors.Is(err, ErrChunkInvalid) {
+			t.Errorf("%d: получено %v, ожидалось %v", i, err, ErrChunkInvalid)
+		}
+	}
+}
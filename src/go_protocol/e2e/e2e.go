@@ -0,0 +1,316 @@
+// Package e2e шифрует сообщения чата и изображения между участниками
+// комнаты так, что сервер видит только шифротекст.
+//
+// У каждого клиента есть долговременный ключ (Identity): X25519 для
+// шифрования и выведенный из него Ed25519 для подписи. Открытые части
+// обоих он публикует при входе одним ключом участника. Отправитель
+// шифрует сообщение случайным ключом ChaCha20-Poly1305, а этот ключ -
+// отдельно для каждого получателя ключом, выведенным HKDF-SHA256 из
+// статического X25519 отправителя и получателя. Весь конверт отправитель
+// подписывает: ключ сообщения знают все получатели, и без подписи любой из
+// них мог бы зашифровать им другой текст от имени отправителя.
+//
+// Формат конверта:
+//
+//	| 2 | счетчик (u64) | число получателей (u16) |
+//	| получатель: id ключа (8) | nonce (24) | ключ сообщения (32+16) | ...
+//	| шифротекст сообщения | подпись Ed25519 (64) |
+//
+// id ключа - первые 8 байт SHA-256 открытого ключа получателя. Заголовок
+// конверта целиком входит в проверяемые данные шифротекста сообщения, а
+// подпись покрывает вид сообщения и весь конверт. Счетчик отправителя
+// растет с каждым сообщением (и между запусками: это время в
+// наносекундах), получатель принимает от каждого отправителя только
+// сообщения новее уже прочитанных, поэтому сервер не может повторить
+// старый конверт.
+package e2e
+
+import (
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+// KeySize - размер открытого ключа участника: X25519 и Ed25519 подряд
+const KeySize = dhKeySize + ed25519.PublicKeySize
+
+const (
+	envelopeVersion byte = 2
+
+	dhKeySize      = 32
+	headerSize     = 1 + 8 + 2
+	keyIDSize      = 8
+	wrappedKeySize = chacha20poly1305.KeySize + chacha20poly1305.Overhead
+	recipientSize  = keyIDSize + chacha20poly1305.NonceSizeX + wrappedKeySize
+
+	// Ограничение числа получателей сверху задает u16 в заголовке
+	maxRecipients = 0xFFFF
+)
+
+var (
+	ErrMalformed    = errors.New("e2e: некорректный конверт")
+	ErrNotRecipient = errors.New("e2e: сообщение зашифровано не для нас")
+	ErrAuth         = errors.New("e2e: сообщение не прошло проверку подлинности")
+	ErrBadKey       = errors.New("e2e: некорректный открытый ключ")
+	ErrTooManyPeers = errors.New("e2e: слишком много получателей")
+	ErrNoRecipients = errors.New("e2e: не указаны получатели")
+	ErrReplay       = errors.New("e2e: повтор или устаревшее сообщение")
+)
+
+// Identity - долговременный ключ участника. Заодно помнит свой счетчик
+// сообщений и счетчики прочитанных сообщений каждого отправителя.
+type Identity struct {
+	private *ecdh.PrivateKey
+	signing ed25519.PrivateKey
+
+	mu       sync.Mutex
+	lastSent uint64
+	lastSeen map[seenKey]uint64 // Счетчик последнего прочитанного сообщения
+}
+
+// seenKey - отправитель и вид сообщения. Чат и изображения могут идти
+// разными путями и обгонять друг друга, поэтому порядок проверяется
+// отдельно для каждого вида.
+type seenKey struct {
+	sender  [KeySize]byte
+	context string
+}
+
+// NewIdentity создает новый случайный ключ
+func NewIdentity() (*Identity, error) {
+	private, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return identityFromKey(private), nil
+}
+
+// identityFromKey выводит ключ подписи из ключа X25519, поэтому в файле
+// хранится только он
+func identityFromKey(private *ecdh.PrivateKey) *Identity {
+	kdf := hkdf.New(sha256.New, private.Bytes(), nil, []byte("airchat e2e signing v1"))
+	seed := make([]byte, ed25519.SeedSize)
+	io.ReadFull(kdf, seed)
+	return &Identity{
+		private:  private,
+		signing:  ed25519.NewKeyFromSeed(seed),
+		lastSeen: make(map[seenKey]uint64),
+	}
+}
+
+// LoadOrCreateIdentity читает ключ из path (ключ X25519 в base64). Если
+// файла нет, создает новый ключ и сохраняет его с правами 0600.
+func LoadOrCreateIdentity(path string) (*Identity, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		id, err := NewIdentity()
+		if err != nil {
+			return nil, err
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+			return nil, err
+		}
+		encoded := base64.StdEncoding.EncodeToString(id.private.Bytes()) + "\n"
+		if err := os.WriteFile(path, []byte(encoded), 0o600); err != nil {
+			return nil, err
+		}
+		return id, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, fmt.Errorf("e2e: %s не содержит ключ X25519", path)
+	}
+	private, err := ecdh.X25519().NewPrivateKey(raw)
+	if err != nil {
+		return nil, fmt.Errorf("e2e: %s не содержит ключ X25519", path)
+	}
+	return identityFromKey(private), nil
+}
+
+// PublicKey возвращает открытый ключ, который публикуется другим
+// участникам
+func (id *Identity) PublicKey() [KeySize]byte {
+	var key [KeySize]byte
+	copy(key[:dhKeySize], id.private.PublicKey().Bytes())
+	copy(key[dhKeySize:], id.signing.Public().(ed25519.PublicKey))
+	return key
+}
+
+// nextCounter возвращает счетчик следующего сообщения
+func (id *Identity) nextCounter() uint64 {
+	id.mu.Lock()
+	defer id.mu.Unlock()
+	id.lastSent = max(uint64(time.Now().UnixNano()), id.lastSent+1)
+	return id.lastSent
+}
+
+// Seal шифрует plaintext для recipients (открытые ключи получателей).
+// context различает виды сообщений ("chat", "image"): конверт одного вида
+// не расшифруется как другой. Чтобы прочитать собственное сообщение,
+// отправитель включает в recipients свой ключ.
+func (id *Identity) Seal(context string, plaintext []byte, recipients [][KeySize]byte) ([]byte, error) {
+	if len(recipients) == 0 {
+		return nil, ErrNoRecipients
+	}
+	if len(recipients) > maxRecipients {
+		return nil, ErrTooManyPeers
+	}
+
+	contentKey := make([]byte, chacha20poly1305.KeySize)
+	if _, err := rand.Read(contentKey); err != nil {
+		return nil, err
+	}
+
+	size := headerSize + len(recipients)*recipientSize + len(plaintext) + chacha20poly1305.Overhead + ed25519.SignatureSize
+	envelope := make([]byte, 0, size)
+	envelope = append(envelope, envelopeVersion)
+	envelope = binary.BigEndian.AppendUint64(envelope, id.nextCounter())
+	envelope = binary.BigEndian.AppendUint16(envelope, uint16(len(recipients)))
+
+	sender := id.PublicKey()
+	for _, recipient := range recipients {
+		wrap, err := id.wrapKey(sender, recipient)
+		if err != nil {
+			return nil, err
+		}
+		n := make([]byte, chacha20poly1305.NonceSizeX)
+		if _, err := rand.Read(n); err != nil {
+			return nil, err
+		}
+		rid := keyID(recipient)
+		envelope = append(envelope, rid[:]...)
+		envelope = append(envelope, n...)
+		envelope = wrap.Seal(envelope, n, contentKey, rid[:])
+	}
+
+	// Ключ сообщения одноразовый, поэтому нулевой nonce безопасен, а
+	// зашифровать им другой текст получателям не даст подпись
+	aead, _ := chacha20poly1305.New(contentKey)
+	header := envelope[:len(envelope):len(envelope)]
+	envelope = aead.Seal(envelope, make([]byte, chacha20poly1305.NonceSize), plaintext, contentAAD(context, header))
+	return append(envelope, ed25519.Sign(id.signing, signedMessage(context, envelope))...), nil
+}
+
+// Open проверяет подпись участника с открытым ключом sender и
+// расшифровывает конверт. Конверт, не новее уже прочитанных от sender,
+// отвергается с ErrReplay.
+func (id *Identity) Open(context string, envelope []byte, sender [KeySize]byte) ([]byte, error) {
+	if len(envelope) < headerSize || envelope[0] != envelopeVersion {
+		return nil, ErrMalformed
+	}
+	counter := binary.BigEndian.Uint64(envelope[1:9])
+	count := int(binary.BigEndian.Uint16(envelope[9:headerSize]))
+	recipientsEnd := headerSize + count*recipientSize
+	if len(envelope) < recipientsEnd+chacha20poly1305.Overhead+ed25519.SignatureSize {
+		return nil, ErrMalformed
+	}
+	signed, signature := envelope[:len(envelope)-ed25519.SignatureSize], envelope[len(envelope)-ed25519.SignatureSize:]
+	if !ed25519.Verify(ed25519.PublicKey(sender[dhKeySize:]), signedMessage(context, signed), signature) {
+		return nil, ErrAuth
+	}
+	header, ciphertext := signed[:recipientsEnd], signed[recipientsEnd:]
+
+	own := keyID(id.PublicKey())
+	var contentKey []byte
+	for entries := header[headerSize:]; len(entries) > 0; entries = entries[recipientSize:] {
+		entry := entries[:recipientSize]
+		if [keyIDSize]byte(entry[:keyIDSize]) != own {
+			continue
+		}
+		wrap, err := id.wrapKey(sender, id.PublicKey())
+		if err != nil {
+			return nil, err
+		}
+		n := entry[keyIDSize : keyIDSize+chacha20poly1305.NonceSizeX]
+		contentKey, err = wrap.Open(nil, n, entry[keyIDSize+chacha20poly1305.NonceSizeX:], own[:])
+		if err != nil {
+			return nil, ErrAuth
+		}
+		break
+	}
+	if contentKey == nil {
+		return nil, ErrNotRecipient
+	}
+
+	aead, _ := chacha20poly1305.New(contentKey)
+	plaintext, err := aead.Open(nil, make([]byte, chacha20poly1305.NonceSize), ciphertext, contentAAD(context, header))
+	if err != nil {
+		return nil, ErrAuth
+	}
+
+	// Счетчик отмечаем только у подлинного конверта, иначе подделка
+	// заблокировала бы настоящие сообщения
+	id.mu.Lock()
+	defer id.mu.Unlock()
+	seen := seenKey{sender: sender, context: context}
+	if last, ok := id.lastSeen[seen]; ok && counter <= last {
+		return nil, ErrReplay
+	}
+	id.lastSeen[seen] = counter
+	return plaintext, nil
+}
+
+// wrapKey выводит ключ, которым отправитель sender шифрует ключ
+// сообщения для recipient. Одна из сторон - id.
+func (id *Identity) wrapKey(sender, recipient [KeySize]byte) (cipher.AEAD, error) {
+	peer := recipient
+	if recipient == id.PublicKey() {
+		peer = sender
+	}
+	public, err := ecdh.X25519().NewPublicKey(peer[:dhKeySize])
+	if err != nil {
+		return nil, ErrBadKey
+	}
+	shared, err := id.private.ECDH(public)
+	if err != nil {
+		// Ключ малого порядка: общий секрет нулевой
+		return nil, ErrBadKey
+	}
+
+	salt := append(sender[:], recipient[:]...)
+	kdf := hkdf.New(sha256.New, shared, salt, []byte("airchat e2e v1"))
+	key := make([]byte, chacha20poly1305.KeySize)
+	io.ReadFull(kdf, key)
+	return chacha20poly1305.NewX(key)
+}
+
+func keyID(key [KeySize]byte) [keyIDSize]byte {
+	sum := sha256.Sum256(key[:])
+	return [keyIDSize]byte(sum[:keyIDSize])
+}
+
+// signedMessage - то, что подписывает отправитель: вид сообщения и
+// конверт без подписи
+func signedMessage(context string, envelope []byte) []byte {
+	msg := make([]byte, 0, 15+len(context)+1+len(envelope))
+	msg = append(msg, "airchat e2e v2\x00"...)
+	msg = append(msg, context...)
+	msg = append(msg, 0)
+	return append(msg, envelope...)
+}
+
+func contentAAD(context string, header []byte) []byte {
+	aad := make([]byte, 0, len(context)+1+len(header))
+	aad = append(aad, context...)
+	aad = append(aad, 0)
+	return append(aad, header...)
+}
@@ -0,0 +1,159 @@
+package e2e
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+func newIdentity(t *testing.T) *Identity {
+	t.Helper()
+	id, err := NewIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+func TestSealOpen(t *testing.T) {
+	alice, bob, eve := newIdentity(t), newIdentity(t), newIdentity(t)
+	plaintext := []byte("привет, bob")
+
+	envelope, err := alice.Seal("chat", plaintext, [][KeySize]byte{alice.PublicKey(), bob.PublicKey()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(envelope, plaintext) {
+		t.Fatal("открытый текст виден в конверте")
+	}
+
+	// Получатели, включая самого отправителя, читают сообщение
+	for name, id := range map[string]*Identity{"alice": alice, "bob": bob} {
+		got, err := id.Open("chat", envelope, alice.PublicKey())
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !bytes.Equal(got, plaintext) {
+			t.Errorf("%s получил %q", name, got)
+		}
+	}
+
+	if _, err := eve.Open("chat", envelope, alice.PublicKey()); !errors.Is(err, ErrNotRecipient) {
+		t.Errorf("посторонний: %v, ожидалось ErrNotRecipient", err)
+	}
+	// Конверт, выданный за сообщение другого отправителя, не расшифруется
+	if _, err := bob.Open("chat", envelope, eve.PublicKey()); !errors.Is(err, ErrAuth) {
+		t.Errorf("чужой отправитель: %v, ожидалось ErrAuth", err)
+	}
+	// Сообщение чата нельзя выдать за изображение
+	if _, err := bob.Open("image", envelope, alice.PublicKey()); !errors.Is(err, ErrAuth) {
+		t.Errorf("другой вид сообщения: %v, ожидалось ErrAuth", err)
+	}
+}
+
+func TestOpenTampered(t *testing.T) {
+	alice, bob := newIdentity(t), newIdentity(t)
+	envelope, err := alice.Seal("chat", []byte("hi"), [][KeySize]byte{bob.PublicKey()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := range envelope {
+		tampered := bytes.Clone(envelope)
+		tampered[i] ^= 0x01
+		if _, err := bob.Open("chat", tampered, alice.PublicKey()); err == nil {
+			t.Fatalf("изменение байта %d не обнаружено", i)
+		}
+	}
+	for _, short := range [][]byte{nil, envelope[:2], envelope[:len(envelope)-1]} {
+		if _, err := bob.Open("chat", short, alice.PublicKey()); err == nil {
+			t.Errorf("обрезанный конверт длиной %d принят", len(short))
+		}
+	}
+	if _, err := alice.Seal("chat", []byte("hi"), nil); !errors.Is(err, ErrNoRecipients) {
+		t.Errorf("без получателей: %v", err)
+	}
+}
+
+func TestForgedBySameRecipient(t *testing.T) {
+	alice, bob, carol := newIdentity(t), newIdentity(t), newIdentity(t)
+	envelope, err := alice.Seal("chat", []byte("hi"), [][KeySize]byte{bob.PublicKey(), carol.PublicKey()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// bob достает ключ сообщения из своей записи и шифрует им другой текст
+	// с тем же заголовком
+	recipientsEnd := headerSize + 2*recipientSize
+	entry := envelope[headerSize : headerSize+recipientSize]
+	if [keyIDSize]byte(entry[:keyIDSize]) != keyID(bob.PublicKey()) {
+		entry = envelope[headerSize+recipientSize : recipientsEnd]
+	}
+	wrap, err := bob.wrapKey(alice.PublicKey(), bob.PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	contentKey, err := wrap.Open(nil, entry[keyIDSize:keyIDSize+chacha20poly1305.NonceSizeX], entry[keyIDSize+chacha20poly1305.NonceSizeX:], entry[:keyIDSize])
+	if err != nil {
+		t.Fatal(err)
+	}
+	aead, _ := chacha20poly1305.New(contentKey)
+	header := envelope[:recipientsEnd:recipientsEnd]
+	forged := aead.Seal(header, make([]byte, chacha20poly1305.NonceSize), []byte("bye"), contentAAD("chat", header))
+	forged = append(forged, envelope[len(envelope)-ed25519.SignatureSize:]...)
+
+	if _, err := carol.Open("chat", forged, alice.PublicKey()); !errors.Is(err, ErrAuth) {
+		t.Errorf("подделка другого получателя: %v, ожидалось ErrAuth", err)
+	}
+	// Подделка не сдвигает счетчик: настоящее сообщение читается
+	if _, err := carol.Open("chat", envelope, alice.PublicKey()); err != nil {
+		t.Errorf("настоящее сообщение: %v", err)
+	}
+}
+
+func TestReplay(t *testing.T) {
+	alice, bob := newIdentity(t), newIdentity(t)
+	seal := func(context string) []byte {
+		t.Helper()
+		envelope, err := alice.Seal(context, []byte("hi"), [][KeySize]byte{bob.PublicKey()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return envelope
+	}
+	image, older, newer := seal("image"), seal("chat"), seal("chat")
+
+	if _, err := bob.Open("chat", newer, alice.PublicKey()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bob.Open("chat", newer, alice.PublicKey()); !errors.Is(err, ErrReplay) {
+		t.Errorf("повтор: %v, ожидалось ErrReplay", err)
+	}
+	if _, err := bob.Open("chat", older, alice.PublicKey()); !errors.Is(err, ErrReplay) {
+		t.Errorf("устаревшее сообщение: %v, ожидалось ErrReplay", err)
+	}
+	// Изображение отправлено раньше, но порядок видов сообщений проверяется
+	// отдельно
+	if _, err := bob.Open("image", image, alice.PublicKey()); err != nil {
+		t.Errorf("изображение: %v", err)
+	}
+}
+
+func TestLoadOrCreateIdentity(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "AirChat", "identity_key")
+	created, err := LoadOrCreateIdentity(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadOrCreateIdentity(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created.PublicKey() != loaded.PublicKey() {
+		t.Error("прочитан другой ключ")
+	}
+}
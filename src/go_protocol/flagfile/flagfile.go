@@ -0,0 +1,202 @@
+// Package flagfile дополняет flag.FlagSet файлом конфигурации. Ключ файла -
+// имя флага с подчеркиваниями вместо дефисов (client_timeout для
+// -client-timeout), поэтому список параметров описывается один раз.
+//
+// Поддерживается подмножество TOML: по паре ключ = значение на строке.
+//
+//	# комментарий
+//	voice_port = 7001                    # число
+//	mode = "sfu"                         # строка в кавычках, экранирование \" \\ \n \t \uXXXX
+//	known_servers = 'C:\AirChat\known'   # строка в апострофах, без экранирования
+//	client_timeout = "30s"               # длительность - строкой
+//	vad = false
+//
+// Строки разбираются по правилам TOML. Без кавычек допускаются только
+// числа и true/false. Таблицы, массивы, ключи в кавычках, даты и
+// многострочные строки не поддерживаются, и такой файл не принимается, а
+// не читается иначе, чем его прочитал бы TOML.
+package flagfile
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Parse разбирает args в fs, затем применяет файл, путь к которому задан
+// строковым флагом fileFlag. Явно заданные флаги важнее значений из файла.
+func Parse(fs *flag.FlagSet, args []string, fileFlag string) error {
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return fmt.Errorf("лишние аргументы: %s", strings.Join(fs.Args(), " "))
+	}
+
+	path := fs.Lookup(fileFlag).Value.String()
+	if path == "" {
+		return nil
+	}
+
+	// Файл перезапишет значения, поэтому явные флаги применяем повторно
+	explicit := make(map[string]string)
+	fs.Visit(func(f *flag.Flag) { explicit[f.Name] = f.Value.String() })
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if err := apply(fs, data, fileFlag); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	for name, value := range explicit {
+		fs.Set(name, value)
+	}
+	return nil
+}
+
+// apply разбирает data, ключ skip (флаг с путем к файлу) в файле запрещен
+func apply(fs *flag.FlagSet, data []byte, skip string) error {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		key, raw, ok := strings.Cut(line, "=")
+		if !ok {
+			return fmt.Errorf("строка %d: ожидается key = value", lineNo)
+		}
+		key = strings.TrimSpace(key)
+		value, err := parseValue(strings.TrimSpace(raw))
+		if err != nil {
+			return fmt.Errorf("строка %d: %w", lineNo, err)
+		}
+
+		name := strings.ReplaceAll(key, "_", "-")
+		if name == skip || fs.Lookup(name) == nil {
+			return fmt.Errorf("строка %d: неизвестный параметр %q", lineNo, key)
+		}
+		if err := fs.Set(name, value); err != nil {
+			return fmt.Errorf("строка %d: %s: %w", lineNo, key, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// parseValue снимает кавычки со строки и отрезает комментарий
+func parseValue(raw string) (string, error) {
+	if strings.HasPrefix(raw, `"""`) || strings.HasPrefix(raw, "'''") {
+		return "", errors.New("многострочные строки не поддерживаются")
+	}
+
+	var value, rest string
+	switch {
+	case strings.HasPrefix(raw, `"`):
+		var err error
+		if value, rest, err = parseBasicString(raw[1:]); err != nil {
+			return "", err
+		}
+	case strings.HasPrefix(raw, "'"):
+		end := strings.IndexByte(raw[1:], '\'')
+		if end < 0 {
+			return "", errors.New("незакрытая кавычка")
+		}
+		value, rest = raw[1:end+1], raw[end+2:]
+	default:
+		value, _, _ = strings.Cut(raw, "#")
+		value = strings.TrimSpace(value)
+		if value == "" {
+			return "", errors.New("пустое значение")
+		}
+		if !bareValue(value) {
+			return "", fmt.Errorf("строка %s должна быть в кавычках", value)
+		}
+		return value, nil
+	}
+
+	rest = strings.TrimSpace(rest)
+	if rest != "" && rest[0] != '#' {
+		return "", fmt.Errorf("лишнее после значения: %q", rest)
+	}
+	return value, nil
+}
+
+// bareValue сообщает, может ли value стоять без кавычек: это число или
+// true/false
+func bareValue(value string) bool {
+	if value == "true" || value == "false" {
+		return true
+	}
+	if _, err := strconv.ParseInt(value, 0, 64); err == nil {
+		return true
+	}
+	_, err := strconv.ParseFloat(value, 64)
+	return err == nil
+}
+
+// parseBasicString разбирает строку TOML в двойных кавычках без
+// открывающей кавычки и возвращает ее значение и остаток после
+// закрывающей
+func parseBasicString(s string) (value, rest string, err error) {
+	var b strings.Builder
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == '"':
+			return b.String(), s[i+1:], nil
+
+		case c == '\\':
+			if i+1 >= len(s) {
+				return "", "", errors.New("незакрытая кавычка")
+			}
+			size := 2
+			switch esc := s[i+1]; esc {
+			case 'b':
+				b.WriteByte('\b')
+			case 't':
+				b.WriteByte('\t')
+			case 'n':
+				b.WriteByte('\n')
+			case 'f':
+				b.WriteByte('\f')
+			case 'r':
+				b.WriteByte('\r')
+			case '"', '\\':
+				b.WriteByte(esc)
+			case 'u', 'U':
+				digits := 4
+				if esc == 'U' {
+					digits = 8
+				}
+				if i+2+digits > len(s) {
+					return "", "", fmt.Errorf("неполная последовательность \\%c", esc)
+				}
+				code, err := strconv.ParseUint(s[i+2:i+2+digits], 16, 32)
+				if err != nil || !utf8.ValidRune(rune(code)) {
+					return "", "", fmt.Errorf("недопустимый символ \\%c%s", esc, s[i+2:i+2+digits])
+				}
+				b.WriteRune(rune(code))
+				size += digits
+			default:
+				return "", "", fmt.Errorf("недопустимая последовательность \\%c", esc)
+			}
+			i += size
+
+		case c < 0x20 && c != '\t' || c == 0x7f:
+			return "", "", errors.New("управляющий символ в строке")
+
+		default:
+			b.WriteByte(c)
+			i++
+		}
+	}
+	return "", "", errors.New("незакрытая кавычка")
+}
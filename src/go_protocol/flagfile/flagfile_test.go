@@ -0,0 +1,116 @@
+package flagfile
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type options struct {
+	name    string
+	port    int
+	timeout time.Duration
+	vad     bool
+}
+
+func newFlagSet(o *options) *flag.FlagSet {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.SetOutput(new(strings.Builder))
+	fs.String("config", "", "")
+	fs.StringVar(&o.name, "name", "", "")
+	fs.IntVar(&o.port, "voice-port", 6001, "")
+	fs.DurationVar(&o.timeout, "client-timeout", time.Second, "")
+	fs.BoolVar(&o.vad, "vad", true, "")
+	return fs
+}
+
+func writeFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "test.toml")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestParse(t *testing.T) {
+	path := writeFile(t, `
+# комментарий
+name = "Иван # не комментарий"  # комментарий
+voice_port = 7001
+client_timeout = "1m"
+vad = false
+`)
+
+	var o options
+	if err := Parse(newFlagSet(&o), []string{"-config", path, "-voice-port", "7101"}, "config"); err != nil {
+		t.Fatal(err)
+	}
+	want := options{name: "Иван # не комментарий", port: 7101, timeout: time.Minute, vad: false}
+	if o != want {
+		t.Errorf("получено %+v, ожидалось %+v", o, want)
+	}
+}
+
+func TestParseValue(t *testing.T) {
+	tests := []struct{ raw, want string }{
+		{`7001`, "7001"},
+		{`-1.5 # комментарий`, "-1.5"},
+		{`0x1F`, "0x1F"},
+		{`true`, "true"},
+		{`"просто строка"`, "просто строка"},
+		{`"в \"кавычках\" # не комментарий" # комментарий`, `в "кавычках" # не комментарий`},
+		{`"C:\\AirChat\\known"`, `C:\AirChat\known`},
+		{`"строка\nвторая\tтаб"`, "строка\nвторая\tтаб"},
+		{`"\u00e9\U0001F3A4"`, "é🎤"},
+		{`'C:\AirChat\known' # без экранирования`, `C:\AirChat\known`},
+		{`'в "кавычках"'`, `в "кавычках"`},
+		{`""`, ""},
+	}
+	for _, tt := range tests {
+		got, err := parseValue(tt.raw)
+		if err != nil || got != tt.want {
+			t.Errorf("parseValue(%s) = %q, %v, ожидалось %q", tt.raw, got, err, tt.want)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+		want string
+	}{
+		{"неизвестный ключ", "voice_prot = 7001", "неизвестный параметр"},
+		{"путь к файлу в файле", `config = "other.toml"`, "неизвестный параметр"},
+		{"без знака равенства", "voice_port 7001", "ожидается key = value"},
+		{"незакрытая кавычка", `name = "Иван`, "незакрытая кавычка"},
+		{"мусор после строки", `name = "Иван" Петров`, "лишнее после значения"},
+		{"пустое значение", "voice_port = ", "пустое значение"},
+		{"строка без кавычек", "name = Иван", "должна быть в кавычках"},
+		{"массив", "voice_port = [7001]", "должна быть в кавычках"},
+		{"таблица", "[server]", "ожидается key = value"},
+		{"многострочная строка", `name = """Иван"""`, "многострочные строки"},
+		{"неизвестное экранирование", `name = "C:\AirChat"`, `недопустимая последовательность \A`},
+		{"неполный код символа", `name = "\u12"`, `неполная последовательность \u`},
+		{"суррогат", `name = "\uD800"`, "недопустимый символ"},
+		{"экранированная кавычка в конце", `name = "Иван\"`, "незакрытая кавычка"},
+		{"незакрытый апостроф", `name = 'Иван`, "незакрытая кавычка"},
+		{"не число", `voice_port = "много"`, "строка 1: voice_port"},
+	}
+	for _, tt := range tests {
+		var o options
+		err := Parse(newFlagSet(&o), []string{"-config", writeFile(t, tt.file)}, "config")
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: ошибка %v, ожидалась с %q", tt.name, err, tt.want)
+		}
+	}
+
+	var o options
+	if err := Parse(newFlagSet(&o), []string{"лишний"}, "config"); err == nil {
+		t.Error("лишний аргумент принят")
+	}
+}
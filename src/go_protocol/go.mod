@@ -0,0 +1,7 @@
+module airchat/protocol
+
+go 1.21
+
+require golang.org/x/crypto v0.32.0
+
+require golang.org/x/sys v0.29.0 // indirect
@@ -0,0 +1,426 @@
+package protocol
+
+import (
+	"crypto/sha256"
+	"time"
+)
+
+// IdentityKeySize - размер открытого ключа сквозного шифрования: X25519 и
+// Ed25519 подряд
+const IdentityKeySize = 64
+
+// Join - вход пользователя в чат. Клиент отправляет его при подключении
+// вместе с сессионным токеном и открытым ключом сквозного шифрования,
+// сервер рассылает его остальным участникам без токена.
+type Join struct {
+	Username    string
+	Token       string
+	IdentityKey [IdentityKeySize]byte
+}
+
+func (*Join) Type() Type { return TypeJoin }
+
+func (m *Join) encode(w *writer) error {
+	if err := w.string(m.Username); err != nil {
+		return err
+	}
+	if err := w.string(m.Token); err != nil {
+		return err
+	}
+	w.fixed(m.IdentityKey[:])
+	return nil
+}
+
+func (m *Join) decode(r *reader) (err error) {
+	if m.Username, err = r.string(); err != nil {
+		return err
+	}
+	if m.Token, err = r.string(); err != nil {
+		return err
+	}
+	return r.fixed(m.IdentityKey[:])
+}
+
+// RejectReason - причина отказа во входе
+type RejectReason byte
+
+const (
+	RejectNone         RejectReason = 0
+	RejectNameTaken    RejectReason = 1 // Имя уже занято другим участником
+	RejectInvalidName  RejectReason = 2 // Имя не проходит проверку
+	RejectServerFull   RejectReason = 3 // Достигнут лимит участников
+	RejectUnauthorized RejectReason = 4 // Нет действительного сессионного токена
+	RejectNoIdentity   RejectReason = 5 // Клиент не прислал ключ сквозного шифрования
+	RejectBanned       RejectReason = 6 // Имя или адрес заблокированы администратором
+	RejectShuttingDown RejectReason = 7 // Сервер завершает работу
+)
+
+func (r RejectReason) String() string {
+	switch r {
+	case RejectNone:
+		return "нет"
+	case RejectNameTaken:
+		return "имя пользователя уже занято"
+	case RejectInvalidName:
+		return "недопустимое имя пользователя"
+	case RejectServerFull:
+		return "сервер заполнен"
+	case RejectUnauthorized:
+		return "требуется вход по логину и паролю"
+	case RejectNoIdentity:
+		return "клиент не поддерживает сквозное шифрование"
+	case RejectBanned:
+		return "вход заблокирован администратором сервера"
+	case RejectShuttingDown:
+		return "сервер завершает работу"
+	}
+	return "неизвестная причина"
+}
+
+// JoinResult - ответ сервера на Join. Клиент не считает себя подключенным,
+// пока не получит его с Accepted. VoiceToken - случайный токен голосовой
+// сессии: клиент предъявляет его в VoiceHello, и по нему сервер узнает
+// адрес голосового сокета клиента.
+type JoinResult struct {
+	Accepted   bool
+	Reason     RejectReason
+	VoiceToken [VoiceTokenSize]byte
+}
+
+func (*JoinResult) Type() Type { return TypeJoinResult }
+
+func (m *JoinResult) encode(w *writer) error {
+	w.bool(m.Accepted)
+	w.byte(byte(m.Reason))
+	w.fixed(m.VoiceToken[:])
+	return nil
+}
+
+func (m *JoinResult) decode(r *reader) (err error) {
+	if m.Accepted, err = r.bool(); err != nil {
+		return err
+	}
+	reason, err := r.byte()
+	if err != nil {
+		return err
+	}
+	m.Reason = RejectReason(reason)
+	return r.fixed(m.VoiceToken[:])
+}
+
+// Leave - выход пользователя из чата. Клиент отправляет его без имени,
+// когда уходит сам, сервер рассылает участникам с именем ушедшего.
+type Leave struct {
+	Username string
+}
+
+func (*Leave) Type() Type { return TypeLeave }
+
+func (m *Leave) encode(w *writer) error {
+	return w.string(m.Username)
+}
+
+func (m *Leave) decode(r *reader) (err error) {
+	m.Username, err = r.string()
+	return err
+}
+
+// Chat - текстовое сообщение. Sender проставляет сервер по адресу
+// отправителя, значение от клиента игнорируется. Ciphertext - конверт
+// сквозного шифрования (пакет e2e) для участников комнаты, сервер
+// пересылает его не читая.
+type Chat struct {
+	Sender     string
+	Ciphertext []byte
+}
+
+func (*Chat) Type() Type { return TypeChat }
+
+func (m *Chat) encode(w *writer) error {
+	if err := w.string(m.Sender); err != nil {
+		return err
+	}
+	return w.bytes(m.Ciphertext)
+}
+
+func (m *Chat) decode(r *reader) (err error) {
+	if m.Sender, err = r.string(); err != nil {
+		return err
+	}
+	m.Ciphertext, err = r.bytes()
+	return err
+}
+
+// ImageChunk - фрагмент изображения. Изображение целиком не помещается в
+// датаграм UDP, поэтому отправитель режет его на фрагменты (см. SplitImage),
+// а получатель собирает их обратно (см. Reassembler). Каждый фрагмент несет
+// описание всей передачи, поэтому сборку можно начать с любого из них.
+// Sender, как и у Chat, проставляет сервер. Режется не само изображение,
+// а его конверт сквозного шифрования.
+type ImageChunk struct {
+	Sender     string
+	TransferID uint32
+	Index      uint32
+	Count      uint32
+	TotalSize  uint32
+	Checksum   [sha256.Size]byte // SHA-256 всего изображения
+	Data       []byte
+}
+
+func (*ImageChunk) Type() Type { return TypeImage }
+
+func (m *ImageChunk) encode(w *writer) error {
+	if err := w.string(m.Sender); err != nil {
+		return err
+	}
+	w.uint32(m.TransferID)
+	w.uint32(m.Index)
+	w.uint32(m.Count)
+	w.uint32(m.TotalSize)
+	w.fixed(m.Checksum[:])
+	return w.bytes(m.Data)
+}
+
+func (m *ImageChunk) decode(r *reader) (err error) {
+	if m.Sender, err = r.string(); err != nil {
+		return err
+	}
+	if m.TransferID, err = r.uint32(); err != nil {
+		return err
+	}
+	if m.Index, err = r.uint32(); err != nil {
+		return err
+	}
+	if m.Count, err = r.uint32(); err != nil {
+		return err
+	}
+	if m.TotalSize, err = r.uint32(); err != nil {
+		return err
+	}
+	if err = r.fixed(m.Checksum[:]); err != nil {
+		return err
+	}
+	m.Data, err = r.bytes()
+	return err
+}
+
+// VoiceState - подключение или отключение от голосового чата. Клиент
+// отправляет его без имени, сервер рассылает с именем участника.
+// StreamID - идентификатор голосового потока участника из заголовка
+// голосовых пакетов, ноль при отключении.
+type VoiceState struct {
+	Username  string
+	Connected bool
+	StreamID  uint32
+}
+
+func (*VoiceState) Type() Type { return TypeVoiceState }
+
+func (m *VoiceState) encode(w *writer) error {
+	if err := w.string(m.Username); err != nil {
+		return err
+	}
+	w.bool(m.Connected)
+	w.uint32(m.StreamID)
+	return nil
+}
+
+func (m *VoiceState) decode(r *reader) (err error) {
+	if m.Username, err = r.string(); err != nil {
+		return err
+	}
+	if m.Connected, err = r.bool(); err != nil {
+		return err
+	}
+	m.StreamID, err = r.uint32()
+	return err
+}
+
+// Error - сообщение об ошибке от сервера
+type Error struct {
+	Message string
+}
+
+func (*Error) Type() Type { return TypeError }
+
+func (m *Error) encode(w *writer) error {
+	return w.string(m.Message)
+}
+
+func (m *Error) decode(r *reader) (err error) {
+	m.Message, err = r.string()
+	return err
+}
+
+// RoomAction - действие с комнатами
+type RoomAction byte
+
+const (
+	RoomActionList   RoomAction = 1 // Запросить список комнат
+	RoomActionCreate RoomAction = 2 // Создать комнату и перейти в нее
+	RoomActionJoin   RoomAction = 3 // Перейти в существующую комнату
+	RoomActionLeave  RoomAction = 4 // Вернуться в общую комнату
+)
+
+// Room - запрос клиента на действие с комнатами. Name не используется
+// для RoomActionList и RoomActionLeave.
+type Room struct {
+	Action RoomAction
+	Name   string
+}
+
+func (*Room) Type() Type { return TypeRoom }
+
+func (m *Room) encode(w *writer) error {
+	w.byte(byte(m.Action))
+	return w.string(m.Name)
+}
+
+func (m *Room) decode(r *reader) (err error) {
+	action, err := r.byte()
+	if err != nil {
+		return err
+	}
+	m.Action = RoomAction(action)
+	m.Name, err = r.string()
+	return err
+}
+
+// RoomInfo - описание комнаты в списке
+type RoomInfo struct {
+	Name    string
+	Members uint32
+}
+
+// RoomList - список комнат сервера
+type RoomList struct {
+	Rooms []RoomInfo
+}
+
+func (*RoomList) Type() Type { return TypeRoomList }
+
+func (m *RoomList) encode(w *writer) error {
+	w.uint32(uint32(len(m.Rooms)))
+	for _, room := range m.Rooms {
+		if err := w.string(room.Name); err != nil {
+			return err
+		}
+		w.uint32(room.Members)
+	}
+	return nil
+}
+
+func (m *RoomList) decode(r *reader) error {
+	count, err := r.uint32()
+	if err != nil {
+		return err
+	}
+	// Каждая запись занимает минимум 6 байт, не доверяем счетчику сверх этого
+	if uint64(count)*6 > uint64(len(r.buf)) {
+		return ErrTruncated
+	}
+
+	m.Rooms = make([]RoomInfo, count)
+	for i := range m.Rooms {
+		if m.Rooms[i].Name, err = r.string(); err != nil {
+			return err
+		}
+		if m.Rooms[i].Members, err = r.uint32(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RoomJoined - сервер перевел клиента в комнату Name. После него сервер
+// присылает Join для каждого участника комнаты.
+type RoomJoined struct {
+	Name string
+}
+
+func (*RoomJoined) Type() Type { return TypeRoomJoined }
+
+func (m *RoomJoined) encode(w *writer) error {
+	return w.string(m.Name)
+}
+
+func (m *RoomJoined) decode(r *reader) (err error) {
+	m.Name, err = r.string()
+	return err
+}
+
+// NoticeKind - вид уведомления администратора
+type NoticeKind byte
+
+const (
+	NoticeKicked       NoticeKind = 1 // Клиент исключен, сессия завершена
+	NoticeBanned       NoticeKind = 2 // Клиент заблокирован и исключен
+	NoticeMuted        NoticeKind = 3 // Сервер не пропускает голос клиента
+	NoticeUnmuted      NoticeKind = 4 // Голос клиента снова пропускается
+	NoticeAnnouncement NoticeKind = 5 // Объявление для всех участников
+)
+
+// Notice - уведомление о действии администратора. Text - причина или
+// текст объявления, может быть пустым.
+type Notice struct {
+	Kind NoticeKind
+	Text string
+}
+
+func (*Notice) Type() Type { return TypeNotice }
+
+func (m *Notice) encode(w *writer) error {
+	w.byte(byte(m.Kind))
+	return w.string(m.Text)
+}
+
+func (m *Notice) decode(r *reader) (err error) {
+	kind, err := r.byte()
+	if err != nil {
+		return err
+	}
+	m.Kind = NoticeKind(kind)
+	m.Text, err = r.string()
+	return err
+}
+
+// Keepalive - проверка связи. Клиент отправляет его периодически, сервер
+// отвечает тем же: по отсутствию сообщений каждая сторона понимает, что
+// другая пропала.
+type Keepalive struct{}
+
+// KeepaliveInterval - как часто клиент отправляет Keepalive
+const KeepaliveInterval = 5 * time.Second
+
+func (*Keepalive) Type() Type { return TypeKeepalive }
+
+func (*Keepalive) encode(*writer) error { return nil }
+
+func (*Keepalive) decode(*reader) error { return nil }
+
+// Shutdown - сервер завершает работу, сессия окончена. Сервер больше не
+// принимает вход и закрывает сокеты, как только клиенты подтвердят это
+// сообщение. Если RestartIn не ноль, сервер ожидается снова примерно через
+// столько секунд и клиенту есть смысл переподключиться.
+type Shutdown struct {
+	Reason    string
+	RestartIn uint32
+}
+
+func (*Shutdown) Type() Type { return TypeShutdown }
+
+func (m *Shutdown) encode(w *writer) error {
+	if err := w.string(m.Reason); err != nil {
+		return err
+	}
+	w.uint32(m.RestartIn)
+	return nil
+}
+
+func (m *Shutdown) decode(r *reader) (err error) {
+	if m.Reason, err = r.string(); err != nil {
+		return err
+	}
+	m.RestartIn, err = r.uint32()
+	return err
+}
@@ -0,0 +1,281 @@
+// Package protocol описывает бинарный формат кадров управляющего канала (:6000).
+//
+// Каждый датаграм содержит ровно один кадр:
+//
+//	+---------+------+----------------+-----------------+
+//	| версия  | тип  | длина (uint32) | полезная нагрузка |
+//	| 1 байт  | 1 б. | big-endian     | длина байт        |
+//	+---------+------+----------------+-----------------+
+//
+// Строки внутри нагрузки кодируются как uint16 длины + байты UTF-8,
+// бинарные данные - как uint32 длины + байты.
+//
+// Заголовок голосовых пакетов (:6001) описан в voice.go.
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Version - текущая версия формата кадров
+const Version byte = 1
+
+// HeaderSize - размер заголовка кадра в байтах
+const HeaderSize = 6
+
+// Type определяет тип кадра
+type Type byte
+
+const (
+	TypeJoin       Type = 1  // Вход пользователя в чат
+	TypeLeave      Type = 2  // Выход пользователя из чата
+	TypeChat       Type = 3  // Текстовое сообщение
+	TypeImage      Type = 4  // Фрагмент изображения
+	TypeVoiceState Type = 5  // Подключение/отключение от голосового чата
+	TypeError      Type = 6  // Сообщение об ошибке
+	TypeJoinResult Type = 7  // Ответ сервера на вход: принят или отклонен
+	TypeRoom       Type = 8  // Запрос клиента на действие с комнатами
+	TypeRoomList   Type = 9  // Список комнат
+	TypeRoomJoined Type = 10 // Клиент перешел в комнату
+	TypeNotice     Type = 11 // Уведомление от администратора сервера
+	TypeKeepalive  Type = 12 // Проверка связи по управляющему каналу
+	TypeShutdown   Type = 13 // Сервер завершает работу
+)
+
+func (t Type) String() string {
+	switch t {
+	case TypeJoin:
+		return "join"
+	case TypeLeave:
+		return "leave"
+	case TypeChat:
+		return "chat"
+	case TypeImage:
+		return "image"
+	case TypeVoiceState:
+		return "voice-state"
+	case TypeError:
+		return "error"
+	case TypeJoinResult:
+		return "join-result"
+	case TypeRoom:
+		return "room"
+	case TypeRoomList:
+		return "room-list"
+	case TypeRoomJoined:
+		return "room-joined"
+	case TypeNotice:
+		return "notice"
+	case TypeKeepalive:
+		return "keepalive"
+	case TypeShutdown:
+		return "shutdown"
+	}
+	return fmt.Sprintf("type(%d)", byte(t))
+}
+
+var (
+	ErrShortFrame     = errors.New("protocol: кадр короче заголовка")
+	ErrVersion        = errors.New("protocol: неподдерживаемая версия кадра")
+	ErrLength         = errors.New("protocol: длина нагрузки не совпадает с размером кадра")
+	ErrUnknownType    = errors.New("protocol: неизвестный тип кадра")
+	ErrTruncated      = errors.New("protocol: нагрузка обрезана")
+	ErrTrailingData   = errors.New("protocol: лишние данные в конце нагрузки")
+	ErrStringTooLong  = errors.New("protocol: строка длиннее 65535 байт")
+	ErrPayloadTooLong = errors.New("protocol: нагрузка длиннее 4 ГБ")
+)
+
+// Message - сообщение управляющего канала
+type Message interface {
+	Type() Type
+	encode(w *writer) error
+	decode(r *reader) error
+}
+
+// Marshal упаковывает сообщение в кадр
+func Marshal(m Message) ([]byte, error) {
+	w := &writer{buf: make([]byte, HeaderSize, HeaderSize+64)}
+	if err := m.encode(w); err != nil {
+		return nil, err
+	}
+
+	payloadLen := len(w.buf) - HeaderSize
+	if uint64(payloadLen) > uint64(^uint32(0)) {
+		return nil, ErrPayloadTooLong
+	}
+
+	w.buf[0] = Version
+	w.buf[1] = byte(m.Type())
+	binary.BigEndian.PutUint32(w.buf[2:HeaderSize], uint32(payloadLen))
+	return w.buf, nil
+}
+
+// Unmarshal разбирает кадр и возвращает сообщение соответствующего типа
+func Unmarshal(frame []byte) (Message, error) {
+	if len(frame) < HeaderSize {
+		return nil, ErrShortFrame
+	}
+	if frame[0] != Version {
+		return nil, ErrVersion
+	}
+
+	payloadLen := binary.BigEndian.Uint32(frame[2:HeaderSize])
+	if uint64(payloadLen) != uint64(len(frame)-HeaderSize) {
+		return nil, ErrLength
+	}
+
+	m := newMessage(Type(frame[1]))
+	if m == nil {
+		return nil, ErrUnknownType
+	}
+
+	r := &reader{buf: frame[HeaderSize:]}
+	if err := m.decode(r); err != nil {
+		return nil, err
+	}
+	if len(r.buf) != 0 {
+		return nil, ErrTrailingData
+	}
+	return m, nil
+}
+
+func newMessage(t Type) Message {
+	switch t {
+	case TypeJoin:
+		return &Join{}
+	case TypeLeave:
+		return &Leave{}
+	case TypeChat:
+		return &Chat{}
+	case TypeImage:
+		return &ImageChunk{}
+	case TypeVoiceState:
+		return &VoiceState{}
+	case TypeError:
+		return &Error{}
+	case TypeJoinResult:
+		return &JoinResult{}
+	case TypeRoom:
+		return &Room{}
+	case TypeRoomList:
+		return &RoomList{}
+	case TypeRoomJoined:
+		return &RoomJoined{}
+	case TypeNotice:
+		return &Notice{}
+	case TypeKeepalive:
+		return &Keepalive{}
+	case TypeShutdown:
+		return &Shutdown{}
+	}
+	return nil
+}
+
+// writer накапливает нагрузку кадра
+type writer struct {
+	buf []byte
+}
+
+func (w *writer) byte(b byte) {
+	w.buf = append(w.buf, b)
+}
+
+func (w *writer) bool(v bool) {
+	if v {
+		w.byte(1)
+	} else {
+		w.byte(0)
+	}
+}
+
+func (w *writer) uint32(v uint32) {
+	w.buf = binary.BigEndian.AppendUint32(w.buf, v)
+}
+
+func (w *writer) fixed(b []byte) {
+	w.buf = append(w.buf, b...)
+}
+
+func (w *writer) string(s string) error {
+	if len(s) > 0xFFFF {
+		return ErrStringTooLong
+	}
+	w.buf = binary.BigEndian.AppendUint16(w.buf, uint16(len(s)))
+	w.buf = append(w.buf, s...)
+	return nil
+}
+
+func (w *writer) bytes(b []byte) error {
+	if uint64(len(b)) > uint64(^uint32(0)) {
+		return ErrPayloadTooLong
+	}
+	w.buf = binary.BigEndian.AppendUint32(w.buf, uint32(len(b)))
+	w.buf = append(w.buf, b...)
+	return nil
+}
+
+// reader последовательно читает нагрузку кадра
+type reader struct {
+	buf []byte
+}
+
+func (r *reader) byte() (byte, error) {
+	if len(r.buf) < 1 {
+		return 0, ErrTruncated
+	}
+	b := r.buf[0]
+	r.buf = r.buf[1:]
+	return b, nil
+}
+
+func (r *reader) bool() (bool, error) {
+	b, err := r.byte()
+	return b != 0, err
+}
+
+func (r *reader) uint32() (uint32, error) {
+	if len(r.buf) < 4 {
+		return 0, ErrTruncated
+	}
+	v := binary.BigEndian.Uint32(r.buf)
+	r.buf = r.buf[4:]
+	return v, nil
+}
+
+func (r *reader) fixed(b []byte) error {
+	if len(r.buf) < len(b) {
+		return ErrTruncated
+	}
+	copy(b, r.buf)
+	r.buf = r.buf[len(b):]
+	return nil
+}
+
+func (r *reader) string() (string, error) {
+	if len(r.buf) < 2 {
+		return "", ErrTruncated
+	}
+	n := int(binary.BigEndian.Uint16(r.buf))
+	if len(r.buf) < 2+n {
+		return "", ErrTruncated
+	}
+	s := string(r.buf[2 : 2+n])
+	r.buf = r.buf[2+n:]
+	return s, nil
+}
+
+func (r *reader) bytes() ([]byte, error) {
+	if len(r.buf) < 4 {
+		return nil, ErrTruncated
+	}
+	n := binary.BigEndian.Uint32(r.buf)
+	if uint64(len(r.buf)-4) < uint64(n) {
+		return nil, ErrTruncated
+	}
+	b := make([]byte, n)
+	copy(b, r.buf[4:4+n])
+	r.buf = r.buf[4+n:]
+	return b, nil
+}
@@ -0,0 +1,118 @@
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	messages := []Message{
+		&Join{Username: "alice"},
+		&Join{Username: "alice", Token: "eyJzdWIiOiJhbGljZSJ9.c2lnbmF0dXJl"},
+		&Join{Username: "alice", IdentityKey: [IdentityKeySize]byte{0x01, 63: 0xFF}},
+		&JoinResult{Accepted: true},
+		&JoinResult{Accepted: true, VoiceToken: [VoiceTokenSize]byte{0xAA, 15: 0x55}},
+		&JoinResult{Accepted: false, Reason: RejectNameTaken},
+		&JoinResult{Accepted: false, Reason: RejectUnauthorized},
+		&JoinResult{Accepted: false, Reason: RejectNoIdentity},
+		&JoinResult{Accepted: false, Reason: RejectBanned},
+		&Leave{Username: "bob"},
+		&Chat{Sender: "alice", Ciphertext: []byte{1, 0, 2, 0xAB, 0xCD}},
+		&Chat{Ciphertext: []byte{}},
+		&ImageChunk{
+			Sender:     "bob",
+			TransferID: 42,
+			Index:      1,
+			Count:      3,
+			TotalSize:  40000,
+			Checksum:   [32]byte{1, 2, 3},
+			Data:       []byte("data:image/jpeg;base64,/9j/4AAQ"),
+		},
+		&ImageChunk{Sender: "bob", Count: 1, Data: []byte{}},
+		&VoiceState{Username: "carol", Connected: true, StreamID: 0xDEADBEEF},
+		&VoiceState{Username: "carol", Connected: false},
+		&Error{Message: "что-то пошло не так"},
+		&Room{Action: RoomActionJoin, Name: "музыка"},
+		&Room{Action: RoomActionList},
+		&RoomList{Rooms: []RoomInfo{{Name: "general", Members: 3}, {Name: "музыка", Members: 1}}},
+		&RoomList{Rooms: []RoomInfo{}},
+		&RoomJoined{Name: "general"},
+		&Notice{Kind: NoticeKicked, Text: "флуд"},
+		&Notice{Kind: NoticeAnnouncement, Text: "перезапуск через 5 минут"},
+		&Notice{Kind: NoticeMuted},
+		&Keepalive{},
+		&Shutdown{Reason: "обновление", RestartIn: 30},
+		&Shutdown{},
+		&Leave{},
+	}
+
+	for _, want := range messages {
+		frame, err := Marshal(want)
+		if err != nil {
+			t.Fatalf("Marshal(%#v): %v", want, err)
+		}
+		if frame[0] != Version || Type(frame[1]) != want.Type() {
+			t.Fatalf("неверный заголовок %v для %s", frame[:HeaderSize], want.Type())
+		}
+
+		got, err := Unmarshal(frame)
+		if err != nil {
+			t.Fatalf("Unmarshal(%s): %v", want.Type(), err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("round-trip %s: получено %#v, ожидалось %#v", want.Type(), got, want)
+		}
+	}
+}
+
+func TestUnmarshalErrors(t *testing.T) {
+	valid, err := Marshal(&Chat{Sender: "alice", Ciphertext: []byte("hi")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	badVersion := bytes.Clone(valid)
+	badVersion[0] = Version + 1
+
+	unknownType := bytes.Clone(valid)
+	unknownType[1] = 0xFF
+
+	longer := append(bytes.Clone(valid), 0)
+
+	truncated := bytes.Clone(valid[:len(valid)-1])
+	truncated[5]-- // длина в заголовке совпадает, но строка обрезана
+
+	trailing := append(bytes.Clone(valid), 0)
+	trailing[5]++ // длина в заголовке учитывает лишний байт
+
+	tests := []struct {
+		name  string
+		frame []byte
+		want  error
+	}{
+		{"пустой", nil, ErrShortFrame},
+		{"короткий", valid[:HeaderSize-1], ErrShortFrame},
+		{"версия", badVersion, ErrVersion},
+		{"тип", unknownType, ErrUnknownType},
+		{"длина", longer, ErrLength},
+		{"обрезан", truncated, ErrTruncated},
+		{"хвост", trailing, ErrTrailingData},
+		{"текст как кадр", []byte("alice joined the chat"), ErrVersion},
+	}
+
+	for _, tt := range tests {
+		if _, err := Unmarshal(tt.frame); !errors.Is(err, tt.want) {
+			t.Errorf("%s: получено %v, ожидалось %v", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestMarshalStringTooLong(t *testing.T) {
+	_, err := Marshal(&Join{Username: strings.Repeat("a", 0x10000)})
+	if !errors.Is(err, ErrStringTooLong) {
+		t.Fatalf("получено %v, ожидалось %v", err, ErrStringTooLong)
+	}
+}
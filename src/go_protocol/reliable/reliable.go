@@ -0,0 +1,587 @@
+// Package reliable добавляет поверх UDP надежную упорядоченную доставку:
+// у каждого получателя своя нумерация пакетов, получатель подтверждает
+// каждый пакет, неподтвержденные пакеты отправляются повторно, а
+// пришедшие не по порядку придерживаются до заполнения пропуска.
+//
+// Формат пакета:
+//
+//	+--------+-----------------+---------------+----------------+
+//	| вид    | эпоха (uint64)  | номер (uint32)| данные         |
+//	| 1 байт | big-endian      | big-endian    | только у data  |
+//	+--------+-----------------+---------------+----------------+
+//
+// Эпоха своя у каждого направления: время ее начала в наносекундах, и
+// каждая следующая эпоха отправителя в пределах процесса больше
+// предыдущей. Получатель переходит на любую эпоху, которой еще не видел,
+// сбрасывает ожидаемый номер и отправляет заново свои неподтвержденные
+// пакеты: отправитель перезапустился и их не получит. Сравнивать эпохи по
+// величине нельзя: после перезапуска часы могли уйти назад. Опоздавшие
+// пакеты последних maxRetiredEpochs эпох отбрасываются. Нумерация каждой
+// эпохи начинается с нуля, и прием от нового адресата начинается с пакета
+// с нулевым номером.
+//
+// Если адресат не подтверждает пакет после maxRetries повторов,
+// отправитель начинает новую эпоху и отправляет в ней все
+// неподтвержденные пакеты: получатель мог потерять состояние приема.
+//
+// Состояние хранится не больше чем для maxPeers адресатов. Адресат, от
+// которого дольше peerIdleTimeout ничего не приходило и которому нечего
+// отправлять, забывается.
+package reliable
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	kindData byte = 1
+	kindAck  byte = 2
+
+	headerSize = 13
+
+	initialRTO  = 200 * time.Millisecond
+	minRTO      = 50 * time.Millisecond
+	maxRTO      = 3 * time.Second
+	maxRetries  = 10                    // после стольких повторов получатель считается недоступным
+	tickPeriod  = 20 * time.Millisecond // период проверки таймеров повторной отправки
+	maxInFlight = 256                   // размер окна отправки в номерах пакетов
+	maxQueued   = 4096                  // максимум пакетов, ожидающих места в окне
+	maxAhead    = 1024                  // насколько далеко вперед придерживаем пакеты
+
+	maxPeers         = 4096            // адресатов с состоянием одновременно
+	peerIdleTimeout  = 2 * time.Minute // через сколько без пакетов забываем адресата
+	maxRetiredEpochs = 8               // сколько прежних эпох адресата помним, чтобы отбросить их опоздавшие пакеты
+)
+
+var (
+	ErrWindowFull   = errors.New("reliable: слишком много неподтвержденных пакетов")
+	ErrClosed       = errors.New("reliable: соединение закрыто")
+	ErrTooManyPeers = errors.New("reliable: слишком много адресатов")
+)
+
+// pending - отправленный, но еще не подтвержденный пакет
+type pending struct {
+	seq      uint32
+	packet   []byte
+	sentAt   time.Time
+	deadline time.Time
+	retries  int
+}
+
+// peer хранит состояние обмена с одним адресом
+type peer struct {
+	addr      net.Addr
+	lastHeard time.Time // Когда от адресата пришел последний пакет
+
+	// Отправка
+	sendEpoch uint64
+	sendSeq   uint32
+	inFlight  map[uint32]*pending
+	queue     []*pending // ждут освобождения окна
+	srtt      time.Duration
+	rttvar    time.Duration
+	rto       time.Duration
+
+	// Прием
+	recvEpoch   uint64
+	retired     []uint64 // Прежние эпохи приема
+	recvStarted bool
+	recvNext    uint32
+	held        map[uint32][]byte
+}
+
+// delivery - пакет, готовый к выдаче через ReadFrom
+type delivery struct {
+	data []byte
+	addr net.Addr
+}
+
+// Conn реализует net.PacketConn с надежной упорядоченной доставкой
+type Conn struct {
+	pc net.PacketConn
+
+	mu     sync.Mutex
+	peers  map[string]*peer
+	closed bool
+
+	// Очередь доставки используется только читающей горутиной
+	readMu sync.Mutex
+	ready  []delivery
+	buf    []byte
+
+	done chan struct{}
+}
+
+// New оборачивает pc. Все пакеты, проходящие через pc, должны
+// отправляться и читаться через возвращаемое соединение.
+func New(pc net.PacketConn) *Conn {
+	c := &Conn{
+		pc:    pc,
+		peers: make(map[string]*peer),
+		buf:   make([]byte, 64*1024),
+		done:  make(chan struct{}),
+	}
+	go c.retransmitLoop()
+	return c
+}
+
+// nextEpoch возвращает эпоху, которая начинается после prev
+func nextEpoch(prev uint64) uint64 {
+	return max(uint64(time.Now().UnixNano()), prev+1)
+}
+
+func putHeader(packet []byte, kind byte, epoch uint64, seq uint32) {
+	packet[0] = kind
+	binary.BigEndian.PutUint64(packet[1:9], epoch)
+	binary.BigEndian.PutUint32(packet[9:13], seq)
+}
+
+// seqBefore сравнивает номера с учетом переполнения
+func seqBefore(a, b uint32) bool {
+	return int32(a-b) < 0
+}
+
+// peerLocked возвращает состояние адреса, создавая его при необходимости,
+// или nil, если адресатов уже maxPeers. Вызывающий должен удерживать c.mu.
+func (c *Conn) peerLocked(addr net.Addr) *peer {
+	key := addr.String()
+	p, ok := c.peers[key]
+	if !ok {
+		if len(c.peers) >= maxPeers {
+			return nil
+		}
+		p = &peer{
+			addr:      addr,
+			lastHeard: time.Now(),
+			sendEpoch: nextEpoch(0),
+			inFlight:  make(map[uint32]*pending),
+			rto:       initialRTO,
+			held:      make(map[uint32][]byte),
+		}
+		c.peers[key] = p
+	}
+	return p
+}
+
+// WriteTo отправляет b адресату addr с гарантией доставки и порядка
+func (c *Conn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return 0, ErrClosed
+	}
+
+	p := c.peerLocked(addr)
+	if p == nil {
+		c.mu.Unlock()
+		return 0, ErrTooManyPeers
+	}
+	if len(p.inFlight)+len(p.queue) >= maxInFlight+maxQueued {
+		c.mu.Unlock()
+		return 0, ErrWindowFull
+	}
+
+	packet := make([]byte, headerSize+len(b))
+	putHeader(packet, kindData, p.sendEpoch, p.sendSeq)
+	copy(packet[headerSize:], b)
+
+	p.queue = append(p.queue, &pending{seq: p.sendSeq, packet: packet})
+	p.sendSeq++
+	ready := p.promoteLocked(time.Now())
+	c.mu.Unlock()
+
+	// Ошибку отправки не возвращаем: пакет остается в окне и будет
+	// отправлен повторно по таймеру
+	for _, packet := range ready {
+		c.pc.WriteTo(packet, addr)
+	}
+	return len(b), nil
+}
+
+// promoteLocked переносит пакеты из очереди в окно, пока в нем есть место,
+// и возвращает их для отправки. Окно ограничено разбросом номеров от самого
+// старого неподтвержденного пакета, а не их количеством, иначе один
+// потерянный пакет позволил бы уйти за окно получателя.
+// Вызывающий должен удерживать c.mu.
+func (p *peer) promoteLocked(now time.Time) [][]byte {
+	var ready [][]byte
+	if len(p.queue) == 0 {
+		return nil
+	}
+
+	base := p.queue[0].seq
+	for seq := range p.inFlight {
+		if seqBefore(seq, base) {
+			base = seq
+		}
+	}
+
+	for len(p.queue) > 0 && seqBefore(p.queue[0].seq, base+maxInFlight) {
+		entry := p.queue[0]
+		p.queue[0] = nil
+		p.queue = p.queue[1:]
+
+		entry.sentAt = now
+		entry.deadline = now.Add(p.rto)
+		p.inFlight[entry.seq] = entry
+		ready = append(ready, entry.packet)
+	}
+	return ready
+}
+
+// ReadFrom возвращает следующий по порядку пакет от любого адресата
+func (c *Conn) ReadFrom(b []byte) (int, net.Addr, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+
+	for {
+		if len(c.ready) > 0 {
+			d := c.ready[0]
+			c.ready[0] = delivery{}
+			c.ready = c.ready[1:]
+			return copy(b, d.data), d.addr, nil
+		}
+
+		n, addr, err := c.pc.ReadFrom(c.buf)
+		if err != nil {
+			return 0, nil, err
+		}
+		if n < headerSize {
+			continue
+		}
+
+		epoch := binary.BigEndian.Uint64(c.buf[1:9])
+		seq := binary.BigEndian.Uint32(c.buf[9:13])
+
+		var ready [][]byte
+		switch c.buf[0] {
+		case kindAck:
+			ready = c.handleAck(addr, epoch, seq)
+		case kindData:
+			ready = c.handleData(addr, epoch, seq, c.buf[headerSize:n])
+		}
+		for _, packet := range ready {
+			c.pc.WriteTo(packet, addr)
+		}
+	}
+}
+
+// handleAck снимает подтвержденный пакет с окна и возвращает пакеты,
+// которые освободившееся место позволяет отправить
+func (c *Conn) handleAck(addr net.Addr, epoch uint64, seq uint32) [][]byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	p, ok := c.peers[addr.String()]
+	if !ok || p.sendEpoch != epoch {
+		return nil
+	}
+	entry, ok := p.inFlight[seq]
+	if !ok {
+		return nil
+	}
+	delete(p.inFlight, seq)
+
+	// Оцениваем RTT только по пакетам без повторов (алгоритм Карна)
+	now := time.Now()
+	p.lastHeard = now
+	if entry.retries == 0 {
+		p.updateRTO(now.Sub(entry.sentAt))
+	}
+	return p.promoteLocked(now)
+}
+
+// restartSendLocked начинает отправку с новой эпохи. Неподтвержденные
+// пакеты получают номера новой эпохи по порядку и ждут отправки в очереди.
+// Вызывающий должен удерживать c.mu.
+func (p *peer) restartSendLocked() {
+	entries := p.unackedLocked()
+	p.inFlight = make(map[uint32]*pending)
+	p.queue = nil
+	p.sendEpoch = nextEpoch(p.sendEpoch)
+	p.sendSeq = 0
+	p.rto = initialRTO
+	p.srtt = 0
+	p.rttvar = 0
+
+	for _, entry := range entries {
+		// Прежний пакет может как раз отправляться повторно, меняем копию
+		entry.packet = bytes.Clone(entry.packet)
+		putHeader(entry.packet, kindData, p.sendEpoch, p.sendSeq)
+		entry.seq = p.sendSeq
+		entry.retries = 0
+		p.queue = append(p.queue, entry)
+		p.sendSeq++
+	}
+}
+
+// unackedLocked возвращает неподтвержденные пакеты в порядке отправки.
+// Вызывающий должен удерживать c.mu.
+func (p *peer) unackedLocked() []*pending {
+	entries := make([]*pending, 0, len(p.inFlight)+len(p.queue))
+	for _, entry := range p.inFlight {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return seqBefore(entries[i].seq, entries[j].seq) })
+	return append(entries, p.queue...)
+}
+
+// updateRTO пересчитывает таймаут повторной отправки по RFC 6298
+func (p *peer) updateRTO(rtt time.Duration) {
+	if p.srtt == 0 {
+		p.srtt = rtt
+		p.rttvar = rtt / 2
+	} else {
+		diff := p.srtt - rtt
+		if diff < 0 {
+			diff = -diff
+		}
+		p.rttvar = (3*p.rttvar + diff) / 4
+		p.srtt = (7*p.srtt + rtt) / 8
+	}
+
+	p.rto = p.srtt + 4*p.rttvar
+	if p.rto < minRTO {
+		p.rto = minRTO
+	}
+	if p.rto > maxRTO {
+		p.rto = maxRTO
+	}
+}
+
+// handleData подтверждает пакет, ставит в очередь все, что теперь можно
+// выдать по порядку, и возвращает пакеты, которые нужно отправить
+// адресату. Вызывается только из ReadFrom.
+func (c *Conn) handleData(addr net.Addr, epoch uint64, seq uint32, data []byte) [][]byte {
+	c.mu.Lock()
+	p, known := c.peers[addr.String()]
+	if !known || !p.recvStarted {
+		// Прием начинается с первого пакета эпохи, остальные отправитель
+		// повторит. Так адресат, которого мы забыли, не придерживается
+		// навсегда в ожидании давно выданного пакета: не получив
+		// подтверждений, он начнет новую эпоху.
+		if seq != 0 {
+			c.mu.Unlock()
+			return nil
+		}
+		if p = c.peerLocked(addr); p == nil {
+			c.mu.Unlock()
+			return nil
+		}
+	}
+	if p.recvStarted && epoch != p.recvEpoch && slices.Contains(p.retired, epoch) {
+		// Опоздавший пакет прежней эпохи
+		c.mu.Unlock()
+		return nil
+	}
+
+	var ready [][]byte
+	now := time.Now()
+	p.lastHeard = now
+
+	// Новая эпоха - отправитель перезапустился, начинаем прием заново
+	if !p.recvStarted || p.recvEpoch != epoch {
+		// Вместе с отправителем заново начался и его прием: нашу прежнюю
+		// нумерацию он не знает и ждал бы пакета с нулевым номером
+		if p.recvStarted {
+			p.restartSendLocked()
+			ready = p.promoteLocked(now)
+			p.retired = append(p.retired, p.recvEpoch)
+			if len(p.retired) > maxRetiredEpochs {
+				p.retired = p.retired[1:]
+			}
+		}
+		p.recvStarted = true
+		p.recvEpoch = epoch
+		p.recvNext = 0
+		p.held = make(map[uint32][]byte)
+	}
+
+	accept := !seqBefore(seq, p.recvNext) && seqBefore(seq, p.recvNext+maxAhead)
+	if accept {
+		if seq == p.recvNext {
+			c.ready = append(c.ready, delivery{data: append([]byte(nil), data...), addr: addr})
+			p.recvNext++
+			for {
+				next, ok := p.held[p.recvNext]
+				if !ok {
+					break
+				}
+				delete(p.held, p.recvNext)
+				c.ready = append(c.ready, delivery{data: next, addr: addr})
+				p.recvNext++
+			}
+		} else if _, dup := p.held[seq]; !dup {
+			p.held[seq] = append([]byte(nil), data...)
+		}
+	}
+
+	// Подтверждаем и дубликаты: предыдущее подтверждение могло потеряться.
+	// Пакеты дальше окна не подтверждаем, чтобы отправитель повторил их позже.
+	sendAck := accept || seqBefore(seq, p.recvNext)
+	c.mu.Unlock()
+
+	if sendAck {
+		ack := make([]byte, headerSize)
+		putHeader(ack, kindAck, epoch, seq)
+		ready = append([][]byte{ack}, ready...)
+	}
+	return ready
+}
+
+// retransmitLoop повторно отправляет пакеты с истекшим таймаутом
+func (c *Conn) retransmitLoop() {
+	ticker := time.NewTicker(tickPeriod)
+	defer ticker.Stop()
+
+	type resend struct {
+		packet []byte
+		addr   net.Addr
+	}
+	var queue []resend
+
+	for {
+		select {
+		case <-c.done:
+			return
+		case now := <-ticker.C:
+			queue = queue[:0]
+
+			c.mu.Lock()
+			for key, p := range c.peers {
+				if len(p.inFlight) == 0 && len(p.queue) == 0 && now.Sub(p.lastHeard) > peerIdleTimeout {
+					delete(c.peers, key)
+					continue
+				}
+
+				giveUp := false
+				for _, entry := range p.inFlight {
+					if now.Before(entry.deadline) {
+						continue
+					}
+					if entry.retries >= maxRetries {
+						giveUp = true
+						break
+					}
+					entry.retries++
+					backoff := p.rto << entry.retries
+					if backoff > maxRTO || backoff <= 0 {
+						backoff = maxRTO
+					}
+					entry.deadline = now.Add(backoff)
+					queue = append(queue, resend{packet: entry.packet, addr: p.addr})
+				}
+
+				if giveUp {
+					// Адресат не отвечает: возможно, он забыл нас и ждет
+					// пакета с нулевым номером. Начинаем новую эпоху и
+					// отправляем в ней все неподтвержденное.
+					p.restartSendLocked()
+					for _, packet := range p.promoteLocked(now) {
+						queue = append(queue, resend{packet: packet, addr: p.addr})
+					}
+				}
+			}
+			c.mu.Unlock()
+
+			for _, r := range queue {
+				c.pc.WriteTo(r.packet, r.addr)
+			}
+		}
+	}
+}
+
+// Forget удаляет состояние адресата, например после его отключения
+func (c *Conn) Forget(addr net.Addr) {
+	c.mu.Lock()
+	delete(c.peers, addr.String())
+	c.mu.Unlock()
+}
+
+// Pending возвращает число пакетов всем адресатам, которые еще не
+// подтверждены
+func (c *Conn) Pending() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := 0
+	for _, p := range c.peers {
+		n += len(p.inFlight) + len(p.queue)
+	}
+	return n
+}
+
+// Unacked возвращает данные пакетов адресату addr, которые еще не
+// подтверждены, в порядке отправки. Нужен, чтобы после потери связи
+// отправить их заново через новое соединение.
+func (c *Conn) Unacked(addr net.Addr) [][]byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	p, ok := c.peers[addr.String()]
+	if !ok {
+		return nil
+	}
+	entries := p.unackedLocked()
+	data := make([][]byte, len(entries))
+	for i, entry := range entries {
+		data[i] = bytes.Clone(entry.packet[headerSize:])
+	}
+	return data
+}
+
+// Flush ждет подтверждения всех отправленных пакетов, но не дольше
+// timeout, и сообщает, удалось ли. Подтверждения разбирает ReadFrom,
+// поэтому во время Flush соединение должен кто-то читать.
+func (c *Conn) Flush(timeout time.Duration) bool {
+	return c.waitAcked(timeout, c.Pending)
+}
+
+// FlushTo как Flush, но ждет подтверждения только пакетов адресату addr
+func (c *Conn) FlushTo(addr net.Addr, timeout time.Duration) bool {
+	return c.waitAcked(timeout, func() int {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		p, ok := c.peers[addr.String()]
+		if !ok {
+			return 0
+		}
+		return len(p.inFlight) + len(p.queue)
+	})
+}
+
+func (c *Conn) waitAcked(timeout time.Duration, pending func() int) bool {
+	deadline := time.Now().Add(timeout)
+	for pending() > 0 {
+		if !time.Now().Before(deadline) {
+			return false
+		}
+		time.Sleep(tickPeriod)
+	}
+	return true
+}
+
+// Close останавливает повторную отправку и закрывает нижележащее соединение
+func (c *Conn) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.closed = true
+	c.mu.Unlock()
+
+	close(c.done)
+	return c.pc.Close()
+}
+
+func (c *Conn) LocalAddr() net.Addr                { return c.pc.LocalAddr() }
+func (c *Conn) SetDeadline(t time.Time) error      { return c.pc.SetDeadline(t) }
+func (c *Conn) SetReadDeadline(t time.Time) error  { return c.pc.SetReadDeadline(t) }
+func (c *Conn) SetWriteDeadline(t time.Time) error { return c.pc.SetWriteDeadline(t) }
@@ -0,0 +1,389 @@
+package reliable
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func listen(t *testing.T) *Conn {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := New(pc)
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+// drain читает соединение, чтобы оно разбирало подтверждения
+func drain(c *Conn) {
+	buf := make([]byte, 2048)
+	for {
+		if _, _, err := c.ReadFrom(buf); err != nil {
+			return
+		}
+	}
+}
+
+// raw - адресат без надежной доставки: тест сам собирает его пакеты
+type raw struct {
+	t  *testing.T
+	pc net.PacketConn
+}
+
+func listenRaw(t *testing.T) *raw {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	return &raw{t: t, pc: pc}
+}
+
+func (r *raw) send(to *Conn, kind byte, epoch uint64, seq uint32, data string) {
+	packet := make([]byte, headerSize+len(data))
+	putHeader(packet, kind, epoch, seq)
+	copy(packet[headerSize:], data)
+	if _, err := r.pc.WriteTo(packet, to.LocalAddr()); err != nil {
+		r.t.Fatal(err)
+	}
+}
+
+// recv возвращает следующий пакет вида kind
+func (r *raw) recv(kind byte) (epoch uint64, seq uint32, data string) {
+	r.t.Helper()
+	buf := make([]byte, 2048)
+	r.pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		n, _, err := r.pc.ReadFrom(buf)
+		if err != nil {
+			r.t.Fatal(err)
+		}
+		if n >= headerSize && buf[0] == kind {
+			return binary.BigEndian.Uint64(buf[1:9]), binary.BigEndian.Uint32(buf[9:13]), string(buf[headerSize:n])
+		}
+	}
+}
+
+// expectRead проверяет, что c выдает сообщения want по порядку
+func expectRead(t *testing.T, c *Conn, want ...string) {
+	t.Helper()
+	buf := make([]byte, 2048)
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	defer c.SetReadDeadline(time.Time{})
+	for _, msg := range want {
+		n, _, err := c.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("ожидалось %q: %v", msg, err)
+		}
+		if string(buf[:n]) != msg {
+			t.Fatalf("получено %q, ожидалось %q", buf[:n], msg)
+		}
+	}
+}
+
+func TestReorderAndDuplicates(t *testing.T) {
+	receiver, sender := listen(t), listenRaw(t)
+
+	// Прием от нового адресата начинается с нулевого номера, первый пакет
+	// не придерживается и не подтверждается
+	sender.send(receiver, kindData, 10, 1, "два")
+	sender.send(receiver, kindData, 10, 0, "раз")
+	sender.send(receiver, kindData, 10, 2, "три")
+	sender.send(receiver, kindData, 10, 1, "два")
+	sender.send(receiver, kindData, 10, 0, "раз")
+	expectRead(t, receiver, "раз", "два", "три")
+	go drain(receiver)
+
+	// Дубликаты подтверждаются повторно, но не выдаются
+	for _, want := range []uint32{0, 2, 1, 0} {
+		if epoch, seq, _ := sender.recv(kindAck); epoch != 10 || seq != want {
+			t.Errorf("подтверждение %d/%d, ожидалось 10/%d", epoch, seq, want)
+		}
+	}
+}
+
+func TestStaleEpoch(t *testing.T) {
+	receiver, sender := listen(t), listenRaw(t)
+
+	sender.send(receiver, kindData, 10, 0, "раз")
+	expectRead(t, receiver, "раз")
+
+	// Новая эпоха начинает прием заново
+	sender.send(receiver, kindData, 20, 0, "после перезапуска")
+	expectRead(t, receiver, "после перезапуска")
+
+	// Опоздавший пакет прежней эпохи не сбивает прием
+	sender.send(receiver, kindData, 10, 1, "старый")
+	sender.send(receiver, kindData, 20, 1, "два")
+	expectRead(t, receiver, "два")
+
+	// Эпоха меньше текущей, но новая: часы отправителя ушли назад
+	sender.send(receiver, kindData, 5, 0, "часы ушли назад")
+	expectRead(t, receiver, "часы ушли назад")
+	go drain(receiver)
+
+	for _, want := range []struct {
+		epoch uint64
+		seq   uint32
+	}{{10, 0}, {20, 0}, {20, 1}, {5, 0}} {
+		if epoch, seq, _ := sender.recv(kindAck); epoch != want.epoch || seq != want.seq {
+			t.Errorf("подтверждение %d/%d, ожидалось %d/%d", epoch, seq, want.epoch, want.seq)
+		}
+	}
+}
+
+func TestEpochResetKeepsUnacked(t *testing.T) {
+	local, remote := listen(t), listenRaw(t)
+
+	remote.send(local, kindData, 10, 0, "привет")
+	expectRead(t, local, "привет")
+	go drain(local)
+
+	// Адресат не подтверждает ответ, а потом перезапускается
+	local.WriteTo([]byte("ответ"), remote.pc.LocalAddr())
+	oldEpoch, seq, data := remote.recv(kindData)
+	if seq != 0 || data != "ответ" {
+		t.Fatalf("получен пакет %d %q", seq, data)
+	}
+	remote.send(local, kindData, 20, 0, "снова привет")
+
+	// Ответ не теряется, а уходит заново в новой эпохе
+	for {
+		epoch, seq, data := remote.recv(kindData)
+		if epoch == oldEpoch {
+			continue // Повтор, отправленный до перезапуска
+		}
+		if epoch < oldEpoch || seq != 0 || data != "ответ" {
+			t.Fatalf("после перезапуска получен пакет %d/%d %q, прежняя эпоха %d", epoch, seq, data, oldEpoch)
+		}
+		break
+	}
+}
+
+func TestGiveUpResendsInNewEpoch(t *testing.T) {
+	local, remote := listen(t), listenRaw(t)
+	go drain(local)
+
+	local.WriteTo([]byte("раз"), remote.pc.LocalAddr())
+	local.WriteTo([]byte("два"), remote.pc.LocalAddr())
+	oldEpoch, _, _ := remote.recv(kindData)
+
+	// Адресат так и не подтвердил пакеты: повторы исчерпаны
+	local.mu.Lock()
+	for _, entry := range local.peers[remote.pc.LocalAddr().String()].inFlight {
+		entry.retries = maxRetries
+		entry.deadline = time.Now()
+	}
+	local.mu.Unlock()
+
+	// Пакеты не теряются, а уходят заново в новой эпохе с нулевого номера
+	var got []string
+	for len(got) < 2 {
+		epoch, seq, data := remote.recv(kindData)
+		if epoch == oldEpoch {
+			continue
+		}
+		if seq != uint32(len(got)) {
+			t.Fatalf("в новой эпохе пакет %d %q, ожидался номер %d", seq, data, len(got))
+		}
+		got = append(got, data)
+	}
+	if got[0] != "раз" || got[1] != "два" {
+		t.Errorf("в новой эпохе отправлено %q", got)
+	}
+}
+
+// lossyConn теряет каждый третий из первых 150 отправленных пакетов.
+// Дальше потерь нет, чтобы повторы с растущей задержкой не затягивали тест.
+type lossyConn struct {
+	net.PacketConn
+
+	mu   sync.Mutex
+	sent int
+}
+
+func (c *lossyConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c.mu.Lock()
+	c.sent++
+	lost := c.sent%3 == 0 && c.sent <= 150
+	c.mu.Unlock()
+	if lost {
+		return len(b), nil
+	}
+	return c.PacketConn.WriteTo(b, addr)
+}
+
+func listenLossy(t *testing.T) *Conn {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := New(&lossyConn{PacketConn: pc})
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func TestLoss(t *testing.T) {
+	sender, receiver := listenLossy(t), listenLossy(t)
+	go drain(sender)
+
+	var want []string
+	for i := 0; i < 100; i++ {
+		msg := string(rune('а'+i%32)) + string(rune('0'+i/10)) + string(rune('0'+i%10))
+		want = append(want, msg)
+		if _, err := sender.WriteTo([]byte(msg), receiver.LocalAddr()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expectRead(t, receiver, want...)
+	go drain(receiver)
+
+	if !sender.Flush(5 * time.Second) {
+		t.Errorf("не подтверждено %d пакетов", sender.Pending())
+	}
+}
+
+func TestFlush(t *testing.T) {
+	sender, receiver := listen(t), listen(t)
+	go drain(sender)
+	go drain(receiver)
+
+	for i := 0; i < 10; i++ {
+		if _, err := sender.WriteTo([]byte("привет"), receiver.LocalAddr()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !sender.Flush(5 * time.Second) {
+		t.Fatalf("не подтверждено %d пакетов", sender.Pending())
+	}
+	if n := sender.Pending(); n != 0 {
+		t.Errorf("после Flush осталось %d пакетов", n)
+	}
+}
+
+func TestFlushTimeout(t *testing.T) {
+	sender := listen(t)
+	go drain(sender)
+
+	// Адресат молчит: подтверждений не будет
+	silent, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+
+	sender.WriteTo([]byte("есть кто?"), silent.LocalAddr())
+	start := time.Now()
+	if sender.Flush(100 * time.Millisecond) {
+		t.Fatal("Flush без подтверждений вернул true")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Flush ждал %v вместо 100мс", elapsed)
+	}
+}
+
+func TestFlushTo(t *testing.T) {
+	sender, receiver := listen(t), listen(t)
+	go drain(sender)
+	go drain(receiver)
+
+	silent, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+
+	// Молчащий адресат не мешает дождаться подтверждений от receiver
+	sender.WriteTo([]byte("есть кто?"), silent.LocalAddr())
+	sender.WriteTo([]byte("привет"), receiver.LocalAddr())
+	if !sender.FlushTo(receiver.LocalAddr(), 5*time.Second) {
+		t.Fatal("receiver не подтвердил пакет")
+	}
+	if sender.FlushTo(silent.LocalAddr(), 100*time.Millisecond) {
+		t.Error("FlushTo без подтверждений вернул true")
+	}
+}
+
+func TestUnacked(t *testing.T) {
+	sender := listen(t)
+	go drain(sender)
+
+	silent, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+
+	want := []string{"раз", "два", "три"}
+	for _, msg := range want {
+		sender.WriteTo([]byte(msg), silent.LocalAddr())
+	}
+	got := sender.Unacked(silent.LocalAddr())
+	if len(got) != len(want) {
+		t.Fatalf("не подтверждено %d пакетов, ожидалось %d", len(got), len(want))
+	}
+	for i := range want {
+		if string(got[i]) != want[i] {
+			t.Errorf("пакет %d: %q, ожидалось %q", i, got[i], want[i])
+		}
+	}
+}
+
+// keepOpen не дает Close закрыть общий сокет, чтобы перезапустить Conn на
+// том же адресе
+type keepOpen struct{ net.PacketConn }
+
+func (keepOpen) Close() error { return nil }
+
+func TestPeerRestart(t *testing.T) {
+	server := listen(t)
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	buf := make([]byte, 2048)
+
+	// Первый клиент здоровается, получает несколько пакетов и пропадает
+	first := New(keepOpen{pc})
+	first.WriteTo([]byte("привет"), server.LocalAddr())
+	server.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, _, err := server.ReadFrom(buf); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		server.WriteTo([]byte("до перезапуска"), pc.LocalAddr())
+		first.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, _, err := first.ReadFrom(buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	first.Close()
+
+	// Новый клиент на том же адресе начинает нумерацию заново, и сервер
+	// должен начать заново свою
+	second := New(keepOpen{pc})
+	defer second.Close()
+	second.WriteTo([]byte("привет"), server.LocalAddr())
+
+	server.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, addr, err := server.ReadFrom(buf)
+	if err != nil || string(buf[:n]) != "привет" {
+		t.Fatalf("сервер получил %q: %v", buf[:n], err)
+	}
+	go drain(server)
+	server.WriteTo([]byte("после перезапуска"), addr)
+
+	second.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err = second.ReadFrom(buf)
+	if err != nil || string(buf[:n]) != "после перезапуска" {
+		t.Fatalf("клиент получил %q: %v", buf[:n], err)
+	}
+}
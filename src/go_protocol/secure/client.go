@@ -0,0 +1,182 @@
+package secure
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Интервал повтора ClientHello, если ответ не пришел
+const helloRetryInterval = 500 * time.Millisecond
+
+// VerifyFunc проверяет долговременный ключ сервера, например сверяет его
+// с сохраненным. Ошибка прерывает рукопожатие.
+type VerifyFunc func(serverKey ed25519.PublicKey) error
+
+// ClientConn - управляющий канал клиента после рукопожатия. Реализует
+// net.PacketConn и принимает данные только от сервера.
+type ClientConn struct {
+	net.PacketConn
+	server    net.Addr
+	serverKey ed25519.PublicKey
+	session   *Session
+
+	readMu sync.Mutex
+	buf    []byte
+}
+
+// Dial выполняет рукопожатие с сервером через pc. verify вызывается до
+// вывода ключей, поэтому подмененный сервер не получит ни одного пакета
+// данных. timeout ограничивает все рукопожатие.
+func Dial(pc net.PacketConn, server net.Addr, verify VerifyFunc, timeout time.Duration) (*ClientConn, error) {
+	ephemeral, err := newEphemeral()
+	if err != nil {
+		return nil, err
+	}
+	hello := clientHello{index: randomIndex(), ephemeral: ephemeral.PublicKey().Bytes()}
+	packet := hello.marshal()
+
+	defer pc.SetReadDeadline(time.Time{})
+	deadline := time.Now().Add(timeout)
+	buf := make([]byte, 64*1024)
+
+	for time.Now().Before(deadline) {
+		if _, err := pc.WriteTo(packet, server); err != nil {
+			return nil, err
+		}
+
+		retry := time.Now().Add(helloRetryInterval)
+		if retry.After(deadline) {
+			retry = deadline
+		}
+		pc.SetReadDeadline(retry)
+
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			if addr.String() != server.String() {
+				continue
+			}
+
+			reply, err := parseServerHello(buf[:n])
+			if err != nil || reply.clientIndex != hello.index {
+				continue
+			}
+			// Ответ с неверной подписью мог подбросить кто угодно, ждем дальше
+			th := transcript(hello, reply)
+			if !ed25519.Verify(reply.identity, signedMessage(th), reply.signature) {
+				continue
+			}
+			if verify != nil {
+				if err := verify(reply.identity); err != nil {
+					return nil, err
+				}
+			}
+
+			shared, err := sharedSecret(ephemeral, reply.ephemeral)
+			if err != nil {
+				return nil, err
+			}
+			return &ClientConn{
+				PacketConn: pc,
+				server:     server,
+				serverKey:  reply.identity,
+				session:    deriveSession(shared, th, true, hello.index, reply.serverIndex),
+				buf:        buf,
+			}, nil
+		}
+	}
+	return nil, ErrTimeout
+}
+
+// ServerKey возвращает долговременный ключ сервера из рукопожатия
+func (c *ClientConn) ServerKey() ed25519.PublicKey {
+	return c.serverKey
+}
+
+// ReadFrom возвращает следующую подлинную датаграмму от сервера
+func (c *ClientConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(c.buf)
+		if err != nil {
+			return 0, nil, err
+		}
+		if addr.String() != c.server.String() {
+			continue
+		}
+		if index, ok := dataIndex(c.buf[:n]); !ok || index != c.session.localIndex {
+			continue
+		}
+
+		plaintext, err := c.session.control.open(b[:0], c.buf[:n])
+		if err != nil {
+			continue
+		}
+		return copy(b, plaintext), addr, nil
+	}
+}
+
+// WriteTo шифрует p ключом управляющего канала
+func (c *ClientConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	packet := c.session.control.seal(make([]byte, 0, len(p)+Overhead), p)
+	if _, err := c.PacketConn.WriteTo(packet, addr); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Voice оборачивает соединенный с голосовым портом сервера сокет
+// голосовыми ключами этой сессии
+func (c *ClientConn) Voice(conn net.Conn) net.Conn {
+	return &voiceConn{Conn: conn, session: c.session, buf: make([]byte, 64*1024)}
+}
+
+type voiceConn struct {
+	net.Conn
+	session *Session
+
+	readMu sync.Mutex
+	buf    []byte
+}
+
+// Read возвращает следующий подлинный голосовой пакет
+func (c *voiceConn) Read(b []byte) (int, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+
+	for {
+		n, err := c.Conn.Read(c.buf)
+		if err != nil {
+			return 0, err
+		}
+		if index, ok := dataIndex(c.buf[:n]); !ok || index != c.session.localIndex {
+			continue
+		}
+
+		plaintext, err := c.session.voice.open(b[:0], c.buf[:n])
+		if err != nil {
+			continue
+		}
+		return copy(b, plaintext), nil
+	}
+}
+
+// Write шифрует голосовой пакет
+func (c *voiceConn) Write(p []byte) (int, error) {
+	packet := c.session.voice.seal(make([]byte, 0, len(p)+Overhead), p)
+	if _, err := c.Conn.Write(packet); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
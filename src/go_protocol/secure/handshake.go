@@ -0,0 +1,160 @@
+package secure
+
+import (
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+const (
+	x25519KeySize   = 32
+	serverHelloSize = 1 + 4 + 4 + x25519KeySize + ed25519.PublicKeySize + ed25519.SignatureSize
+
+	// ClientHello дополняется до размера ответа, чтобы сервер нельзя
+	// было использовать для усиления трафика на чужой адрес
+	clientHelloSize = serverHelloSize
+)
+
+// Контекст подписи, чтобы подпись рукопожатия нельзя было выдать за
+// подпись чего-то другого
+const signatureContext = "airchat handshake v1"
+
+// clientHello - первый пакет рукопожатия от клиента
+type clientHello struct {
+	index     uint32
+	ephemeral []byte
+}
+
+func (h clientHello) marshal() []byte {
+	b := make([]byte, 0, clientHelloSize)
+	b = append(b, kindClientHello)
+	b = binary.BigEndian.AppendUint32(b, h.index)
+	b = append(b, h.ephemeral...)
+	return b[:clientHelloSize] // Дополнение нулями
+}
+
+func parseClientHello(p []byte) (clientHello, error) {
+	if len(p) != clientHelloSize || p[0] != kindClientHello {
+		return clientHello{}, ErrHandshake
+	}
+	return clientHello{
+		index:     binary.BigEndian.Uint32(p[1:5]),
+		ephemeral: p[5 : 5+x25519KeySize],
+	}, nil
+}
+
+// serverHello - ответ сервера: его одноразовый ключ, долговременный ключ
+// и подпись рукопожатия этим ключом
+type serverHello struct {
+	clientIndex uint32
+	serverIndex uint32
+	ephemeral   []byte
+	identity    ed25519.PublicKey
+	signature   []byte
+}
+
+// signedPart - все поля ответа, кроме подписи
+func (h serverHello) signedPart() []byte {
+	b := make([]byte, 0, serverHelloSize)
+	b = append(b, kindServerHello)
+	b = binary.BigEndian.AppendUint32(b, h.clientIndex)
+	b = binary.BigEndian.AppendUint32(b, h.serverIndex)
+	b = append(b, h.ephemeral...)
+	return append(b, h.identity...)
+}
+
+func (h serverHello) marshal() []byte {
+	return append(h.signedPart(), h.signature...)
+}
+
+func parseServerHello(p []byte) (serverHello, error) {
+	if len(p) != serverHelloSize || p[0] != kindServerHello {
+		return serverHello{}, ErrHandshake
+	}
+	p = p[1:]
+	h := serverHello{
+		clientIndex: binary.BigEndian.Uint32(p[0:4]),
+		serverIndex: binary.BigEndian.Uint32(p[4:8]),
+	}
+	p = p[8:]
+	h.ephemeral, p = p[:x25519KeySize], p[x25519KeySize:]
+	h.identity, p = ed25519.PublicKey(p[:ed25519.PublicKeySize]), p[ed25519.PublicKeySize:]
+	h.signature = p
+	return h, nil
+}
+
+// transcript - хеш рукопожатия, им подписывается ответ сервера и
+// солится вывод ключей
+func transcript(client clientHello, server serverHello) []byte {
+	sum := sha256.New()
+	sum.Write(client.marshal())
+	sum.Write(server.signedPart())
+	return sum.Sum(nil)
+}
+
+func signedMessage(transcript []byte) []byte {
+	return append([]byte(signatureContext), transcript...)
+}
+
+// randomIndex выбирает ненулевой индекс сессии
+func randomIndex() uint32 {
+	var b [4]byte
+	for {
+		rand.Read(b[:])
+		if index := binary.BigEndian.Uint32(b[:]); index != 0 {
+			return index
+		}
+	}
+}
+
+func newEphemeral() (*ecdh.PrivateKey, error) {
+	return ecdh.X25519().GenerateKey(rand.Reader)
+}
+
+// sharedSecret вычисляет общий секрет X25519 с ключом собеседника
+func sharedSecret(private *ecdh.PrivateKey, peer []byte) ([]byte, error) {
+	public, err := ecdh.X25519().NewPublicKey(peer)
+	if err != nil {
+		return nil, ErrHandshake
+	}
+	shared, err := private.ECDH(public)
+	if err != nil {
+		// Нулевой результат: собеседник прислал ключ малого порядка
+		return nil, ErrHandshake
+	}
+	return shared, nil
+}
+
+// LoadOrCreateIdentity читает долговременный ключ сервера из path
+// (seed Ed25519 в base64). Если файла нет, создает новый ключ и сохраняет
+// его с правами 0600.
+func LoadOrCreateIdentity(path string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		encoded := base64.StdEncoding.EncodeToString(key.Seed()) + "\n"
+		if err := os.WriteFile(path, []byte(encoded), 0o600); err != nil {
+			return nil, err
+		}
+		return key, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	seed, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("secure: %s не содержит ключ Ed25519", path)
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
@@ -0,0 +1,226 @@
+// Package secure шифрует датаграммы управляющего и голосового каналов.
+//
+// Клиент и сервер обмениваются одноразовыми ключами X25519 за одно
+// рукопожатие, сервер подписывает его своим долговременным ключом
+// Ed25519, а клиент сверяет этот ключ с сохраненным. Из общего секрета
+// и хеша рукопожатия HKDF-SHA256 выводит четыре ключа ChaCha20-Poly1305:
+// по одному на каждое направление управляющего и голосового каналов.
+//
+// Формат пакетов:
+//
+//	ClientHello: | 1 | индекс клиента (u32) | ключ X25519 (32) | дополнение |
+//	ServerHello: | 2 | индекс клиента (u32) | индекс сервера (u32) |
+//	             | ключ X25519 (32) | ключ Ed25519 (32) | подпись (64) |
+//	Данные:      | 3 | индекс получателя (u32) | счетчик (u64) | шифротекст |
+//
+// Индекс выбирает получатель и по нему находит сессию. Одноразовый код
+// (nonce) - счетчик отправителя, заголовок данных входит в проверяемые
+// данные AEAD. Получатель отбрасывает пакеты со счетчиком, который уже
+// встречался или отстал от самого нового больше чем на размер окна.
+package secure
+
+import (
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	kindClientHello byte = 1
+	kindServerHello byte = 2
+	kindData        byte = 3
+)
+
+const (
+	dataHeaderSize = 1 + 4 + 8
+
+	// Размер окна защиты от повторов в пакетах, для голоса это 20 секунд
+	replayWindowSize = 1024
+)
+
+var (
+	ErrShort     = errors.New("secure: пакет короче заголовка")
+	ErrReplay    = errors.New("secure: повтор или слишком старый пакет")
+	ErrAuth      = errors.New("secure: пакет не прошел проверку подлинности")
+	ErrNoSession = errors.New("secure: нет сессии с этим адресом")
+	ErrHandshake = errors.New("secure: некорректное рукопожатие")
+	ErrTimeout   = errors.New("secure: сервер не ответил на рукопожатие")
+)
+
+// Overhead - сколько байт шифрование добавляет к датаграмме
+const Overhead = dataHeaderSize + chacha20poly1305.Overhead
+
+// channel - ключи и счетчики одного канала (управляющего или голосового)
+// в обе стороны
+type channel struct {
+	send        cipher.AEAD
+	sendCounter atomic.Uint64
+	remoteIndex uint32
+
+	recv   cipher.AEAD
+	mu     sync.Mutex
+	replay replayWindow
+}
+
+func newChannel(sendKey, recvKey []byte, remoteIndex uint32) *channel {
+	send, _ := chacha20poly1305.New(sendKey) // Ошибка возможна только при неверной длине ключа
+	recv, _ := chacha20poly1305.New(recvKey)
+	return &channel{send: send, recv: recv, remoteIndex: remoteIndex}
+}
+
+func nonce(counter uint64) []byte {
+	var n [chacha20poly1305.NonceSize]byte
+	binary.BigEndian.PutUint64(n[4:], counter)
+	return n[:]
+}
+
+// seal дописывает к dst зашифрованный пакет данных
+func (c *channel) seal(dst, plaintext []byte) []byte {
+	counter := c.sendCounter.Add(1) - 1
+
+	start := len(dst)
+	dst = append(dst, kindData)
+	dst = binary.BigEndian.AppendUint32(dst, c.remoteIndex)
+	dst = binary.BigEndian.AppendUint64(dst, counter)
+	return c.send.Seal(dst, nonce(counter), plaintext, dst[start:])
+}
+
+// open проверяет и расшифровывает пакет данных, дописывая открытый текст
+// к dst. Каждый счетчик принимается один раз.
+func (c *channel) open(dst, packet []byte) ([]byte, error) {
+	if len(packet) < dataHeaderSize+c.recv.Overhead() || packet[0] != kindData {
+		return nil, ErrShort
+	}
+	counter := binary.BigEndian.Uint64(packet[5:dataHeaderSize])
+
+	c.mu.Lock()
+	fresh := c.replay.check(counter)
+	c.mu.Unlock()
+	if !fresh {
+		return nil, ErrReplay
+	}
+
+	plaintext, err := c.recv.Open(dst, nonce(counter), packet[dataHeaderSize:], packet[:dataHeaderSize])
+	if err != nil {
+		return nil, ErrAuth
+	}
+
+	// Отмечаем только подлинные пакеты, иначе подделка сдвинула бы окно
+	c.mu.Lock()
+	fresh = c.replay.update(counter)
+	c.mu.Unlock()
+	if !fresh {
+		return nil, ErrReplay
+	}
+	return plaintext, nil
+}
+
+// replayWindow помнит, какие счетчики из последних replayWindowSize уже
+// приходили. Бит счетчика n хранится в позиции n % replayWindowSize.
+type replayWindow struct {
+	started bool
+	top     uint64 // Самый новый принятый счетчик
+	bits    [replayWindowSize / 64]uint64
+}
+
+func (w *replayWindow) check(n uint64) bool {
+	if !w.started || n > w.top {
+		return true
+	}
+	if w.top-n >= replayWindowSize {
+		return false
+	}
+	i := n % replayWindowSize
+	return w.bits[i/64]&(1<<(i%64)) == 0
+}
+
+func (w *replayWindow) update(n uint64) bool {
+	if !w.check(n) {
+		return false
+	}
+
+	switch {
+	case !w.started:
+		w.started = true
+		w.top = n
+	case n > w.top:
+		// Позиции счетчиков между старым и новым верхом освобождаются:
+		// они хранили счетчики, вышедшие из окна
+		if n-w.top >= replayWindowSize {
+			clear(w.bits[:])
+		} else {
+			for m := w.top + 1; m < n; m++ {
+				i := m % replayWindowSize
+				w.bits[i/64] &^= 1 << (i % 64)
+			}
+		}
+		w.top = n
+	}
+
+	i := n % replayWindowSize
+	w.bits[i/64] |= 1 << (i % 64)
+	return true
+}
+
+// Session - ключи, выведенные из одного рукопожатия
+type Session struct {
+	localIndex uint32
+	control    *channel
+	voice      *channel
+	lastSeen   atomic.Int64 // Время последнего подлинного пакета, UnixNano
+}
+
+// deriveSession выводит ключи из общего секрета X25519 и хеша рукопожатия
+func deriveSession(shared, transcript []byte, client bool, localIndex, remoteIndex uint32) *Session {
+	kdf := hkdf.New(sha256.New, shared, transcript, []byte("airchat secure v1"))
+	keys := make([][]byte, 4)
+	for i := range keys {
+		keys[i] = make([]byte, chacha20poly1305.KeySize)
+		io.ReadFull(kdf, keys[i])
+	}
+	controlC2S, controlS2C, voiceC2S, voiceS2C := keys[0], keys[1], keys[2], keys[3]
+
+	s := &Session{localIndex: localIndex}
+	if client {
+		s.control = newChannel(controlC2S, controlS2C, remoteIndex)
+		s.voice = newChannel(voiceC2S, voiceS2C, remoteIndex)
+	} else {
+		s.control = newChannel(controlS2C, controlC2S, remoteIndex)
+		s.voice = newChannel(voiceS2C, voiceC2S, remoteIndex)
+	}
+	s.touch()
+	return s
+}
+
+func (s *Session) touch() {
+	s.lastSeen.Store(time.Now().UnixNano())
+}
+
+// dataIndex возвращает индекс получателя из пакета данных
+func dataIndex(packet []byte) (uint32, bool) {
+	if len(packet) < dataHeaderSize || packet[0] != kindData {
+		return 0, false
+	}
+	return binary.BigEndian.Uint32(packet[1:5]), true
+}
+
+// Fingerprint - отпечаток открытого ключа для сверки людьми: первые
+// 16 байт SHA-256 группами по 2 байта
+func Fingerprint(publicKey []byte) string {
+	sum := sha256.Sum256(publicKey)
+	groups := make([]string, 8)
+	for i := range groups {
+		groups[i] = hex.EncodeToString(sum[2*i : 2*i+2])
+	}
+	return strings.Join(groups, ":")
+}
@@ -0,0 +1,292 @@
+package secure
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// recordingConn запоминает последнюю отправленную датаграмму, чтобы тест мог
+// повторить ее как атакующий
+type recordingConn struct {
+	net.PacketConn
+	last []byte
+}
+
+func (c *recordingConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	c.last = bytes.Clone(p)
+	return c.PacketConn.WriteTo(p, addr)
+}
+
+func listen(t *testing.T) net.PacketConn {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	return pc
+}
+
+func newIdentity(t *testing.T) ed25519.PrivateKey {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// serve читает управляющий канал сервера и отправляет прочитанное в out
+func serve(conn net.PacketConn, out chan<- []byte) {
+	buf := make([]byte, 2048)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			close(out)
+			return
+		}
+		out <- bytes.Clone(buf[:n])
+		conn.WriteTo([]byte("pong"), addr)
+	}
+}
+
+func TestHandshakeAndReplay(t *testing.T) {
+	identity := newIdentity(t)
+	server := NewServer(identity)
+	control := server.Control(listen(t))
+	received := make(chan []byte, 4)
+	go serve(control, received)
+
+	raw := &recordingConn{PacketConn: listen(t)}
+	var seenKey ed25519.PublicKey
+	client, err := Dial(raw, control.LocalAddr(), func(key ed25519.PublicKey) error {
+		seenKey = key
+		return nil
+	}, 2*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !seenKey.Equal(identity.Public()) || !client.ServerKey().Equal(identity.Public()) {
+		t.Fatal("клиент не увидел ключ сервера")
+	}
+
+	if _, err := client.WriteTo([]byte("ping"), control.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-received; string(got) != "ping" {
+		t.Fatalf("сервер получил %q", got)
+	}
+	sealed := raw.last
+	if bytes.Contains(sealed, []byte("ping")) {
+		t.Error("датаграмма содержит открытый текст")
+	}
+
+	client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 2048)
+	n, _, err := client.ReadFrom(buf)
+	if err != nil || string(buf[:n]) != "pong" {
+		t.Fatalf("клиент получил %q, %v", buf[:n], err)
+	}
+
+	// Повтор перехваченного пакета и подделка отбрасываются молча
+	raw.PacketConn.WriteTo(sealed, control.LocalAddr())
+	tampered := bytes.Clone(sealed)
+	tampered[len(tampered)-1] ^= 1
+	raw.PacketConn.WriteTo(tampered, control.LocalAddr())
+
+	client.WriteTo([]byte("после повтора"), control.LocalAddr())
+	if got := <-received; string(got) != "после повтора" {
+		t.Errorf("после повтора сервер получил %q", got)
+	}
+}
+
+func TestVoice(t *testing.T) {
+	server := NewServer(newIdentity(t))
+	control := server.Control(listen(t))
+	go serve(control, make(chan []byte, 16))
+	voice := server.Voice(listen(t))
+
+	client, err := Dial(listen(t), control.LocalAddr(), nil, 2*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	udp, err := net.DialUDP("udp", nil, voice.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udp.Close()
+	clientVoice := client.Voice(udp)
+
+	// До первого подлинного пакета сервер не знает, куда слать голос
+	if _, err := voice.WriteTo([]byte("mix"), udp.LocalAddr()); !errors.Is(err, ErrNoSession) {
+		t.Errorf("отправка без привязки адреса: %v", err)
+	}
+
+	clientVoice.Write([]byte("hello"))
+	voice.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 2048)
+	n, addr, err := voice.ReadFrom(buf)
+	if err != nil || string(buf[:n]) != "hello" {
+		t.Fatalf("сервер получил %q, %v", buf[:n], err)
+	}
+	if session, ok := addr.(SessionAddr); !ok || session.Control != client.LocalAddr().String() {
+		t.Errorf("голос приписан сессии %#v, ожидалась сессия %s", addr, client.LocalAddr())
+	}
+
+	if _, err := voice.WriteTo([]byte("mix"), addr); err != nil {
+		t.Fatal(err)
+	}
+	clientVoice.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, err = clientVoice.Read(buf)
+	if err != nil || string(buf[:n]) != "mix" {
+		t.Errorf("клиент получил %q, %v", buf[:n], err)
+	}
+}
+
+func TestDialRejectsServerKey(t *testing.T) {
+	server := NewServer(newIdentity(t))
+	control := server.Control(listen(t))
+	go serve(control, make(chan []byte, 1))
+
+	errPinned := errors.New("ключ не совпал")
+	_, err := Dial(listen(t), control.LocalAddr(), func(ed25519.PublicKey) error { return errPinned }, 2*time.Second)
+	if !errors.Is(err, errPinned) {
+		t.Errorf("Dial вернул %v", err)
+	}
+}
+
+func TestReplayWindow(t *testing.T) {
+	var w replayWindow
+	steps := []struct {
+		n    uint64
+		want bool
+	}{
+		{5, true},
+		{5, false}, // повтор
+		{3, true},  // опоздавший, но в окне
+		{3, false},
+		{5 + replayWindowSize, true},
+		{5, false}, // вышел из окна
+		{6, true},  // на границе окна
+		{10 + 3*replayWindowSize, true},
+		{6 + replayWindowSize, false},
+	}
+	for i, s := range steps {
+		if got := w.update(s.n); got != s.want {
+			t.Errorf("шаг %d: update(%d) = %v, ожидалось %v", i, s.n, got, s.want)
+		}
+	}
+}
+
+func TestLoadOrCreateIdentity(t *testing.T) {
+	path := t.TempDir() + "/identity.key"
+	created, err := LoadOrCreateIdentity(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadOrCreateIdentity(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !created.Equal(loaded) {
+		t.Error("ключ изменился после повторной загрузки")
+	}
+	if fp := Fingerprint(loaded.Public().(ed25519.PublicKey)); len(fp) != 39 {
+		t.Errorf("отпечаток %q", fp)
+	}
+}
+
+// spoofedHello - ClientHello, который атакующий может отправить от
+// чужого адреса
+func spoofedHello(t *testing.T) []byte {
+	t.Helper()
+	ephemeral, err := newEphemeral()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return clientHello{index: randomIndex(), ephemeral: ephemeral.PublicKey().Bytes()}.marshal()
+}
+
+func TestSpoofedHelloKeepsSession(t *testing.T) {
+	server := NewServer(newIdentity(t))
+	control := server.Control(listen(t))
+	received := make(chan []byte, 4)
+	go serve(control, received)
+
+	raw := &recordingConn{PacketConn: listen(t)}
+	client, err := Dial(raw, control.LocalAddr(), nil, 2*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.WriteTo([]byte("ping"), control.LocalAddr())
+	<-received
+
+	// Новое рукопожатие с адреса клиента без подлинного пакета не
+	// заменяет его сессию
+	raw.PacketConn.WriteTo(spoofedHello(t), control.LocalAddr())
+	client.WriteTo([]byte("после чужого рукопожатия"), control.LocalAddr())
+	if got := <-received; string(got) != "после чужого рукопожатия" {
+		t.Fatalf("сервер получил %q", got)
+	}
+	client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 2048)
+	for i := 0; i < 2; i++ {
+		if n, _, err := client.ReadFrom(buf); err != nil || string(buf[:n]) != "pong" {
+			t.Fatalf("клиент получил %q, %v", buf[:n], err)
+		}
+	}
+
+	// Переподключение с того же адреса заменяет сессию после первого
+	// подлинного пакета
+	again, err := Dial(raw.PacketConn, control.LocalAddr(), nil, 2*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again.WriteTo([]byte("снова"), control.LocalAddr())
+	if got := <-received; string(got) != "снова" {
+		t.Fatalf("сервер получил %q", got)
+	}
+	server.mu.Lock()
+	sessions, pending := len(server.sessions), len(server.pending)
+	server.mu.Unlock()
+	if sessions != 1 || pending != 0 {
+		t.Errorf("сессий %d, незавершенных %d, ожидалась одна установленная", sessions, pending)
+	}
+}
+
+func TestHelloFlood(t *testing.T) {
+	server := NewServer(newIdentity(t))
+	for i := 0; i < 2*maxPendingSessions; i++ {
+		addr := &net.UDPAddr{IP: net.IPv4(10, byte(i>>16), byte(i>>8), byte(i)), Port: 6000}
+		if server.handshake(addr, spoofedHello(t)) == nil {
+			t.Fatalf("рукопожатие %d отклонено", i)
+		}
+	}
+	if n := len(server.pending); n != maxPendingSessions {
+		t.Errorf("незавершенных сессий %d, ожидалось не больше %d", n, maxPendingSessions)
+	}
+	if n := len(server.sessions); n != maxPendingSessions {
+		t.Errorf("сессий %d", n)
+	}
+
+	// Незавершенные рукопожатия быстро истекают
+	for _, session := range server.pending {
+		session.lastSeen.Store(time.Now().Add(-pendingTimeout - time.Second).UnixNano())
+	}
+	server.handshake(&net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 6000}, spoofedHello(t))
+	if n := len(server.sessions); n != 1 {
+		t.Errorf("после истечения осталось %d сессий", n)
+	}
+
+	// Настоящий клиент подключается и во время потока рукопожатий
+	control := server.Control(listen(t))
+	go serve(control, make(chan []byte, 1))
+	if _, err := Dial(listen(t), control.LocalAddr(), nil, 2*time.Second); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,335 @@
+package secure
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ClientHello ничем не подписан, и его адрес отправителя можно подделать.
+// Поэтому сессия после рукопожатия считается незавершенной, пока с ее
+// ключом не придет подлинный пакет данных: такие сессии живут недолго,
+// их число ограничено отдельно, и они не заменяют установленную сессию с
+// того же адреса.
+const (
+	// Установленная сессия без подлинных пакетов дольше этого забывается
+	// при следующем рукопожатии
+	sessionIdleTimeout = time.Hour
+
+	// Сколько ждем первого подлинного пакета после рукопожатия. Клиент
+	// отправляет его сразу после ServerHello.
+	pendingTimeout = 5 * time.Second
+
+	// Ограничения на число сессий, чтобы поток ClientHello не съел память
+	// и не вытеснил настоящих клиентов
+	maxSessions        = 4096
+	maxPendingSessions = 1024
+)
+
+// serverSession - сессия на стороне сервера и адреса, с которых она
+// пришла
+type serverSession struct {
+	*Session
+	controlAddr string
+	voiceAddr   string
+	hello       clientHello // Для повторной отправки ответа
+	reply       []byte
+	confirmed   atomic.Bool // Пришел подлинный пакет, сессия установлена
+}
+
+// Server хранит сессии всех клиентов. Управляющий и голосовой сокеты
+// оборачиваются отдельно (Control и Voice), но сессии у них общие.
+type Server struct {
+	identity ed25519.PrivateKey
+
+	mu        sync.Mutex
+	sessions  map[uint32]*serverSession // По индексу сервера
+	byControl map[string]*serverSession // Установленные, по адресу управляющего канала
+	byVoice   map[string]*serverSession // По адресу голосового сокета
+	pending   map[string]*serverSession // Незавершенные, по адресу управляющего канала
+}
+
+func NewServer(identity ed25519.PrivateKey) *Server {
+	return &Server{
+		identity:  identity,
+		sessions:  make(map[uint32]*serverSession),
+		byControl: make(map[string]*serverSession),
+		byVoice:   make(map[string]*serverSession),
+		pending:   make(map[string]*serverSession),
+	}
+}
+
+// PublicKey возвращает долговременный ключ сервера
+func (s *Server) PublicKey() ed25519.PublicKey {
+	return s.identity.Public().(ed25519.PublicKey)
+}
+
+// Control оборачивает сокет управляющего канала: рукопожатия
+// обрабатываются внутри ReadFrom, наружу выходят только расшифрованные
+// данные
+func (s *Server) Control(pc net.PacketConn) *ServerConn {
+	return &ServerConn{PacketConn: pc, server: s, buf: make([]byte, 64*1024)}
+}
+
+// Voice оборачивает голосовой сокет. Адрес, с которого пришел подлинный
+// голосовой пакет сессии, запоминается для ответов. ReadFrom голосового
+// сокета возвращает SessionAddr.
+func (s *Server) Voice(pc net.PacketConn) *ServerConn {
+	return &ServerConn{PacketConn: pc, server: s, voice: true, buf: make([]byte, 64*1024)}
+}
+
+// Forget удаляет сессию клиента с адресом управляющего канала addr
+func (s *Server) Forget(addr net.Addr) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if session, ok := s.byControl[addr.String()]; ok {
+		s.removeLocked(session)
+	}
+}
+
+func (s *Server) removeLocked(session *serverSession) {
+	delete(s.sessions, session.localIndex)
+	if s.byControl[session.controlAddr] == session {
+		delete(s.byControl, session.controlAddr)
+	}
+	if s.byVoice[session.voiceAddr] == session {
+		delete(s.byVoice, session.voiceAddr)
+	}
+	if s.pending[session.controlAddr] == session {
+		delete(s.pending, session.controlAddr)
+	}
+}
+
+// handshake отвечает на ClientHello и создает сессию. nil - отвечать не
+// нужно.
+func (s *Server) handshake(addr net.Addr, packet []byte) []byte {
+	hello, err := parseClientHello(packet)
+	if err != nil {
+		return nil
+	}
+	key := addr.String()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Повтор ClientHello: наш ответ потерялся, отправляем тот же
+	for _, old := range []*serverSession{s.pending[key], s.byControl[key]} {
+		if old != nil && old.hello.index == hello.index && bytes.Equal(old.hello.ephemeral, hello.ephemeral) {
+			return old.reply
+		}
+	}
+
+	// Установленная сессия с этого адреса остается, пока новая не
+	// подтвердит себя подлинным пакетом. Незавершенную заменяем.
+	s.expireLocked()
+	if old, ok := s.pending[key]; ok {
+		s.removeLocked(old)
+	}
+	if len(s.pending) >= maxPendingSessions {
+		s.removeLocked(s.oldestPendingLocked())
+	}
+	if len(s.sessions) >= maxSessions {
+		return nil
+	}
+
+	ephemeral, err := newEphemeral()
+	if err != nil {
+		return nil
+	}
+	shared, err := sharedSecret(ephemeral, hello.ephemeral)
+	if err != nil {
+		return nil
+	}
+
+	index := randomIndex()
+	for s.sessions[index] != nil {
+		index = randomIndex()
+	}
+
+	reply := serverHello{
+		clientIndex: hello.index,
+		serverIndex: index,
+		ephemeral:   ephemeral.PublicKey().Bytes(),
+		identity:    s.PublicKey(),
+	}
+	th := transcript(hello, reply)
+	reply.signature = ed25519.Sign(s.identity, signedMessage(th))
+
+	session := &serverSession{
+		Session:     deriveSession(shared, th, false, index, hello.index),
+		controlAddr: key,
+		hello:       clientHello{index: hello.index, ephemeral: bytes.Clone(hello.ephemeral)},
+		reply:       reply.marshal(),
+	}
+	s.sessions[index] = session
+	s.pending[key] = session
+	return session.reply
+}
+
+// confirm отмечает сессию установленной после первого подлинного пакета
+// и заменяет ею прежнюю сессию с того же адреса. false - сессия уже
+// удалена.
+func (s *Server) confirm(session *serverSession) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.sessions[session.localIndex] != session {
+		return false
+	}
+	if session.confirmed.Load() {
+		return true
+	}
+	if old, ok := s.byControl[session.controlAddr]; ok {
+		s.removeLocked(old)
+	}
+	delete(s.pending, session.controlAddr)
+	s.byControl[session.controlAddr] = session
+	session.confirmed.Store(true)
+	return true
+}
+
+// expireLocked удаляет сессии, от которых давно не было пакетов, и
+// незавершенные рукопожатия старше pendingTimeout
+func (s *Server) expireLocked() {
+	now := time.Now()
+	idle := now.Add(-sessionIdleTimeout).UnixNano()
+	unconfirmed := now.Add(-pendingTimeout).UnixNano()
+	for _, session := range s.sessions {
+		deadline := idle
+		if !session.confirmed.Load() {
+			deadline = unconfirmed
+		}
+		if session.lastSeen.Load() < deadline {
+			s.removeLocked(session)
+		}
+	}
+}
+
+// oldestPendingLocked возвращает самое старое незавершенное рукопожатие
+func (s *Server) oldestPendingLocked() *serverSession {
+	var oldest *serverSession
+	for _, session := range s.pending {
+		if oldest == nil || session.lastSeen.Load() < oldest.lastSeen.Load() {
+			oldest = session
+		}
+	}
+	return oldest
+}
+
+// SessionAddr - адрес отправителя голосового пакета и адрес управляющего
+// канала сессии, ключом которой пакет подтвержден. По нему голос
+// приписывается участнику, а не по совпадению адресов.
+type SessionAddr struct {
+	net.Addr
+	Control string
+}
+
+// ServerConn - сокет сервера, который шифрует и расшифровывает данные
+// сессий. Реализует net.PacketConn.
+type ServerConn struct {
+	net.PacketConn
+	server *Server
+	voice  bool
+
+	readMu sync.Mutex
+	buf    []byte
+}
+
+func (c *ServerConn) channel(session *serverSession) *channel {
+	if c.voice {
+		return session.voice
+	}
+	return session.control
+}
+
+// ReadFrom возвращает следующую подлинную датаграмму. Рукопожатия,
+// повторы и подделки обрабатываются и отбрасываются внутри.
+func (c *ServerConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(c.buf)
+		if err != nil {
+			return 0, nil, err
+		}
+		packet := c.buf[:n]
+
+		if !c.voice && n > 0 && packet[0] == kindClientHello {
+			if reply := c.server.handshake(addr, packet); reply != nil {
+				c.PacketConn.WriteTo(reply, addr)
+			}
+			continue
+		}
+
+		index, ok := dataIndex(packet)
+		if !ok {
+			continue
+		}
+		c.server.mu.Lock()
+		session := c.server.sessions[index]
+		c.server.mu.Unlock()
+
+		// Управляющий канал сессии привязан к адресу рукопожатия
+		if session == nil || !c.voice && session.controlAddr != addr.String() {
+			continue
+		}
+
+		plaintext, err := c.channel(session).open(b[:0], packet)
+		if err != nil {
+			continue
+		}
+		if !session.confirmed.Load() && !c.server.confirm(session) {
+			continue
+		}
+		session.touch()
+
+		if c.voice {
+			c.bindVoice(session, addr.String())
+			return copy(b, plaintext), SessionAddr{Addr: addr, Control: session.controlAddr}, nil
+		}
+		return copy(b, plaintext), addr, nil
+	}
+}
+
+// bindVoice запоминает голосовой адрес сессии. Смена адреса (например,
+// после смены порта в NAT) подтверждена подлинным пакетом.
+func (c *ServerConn) bindVoice(session *serverSession, addr string) {
+	c.server.mu.Lock()
+	defer c.server.mu.Unlock()
+	if session.voiceAddr == addr {
+		return
+	}
+	if c.server.byVoice[session.voiceAddr] == session {
+		delete(c.server.byVoice, session.voiceAddr)
+	}
+	session.voiceAddr = addr
+	c.server.byVoice[addr] = session
+}
+
+// WriteTo шифрует p ключом сессии получателя
+func (c *ServerConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	if session, ok := addr.(SessionAddr); ok {
+		addr = session.Addr
+	}
+	c.server.mu.Lock()
+	var session *serverSession
+	if c.voice {
+		session = c.server.byVoice[addr.String()]
+	} else {
+		session = c.server.byControl[addr.String()]
+	}
+	c.server.mu.Unlock()
+	if session == nil {
+		return 0, ErrNoSession
+	}
+
+	packet := c.channel(session).seal(make([]byte, 0, len(p)+Overhead), p)
+	if _, err := c.PacketConn.WriteTo(packet, addr); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
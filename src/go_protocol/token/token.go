@@ -0,0 +1,84 @@
+// Package token проверяет сессионные токены, которые выдает Electron после
+// входа по паролю. Токен имеет вид
+//
+//	base64url(JSON {"sub": имя, "exp": unix-время}) "." base64url(подпись Ed25519)
+//
+// Подпись считается от первой части токена закрытым ключом, который есть
+// только у стороны, проверяющей пароли. Серверу нужен лишь открытый ключ
+// (переменная окружения AIRCHAT_AUTH_PUBLIC_KEY), поэтому ни сервер, ни
+// клиенты, которые к нему подключаются, выпустить токен не могут.
+package token
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+var (
+	ErrMalformed = errors.New("token: некорректный формат токена")
+	ErrSignature = errors.New("token: неверная подпись токена")
+	ErrExpired   = errors.New("token: срок действия токена истек")
+	ErrSubject   = errors.New("token: токен выпущен для другого пользователя")
+	ErrKey       = errors.New("token: ключ должен быть открытым ключом Ed25519 в base64")
+)
+
+type claims struct {
+	Subject string `json:"sub"`
+	Expires int64  `json:"exp"`
+}
+
+// ParsePublicKey разбирает открытый ключ Ed25519 в base64 или base64url,
+// с дополнением или без, например поле "x" ключа в формате JWK
+func ParsePublicKey(s string) (ed25519.PublicKey, error) {
+	s = strings.NewReplacer("+", "-", "/", "_").Replace(strings.TrimRight(strings.TrimSpace(s), "="))
+	key, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return nil, ErrKey
+	}
+	return ed25519.PublicKey(key), nil
+}
+
+// Sign выпускает токен для username, действующий до expires
+func Sign(key ed25519.PrivateKey, username string, expires time.Time) (string, error) {
+	body, err := json.Marshal(claims{Subject: username, Expires: expires.Unix()})
+	if err != nil {
+		return "", err
+	}
+	payload := base64.RawURLEncoding.EncodeToString(body)
+	signature := ed25519.Sign(key, []byte(payload))
+	return payload + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// Verify проверяет подпись и срок действия токена и что он выпущен для
+// username
+func Verify(key ed25519.PublicKey, token, username string, now time.Time) error {
+	payload, encoded, ok := strings.Cut(token, ".")
+	if !ok || payload == "" || encoded == "" {
+		return ErrMalformed
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil || len(key) != ed25519.PublicKeySize || !ed25519.Verify(key, []byte(payload), signature) {
+		return ErrSignature
+	}
+
+	body, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return ErrMalformed
+	}
+	var c claims
+	if err := json.Unmarshal(body, &c); err != nil || c.Subject == "" {
+		return ErrMalformed
+	}
+	if now.Unix() >= c.Expires {
+		return ErrExpired
+	}
+	if c.Subject != username {
+		return ErrSubject
+	}
+	return nil
+}
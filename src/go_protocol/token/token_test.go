@@ -0,0 +1,89 @@
+package token
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newKey(t *testing.T) (ed25519.PublicKey, ed25519.PrivateKey) {
+	t.Helper()
+	public, private, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return public, private
+}
+
+func TestVerify(t *testing.T) {
+	public, private := newKey(t)
+	other, _ := newKey(t)
+	now := time.Unix(1700000000, 0)
+
+	valid, err := Sign(private, "alice", now.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired, _ := Sign(private, "alice", now.Add(-time.Second))
+	payload, signature, _ := strings.Cut(valid, ".")
+
+	signed := func(payload string) string {
+		return payload + "." + base64.RawURLEncoding.EncodeToString(ed25519.Sign(private, []byte(payload)))
+	}
+	// Чужая первая часть с подписью от настоящей
+	forged := base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"mallory","exp":9999999999}`)) + "." + signature
+	// Подписанная, но не JSON
+	garbage := signed("bm90IGpzb24")
+	// Подписанная, но без имени
+	anonymous := signed(base64.RawURLEncoding.EncodeToString([]byte(`{"exp":9999999999}`)))
+
+	tests := []struct {
+		name     string
+		key      ed25519.PublicKey
+		token    string
+		username string
+		want     error
+	}{
+		{"действительный", public, valid, "alice", nil},
+		{"другой пользователь", public, valid, "bob", ErrSubject},
+		{"чужой ключ", other, valid, "alice", ErrSignature},
+		{"без ключа", nil, valid, "alice", ErrSignature},
+		{"испорченная подпись", public, payload + "." + signature[1:] + "A", "alice", ErrSignature},
+		{"подмененное имя", public, forged, "mallory", ErrSignature},
+		{"истек", public, expired, "alice", ErrExpired},
+		{"пустой", public, "", "alice", ErrMalformed},
+		{"без подписи", public, payload, "alice", ErrMalformed},
+		{"пустая подпись", public, payload + ".", "alice", ErrMalformed},
+		{"обрезан", public, payload[:len(payload)/2], "alice", ErrMalformed},
+		{"обрезана подпись", public, valid[:len(valid)-4], "alice", ErrSignature},
+		{"не JSON", public, garbage, "alice", ErrMalformed},
+		{"без имени", public, anonymous, "alice", ErrMalformed},
+	}
+	for _, tt := range tests {
+		if err := Verify(tt.key, tt.token, tt.username, now); err != tt.want {
+			t.Errorf("%s: %v, ожидалось %v", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestParsePublicKey(t *testing.T) {
+	public, _ := newKey(t)
+	for _, encoded := range []string{
+		base64.StdEncoding.EncodeToString(public),
+		base64.RawURLEncoding.EncodeToString(public),
+		" " + base64.URLEncoding.EncodeToString(public) + "\n",
+	} {
+		key, err := ParsePublicKey(encoded)
+		if err != nil || !key.Equal(public) {
+			t.Errorf("%q: %v", encoded, err)
+		}
+	}
+	for _, encoded := range []string{"", "не base64", base64.StdEncoding.EncodeToString(public[:16])} {
+		if _, err := ParsePublicKey(encoded); !errors.Is(err, ErrKey) {
+			t.Errorf("%q: %v, ожидалось ErrKey", encoded, err)
+		}
+	}
+}
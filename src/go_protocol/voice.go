@@ -0,0 +1,148 @@
+package protocol
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+)
+
+// Голосовые датаграммы на :6001 начинаются с заголовка в духе RTP:
+//
+//	+--------+------+-------------+-----------------+----------------+
+//	| версия | вид  | номер (u16) | метка времени   | поток (u32)    |
+//	| 1 байт | 1 б. | big-endian  | (u32), 48 кГц   | big-endian     |
+//	+--------+------+-------------+-----------------+----------------+
+//
+// За заголовком аудиопакета идут байты Opus, у heartbeat нагрузки нет,
+// у VoiceHello нагрузка - токен голосовой сессии из JoinResult.
+
+// VoiceVersion - текущая версия заголовка голосовых пакетов
+const VoiceVersion byte = 1
+
+// VoiceHeaderSize - размер заголовка голосового пакета в байтах
+const VoiceHeaderSize = 12
+
+// VoiceClockRate - частота меток времени голосовых пакетов
+const VoiceClockRate = 48000
+
+// VoiceTokenSize - размер токена голосовой сессии
+const VoiceTokenSize = 16
+
+// MixStreamID - поток микса, который сервер отправляет слушателю.
+// Клиенты выбирают себе ненулевые идентификаторы.
+const MixStreamID uint32 = 0
+
+// VoiceKind - вид голосового пакета
+type VoiceKind byte
+
+const (
+	VoiceAudio     VoiceKind = 1 // Кадр Opus
+	VoiceHeartbeat VoiceKind = 2 // Поддержание NAT и активности, без нагрузки
+	VoiceHello     VoiceKind = 3 // Привязка адреса к сессии: нагрузка - токен голосовой сессии
+)
+
+var (
+	ErrVoiceShort   = errors.New("protocol: голосовой пакет короче заголовка")
+	ErrVoiceVersion = errors.New("protocol: неподдерживаемая версия голосового пакета")
+	ErrVoiceKind    = errors.New("protocol: неизвестный вид голосового пакета")
+)
+
+// VoiceHeader - заголовок голосового пакета
+type VoiceHeader struct {
+	Kind      VoiceKind
+	Seq       uint16 // Растет на 1 с каждым аудиопакетом потока
+	Timestamp uint32 // Номер первого сэмпла кадра при VoiceClockRate
+	StreamID  uint32
+}
+
+// AppendVoicePacket дописывает к dst заголовок h и нагрузку
+func AppendVoicePacket(dst []byte, h VoiceHeader, payload []byte) []byte {
+	dst = append(dst, VoiceVersion, byte(h.Kind))
+	dst = binary.BigEndian.AppendUint16(dst, h.Seq)
+	dst = binary.BigEndian.AppendUint32(dst, h.Timestamp)
+	dst = binary.BigEndian.AppendUint32(dst, h.StreamID)
+	return append(dst, payload...)
+}
+
+// ParseVoicePacket разбирает голосовой пакет. Нагрузка ссылается на
+// packet и не копируется.
+func ParseVoicePacket(packet []byte) (VoiceHeader, []byte, error) {
+	if len(packet) < VoiceHeaderSize {
+		return VoiceHeader{}, nil, ErrVoiceShort
+	}
+	if packet[0] != VoiceVersion {
+		return VoiceHeader{}, nil, ErrVoiceVersion
+	}
+
+	h := VoiceHeader{
+		Kind:      VoiceKind(packet[1]),
+		Seq:       binary.BigEndian.Uint16(packet[2:4]),
+		Timestamp: binary.BigEndian.Uint32(packet[4:8]),
+		StreamID:  binary.BigEndian.Uint32(packet[8:12]),
+	}
+	if h.Kind != VoiceAudio && h.Kind != VoiceHeartbeat && h.Kind != VoiceHello {
+		return VoiceHeader{}, nil, ErrVoiceKind
+	}
+	return h, packet[VoiceHeaderSize:], nil
+}
+
+// SeqDiff возвращает расстояние от b до a с учетом переполнения номера:
+// положительное, если a новее b
+func SeqDiff(a, b uint16) int {
+	return int(int16(a - b))
+}
+
+// NewStreamID выбирает случайный ненулевой идентификатор потока
+func NewStreamID() uint32 {
+	var b [4]byte
+	for {
+		rand.Read(b[:])
+		if id := binary.BigEndian.Uint32(b[:]); id != MixStreamID {
+			return id
+		}
+	}
+}
+
+// VoiceStream нумерует исходящие пакеты одного потока. Номер и метка
+// времени начинаются со случайных значений, как в RTP. Не безопасен
+// для одновременного использования из нескольких горутин.
+type VoiceStream struct {
+	id        uint32
+	seq       uint16
+	timestamp uint32
+}
+
+func NewVoiceStream(id uint32) *VoiceStream {
+	var b [6]byte
+	rand.Read(b[:])
+	return &VoiceStream{
+		id:        id,
+		seq:       binary.BigEndian.Uint16(b[:2]),
+		timestamp: binary.BigEndian.Uint32(b[2:]),
+	}
+}
+
+// ID возвращает идентификатор потока
+func (s *VoiceStream) ID() uint32 {
+	return s.id
+}
+
+// Next возвращает заголовок следующего аудиопакета из samples сэмплов
+func (s *VoiceStream) Next(samples int) VoiceHeader {
+	h := VoiceHeader{Kind: VoiceAudio, Seq: s.seq, Timestamp: s.timestamp, StreamID: s.id}
+	s.seq++
+	s.timestamp += uint32(samples)
+	return h
+}
+
+// Heartbeat возвращает заголовок heartbeat этого потока. Номер и метку
+// времени heartbeat не занимает.
+func (s *VoiceStream) Heartbeat() VoiceHeader {
+	return VoiceHeader{Kind: VoiceHeartbeat, StreamID: s.id}
+}
+
+// Hello возвращает заголовок VoiceHello этого потока. Как и heartbeat,
+// не занимает номер и метку времени.
+func (s *VoiceStream) Hello() VoiceHeader {
+	return VoiceHeader{Kind: VoiceHello, StreamID: s.id}
+}
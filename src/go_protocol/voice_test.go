@@ -0,0 +1,94 @@
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestVoicePacketRoundTrip(t *testing.T) {
+	stream := NewVoiceStream(0x01020304)
+	opus := []byte{0xF8, 0xFF, 0xFE}
+
+	first := stream.Next(960)
+	second := stream.Next(960)
+	if second.Seq != first.Seq+1 || second.Timestamp != first.Timestamp+960 {
+		t.Fatalf("номер/метка не растут: %+v -> %+v", first, second)
+	}
+
+	packet := AppendVoicePacket(nil, second, opus)
+	if len(packet) != VoiceHeaderSize+len(opus) {
+		t.Fatalf("длина пакета %d", len(packet))
+	}
+
+	h, payload, err := ParseVoicePacket(packet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h != second || !bytes.Equal(payload, opus) {
+		t.Errorf("получено %+v %v, ожидалось %+v %v", h, payload, second, opus)
+	}
+
+	hb, payload, err := ParseVoicePacket(AppendVoicePacket(nil, stream.Heartbeat(), nil))
+	if err != nil || hb.Kind != VoiceHeartbeat || hb.StreamID != stream.ID() || len(payload) != 0 {
+		t.Errorf("heartbeat: %+v %v %v", hb, payload, err)
+	}
+
+	token := []byte("0123456789abcdef")
+	hello, payload, err := ParseVoicePacket(AppendVoicePacket(nil, stream.Hello(), token))
+	if err != nil || hello.Kind != VoiceHello || hello.StreamID != stream.ID() || !bytes.Equal(payload, token) {
+		t.Errorf("hello: %+v %v %v", hello, payload, err)
+	}
+}
+
+func TestParseVoicePacketErrors(t *testing.T) {
+	valid := AppendVoicePacket(nil, VoiceHeader{Kind: VoiceAudio, StreamID: 7}, []byte{1})
+
+	badVersion := bytes.Clone(valid)
+	badVersion[0] = VoiceVersion + 1
+
+	badKind := bytes.Clone(valid)
+	badKind[1] = 0
+
+	tests := []struct {
+		name   string
+		packet []byte
+		want   error
+	}{
+		{"старый heartbeat", []byte{0}, ErrVoiceShort},
+		{"короткий", valid[:VoiceHeaderSize-1], ErrVoiceShort},
+		{"версия", badVersion, ErrVoiceVersion},
+		{"вид", badKind, ErrVoiceKind},
+	}
+	for _, tt := range tests {
+		if _, _, err := ParseVoicePacket(tt.packet); !errors.Is(err, tt.want) {
+			t.Errorf("%s: получено %v, ожидалось %v", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestSeqDiff(t *testing.T) {
+	tests := []struct {
+		a, b uint16
+		want int
+	}{
+		{5, 3, 2},
+		{3, 5, -2},
+		{1, 0xFFFF, 2},
+		{0xFFFF, 1, -2},
+		{100, 100, 0},
+	}
+	for _, tt := range tests {
+		if got := SeqDiff(tt.a, tt.b); got != tt.want {
+			t.Errorf("SeqDiff(%d, %d) = %d, ожидалось %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestNewStreamIDNonZero(t *testing.T) {
+	for i := 0; i < 1000; i++ {
+		if NewStreamID() == MixStreamID {
+			t.Fatal("NewStreamID вернул идентификатор потока микса")
+		}
+	}
+}
@@ -0,0 +1,468 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/netip"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"airchat/protocol"
+	"airchat/protocol/reliable"
+)
+
+// Команды администратора принимаются на Unix-сокете config.AdminSocket:
+// по одному JSON-запросу adminRequest в строке, на каждый - ответ
+// adminResponse. Подкоманда "server admin" - клиент этого сокета.
+
+// adminTimeout ограничивает разговор CLI с сервером
+const adminTimeout = 10 * time.Second
+
+// adminRequest - команда администратора. Target - имя пользователя, для
+// ban и unban также IP-адрес. Text - причина или текст объявления.
+// RestartIn - для shutdown, через сколько сервер ожидается снова.
+type adminRequest struct {
+	Command   string        `json:"command"`
+	Target    string        `json:"target,omitempty"`
+	Text      string        `json:"text,omitempty"`
+	RestartIn time.Duration `json:"restart_in,omitempty"`
+}
+
+type adminResponse struct {
+	OK       bool          `json:"ok"`
+	Error    string        `json:"error,omitempty"`
+	Clients  []adminClient `json:"clients,omitempty"`
+	Bans     []adminBan    `json:"bans,omitempty"`
+	Affected int           `json:"affected,omitempty"` // Сколько клиентов затронула команда
+}
+
+type adminClient struct {
+	Username     string    `json:"username"`
+	Address      string    `json:"address"`
+	Room         string    `json:"room"`
+	Voice        bool      `json:"voice"`
+	VoiceAddress string    `json:"voice_address,omitempty"`
+	Muted        bool      `json:"muted"`
+	LastActivity time.Time `json:"last_activity"`
+}
+
+type adminBan struct {
+	Target string `json:"target"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// Блокировки по имени и по IP с причиной, защищены clientsMux. Живут до
+// перезапуска сервера.
+var (
+	bannedNames = make(map[string]string)
+	bannedIPs   = make(map[string]string)
+)
+
+// listenAdmin открывает сокет администратора. Файл, оставшийся от
+// прошлого запуска, удаляется; доступ к сокету - только у владельца.
+func listenAdmin(path string) (net.Listener, error) {
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0o600); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
+
+// serveAdmin принимает подключения к сокету администратора, пока он не
+// закрыт
+func serveAdmin(ln net.Listener, pc net.PacketConn) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Printf("❌ Сокет администратора: %v", err)
+			}
+			return
+		}
+		go handleAdminConn(conn, pc)
+	}
+}
+
+func handleAdminConn(conn net.Conn, pc net.PacketConn) {
+	defer conn.Close()
+	decoder := json.NewDecoder(conn)
+	encoder := json.NewEncoder(conn)
+	for {
+		var req adminRequest
+		if err := decoder.Decode(&req); err != nil {
+			if !errors.Is(err, io.EOF) {
+				encoder.Encode(adminResponse{Error: "некорректный запрос: " + err.Error()})
+			}
+			return
+		}
+		resp := handleAdminRequest(pc, req)
+		if err := encoder.Encode(resp); err != nil {
+			return
+		}
+		// Останавливаем сервер только после ответа, иначе CLI может его
+		// не дождаться
+		if req.Command == "shutdown" && resp.OK {
+			requestShutdown(shutdownRequest{reason: req.Text, restartIn: req.RestartIn})
+		}
+	}
+}
+
+func adminError(format string, args ...any) adminResponse {
+	return adminResponse{Error: fmt.Sprintf(format, args...)}
+}
+
+// handleAdminRequest выполняет команду администратора
+func handleAdminRequest(pc net.PacketConn, req adminRequest) adminResponse {
+	clientsMux.Lock()
+	defer clientsMux.Unlock()
+
+	switch req.Command {
+	case "list":
+		return adminResponse{OK: true, Clients: listClientsLocked(), Bans: listBansLocked()}
+
+	case "kick":
+		client := findClientLocked(req.Target)
+		if client == nil {
+			return adminError("пользователь %s не найден", req.Target)
+		}
+		log.Printf("👮 Администратор исключил %s (%s): %s", client.username, client.addr, req.Text)
+		disconnectClientLocked(pc, client, protocol.NoticeKicked, req.Text)
+		return adminResponse{OK: true, Affected: 1}
+
+	case "mute", "unmute":
+		client := findClientLocked(req.Target)
+		if client == nil {
+			return adminError("пользователь %s не найден", req.Target)
+		}
+		muted := req.Command == "mute"
+		if client.serverMuted == muted {
+			return adminResponse{OK: true}
+		}
+		client.serverMuted = muted
+		kind := protocol.NoticeUnmuted
+		if muted {
+			kind = protocol.NoticeMuted
+			// Уже накопленные кадры тоже не должны попасть в микс
+			if client.room != nil {
+				client.room.audioProcessor.RemoveClient(client.username)
+			}
+		} else {
+			// Номера пакетов за время заглушения не считаем потерями
+			client.voiceSeqStarted = false
+		}
+		sendMessage(pc, client.addr, &protocol.Notice{Kind: kind, Text: req.Text})
+		if muted {
+			log.Printf("👮 Администратор заглушил %s: %s", client.username, req.Text)
+		} else {
+			log.Printf("👮 Администратор вернул голос %s", client.username)
+		}
+		return adminResponse{OK: true, Affected: 1}
+
+	case "ban":
+		target := strings.TrimSpace(req.Target)
+		if ip, ok := normalizeIP(target); ok {
+			bannedIPs[ip] = req.Text
+		} else if validUsername(target) {
+			bannedNames[target] = req.Text
+		} else {
+			return adminError("%q - не имя пользователя и не IP-адрес", req.Target)
+		}
+
+		affected := 0
+		for _, client := range clients {
+			if bannedLocked(client.username, client.addr.String()) {
+				disconnectClientLocked(pc, client, protocol.NoticeBanned, req.Text)
+				affected++
+			}
+		}
+		log.Printf("👮 Администратор заблокировал %s: %s (исключено клиентов: %d)", target, req.Text, affected)
+		return adminResponse{OK: true, Affected: affected}
+
+	case "unban":
+		target := strings.TrimSpace(req.Target)
+		if ip, ok := normalizeIP(target); ok {
+			target = ip
+		}
+		_, name := bannedNames[target]
+		_, ip := bannedIPs[target]
+		if !name && !ip {
+			return adminError("%s не заблокирован", req.Target)
+		}
+		delete(bannedNames, target)
+		delete(bannedIPs, target)
+		log.Printf("👮 Администратор снял блокировку с %s", target)
+		return adminResponse{OK: true}
+
+	case "shutdown":
+		// Сама остановка - в handleAdminConn после ответа
+		if req.RestartIn < 0 {
+			return adminError("время перезапуска не может быть отрицательным")
+		}
+		if shuttingDown.Load() || len(shutdownRequests) > 0 {
+			return adminError("сервер уже завершает работу")
+		}
+		log.Printf("👮 Администратор останавливает сервер: %s (перезапуск через %s)", req.Text, req.RestartIn)
+		return adminResponse{OK: true, Affected: len(clients)}
+
+	case "broadcast":
+		if strings.TrimSpace(req.Text) == "" {
+			return adminError("пустое объявление")
+		}
+		for _, client := range clients {
+			sendMessage(pc, client.addr, &protocol.Notice{Kind: protocol.NoticeAnnouncement, Text: req.Text})
+		}
+		log.Printf("📢 Объявление администратора: %s", req.Text)
+		return adminResponse{OK: true, Affected: len(clients)}
+	}
+	return adminError("неизвестная команда %q", req.Command)
+}
+
+func findClientLocked(username string) *Client {
+	for _, client := range clients {
+		if client.username == username {
+			return client
+		}
+	}
+	return nil
+}
+
+// disconnectClientLocked сообщает клиенту, почему его сессия завершена,
+// и удаляет его с сервера. Состояние доставки и шифрования адресата
+// забывается, когда клиент подтвердит уведомление.
+func disconnectClientLocked(pc net.PacketConn, client *Client, kind protocol.NoticeKind, reason string) {
+	sendMessage(pc, client.addr, &protocol.Notice{Kind: kind, Text: reason})
+	removeClientLocked(pc, client)
+	go forgetAfterNotice(pc, client.addr)
+}
+
+// forgetAfterNotice ждет подтверждения уведомления, но не дольше
+// config.ShutdownTimeout, и забывает адресата, если с его адреса тем
+// временем никто не вошел заново
+func forgetAfterNotice(pc net.PacketConn, addr net.Addr) {
+	if conn, ok := pc.(*reliable.Conn); ok {
+		conn.FlushTo(addr, config.ShutdownTimeout)
+	}
+	clientsMux.RLock()
+	_, rejoined := clients[addr.String()]
+	clientsMux.RUnlock()
+	if !rejoined {
+		forgetPeer(pc, addr)
+	}
+}
+
+// bannedLocked проверяет блокировку по имени и по IP адреса addr
+// (host:port). Вызывающий должен удерживать clientsMux.
+func bannedLocked(username, addr string) bool {
+	if _, ok := bannedNames[username]; ok {
+		return true
+	}
+	if ip, ok := normalizeIP(addrHost(addr)); ok {
+		_, banned := bannedIPs[ip]
+		return banned
+	}
+	return false
+}
+
+// normalizeIP приводит IP к одному виду: IPv4 внутри IPv6 - к IPv4,
+// зона отбрасывается
+func normalizeIP(s string) (string, bool) {
+	ip, err := netip.ParseAddr(s)
+	if err != nil {
+		return "", false
+	}
+	return ip.Unmap().WithZone("").String(), true
+}
+
+func listClientsLocked() []adminClient {
+	list := make([]adminClient, 0, len(clients))
+	for _, client := range clients {
+		entry := adminClient{
+			Username:     client.username,
+			Address:      client.addr.String(),
+			Voice:        client.inVoice,
+			VoiceAddress: client.voiceAddr,
+			Muted:        client.serverMuted,
+			LastActivity: client.lastSeen,
+		}
+		if client.lastActivity.After(entry.LastActivity) {
+			entry.LastActivity = client.lastActivity
+		}
+		if client.room != nil {
+			entry.Room = client.room.name
+		}
+		list = append(list, entry)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Username < list[j].Username })
+	return list
+}
+
+func listBansLocked() []adminBan {
+	list := make([]adminBan, 0, len(bannedNames)+len(bannedIPs))
+	for _, bans := range []map[string]string{bannedNames, bannedIPs} {
+		for target, reason := range bans {
+			list = append(list, adminBan{Target: target, Reason: reason})
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Target < list[j].Target })
+	return list
+}
+
+const adminUsage = `Использование: server admin [-socket путь] команда [аргументы]
+
+Команды:
+  list                        участники, их адреса, голос и активность, блокировки
+  kick <имя> [причина]        исключить участника
+  mute <имя> [причина]        не пропускать голос участника
+  unmute <имя>                снова пропускать голос
+  ban <имя|IP> [причина]      заблокировать вход и исключить совпавших участников
+  unban <имя|IP>              снять блокировку
+  broadcast <текст>           объявление всем участникам
+  shutdown [-restart время] [причина]
+                              остановить сервер; с -restart клиенты
+                              переподключатся через указанное время
+`
+
+// runAdmin - подкоманда "server admin": отправляет команду работающему
+// серверу и печатает ответ. Возвращает код выхода.
+func runAdmin(args []string) int {
+	fs := flag.NewFlagSet("admin", flag.ContinueOnError)
+	socket := fs.String("socket", defaultConfig().AdminSocket, "сокет администратора работающего сервера (admin_socket)")
+	fs.Usage = func() {
+		fmt.Fprint(fs.Output(), adminUsage)
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		return 2
+	}
+
+	req, err := parseAdminArgs(fs.Args())
+	if err != nil {
+		fmt.Fprintf(fs.Output(), "%v\n\n", err)
+		fs.Usage()
+		return 2
+	}
+
+	resp, err := adminCall(*socket, req)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "❌ Нет связи с сервером через %s: %v\n", *socket, err)
+		return 1
+	}
+	if !resp.OK {
+		fmt.Fprintf(os.Stderr, "❌ %s\n", resp.Error)
+		return 1
+	}
+	printAdminResponse(os.Stdout, req, resp, time.Now())
+	return 0
+}
+
+// parseAdminArgs собирает запрос из аргументов: команда, цель и текст
+func parseAdminArgs(args []string) (adminRequest, error) {
+	if len(args) == 0 {
+		return adminRequest{}, errors.New("не указана команда")
+	}
+	req := adminRequest{Command: args[0]}
+	rest := args[1:]
+
+	switch req.Command {
+	case "list":
+		if len(rest) != 0 {
+			return req, errors.New("list не принимает аргументов")
+		}
+	case "kick", "mute", "unmute", "ban", "unban":
+		if len(rest) == 0 {
+			return req, fmt.Errorf("%s: не указан участник", req.Command)
+		}
+		req.Target = rest[0]
+		req.Text = strings.Join(rest[1:], " ")
+	case "broadcast":
+		req.Text = strings.Join(rest, " ")
+		if strings.TrimSpace(req.Text) == "" {
+			return req, errors.New("broadcast: не указан текст объявления")
+		}
+	case "shutdown":
+		fs := flag.NewFlagSet("shutdown", flag.ContinueOnError)
+		fs.SetOutput(io.Discard)
+		fs.DurationVar(&req.RestartIn, "restart", 0, "")
+		if err := fs.Parse(rest); err != nil {
+			return req, fmt.Errorf("shutdown: %v", err)
+		}
+		if req.RestartIn < 0 {
+			return req, errors.New("shutdown: время перезапуска не может быть отрицательным")
+		}
+		req.Text = strings.Join(fs.Args(), " ")
+	default:
+		return req, fmt.Errorf("неизвестная команда %q", req.Command)
+	}
+	return req, nil
+}
+
+// adminCall отправляет один запрос на сокет администратора
+func adminCall(socket string, req adminRequest) (adminResponse, error) {
+	var resp adminResponse
+	conn, err := net.DialTimeout("unix", socket, adminTimeout)
+	if err != nil {
+		return resp, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(adminTimeout))
+
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return resp, err
+	}
+	err = json.NewDecoder(conn).Decode(&resp)
+	return resp, err
+}
+
+func printAdminResponse(w io.Writer, req adminRequest, resp adminResponse, now time.Time) {
+	if req.Command != "list" {
+		fmt.Fprintf(w, "✅ Готово, затронуто участников: %d\n", resp.Affected)
+		return
+	}
+
+	if len(resp.Clients) == 0 {
+		fmt.Fprintln(w, "Участников нет")
+	} else {
+		tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "ИМЯ\tАДРЕС\tКОМНАТА\tГОЛОС\tАКТИВНОСТЬ")
+		for _, c := range resp.Clients {
+			voice := "-"
+			if c.Voice {
+				voice = "в войсе"
+				if c.VoiceAddress != "" {
+					voice += " " + c.VoiceAddress
+				}
+			}
+			if c.Muted {
+				voice += " (заглушен)"
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s назад\n",
+				c.Username, c.Address, c.Room, voice, now.Sub(c.LastActivity).Round(time.Second))
+		}
+		tw.Flush()
+	}
+
+	if len(resp.Bans) > 0 {
+		fmt.Fprintln(w, "\nЗаблокированы:")
+		for _, ban := range resp.Bans {
+			fmt.Fprintf(w, "  %s %s\n", ban.Target, ban.Reason)
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"airchat/protocol"
+)
+
+// addAdminTestClients регистрирует участников комнаты test и убирает их
+// после теста
+func addAdminTestClients(t *testing.T, addrs map[string]*net.UDPAddr) *Room {
+	t.Helper()
+	room := &Room{name: "test", members: make(map[string]*Client), audioProcessor: NewAudioProcessor(), stop: make(chan struct{})}
+
+	clientsMux.Lock()
+	defer clientsMux.Unlock()
+	for name, addr := range addrs {
+		client := &Client{addr: addr, username: name, room: room, voiceToken: newVoiceToken(), lastActivity: time.Now()}
+		clients[addr.String()] = client
+		voiceSessions[client.voiceToken] = client
+		room.members[addr.String()] = client
+	}
+	t.Cleanup(func() {
+		clientsMux.Lock()
+		defer clientsMux.Unlock()
+		for _, addr := range addrs {
+			if client, ok := clients[addr.String()]; ok {
+				delete(voiceSessions, client.voiceToken)
+				delete(clients, addr.String())
+			}
+		}
+		clear(bannedNames)
+		clear(bannedIPs)
+	})
+	return room
+}
+
+// sentNotice разбирает последний кадр, отправленный на addr
+func sentNotice(t *testing.T, conn *recordingConn, addr net.Addr) *protocol.Notice {
+	t.Helper()
+	msg, err := protocol.Unmarshal(conn.sent[addr.String()])
+	if err != nil {
+		t.Fatalf("кадр для %s: %v", addr, err)
+	}
+	notice, ok := msg.(*protocol.Notice)
+	if !ok {
+		t.Fatalf("для %s отправлено %s, ожидалось уведомление", addr, msg.Type())
+	}
+	return notice
+}
+
+func TestAdminKickAndMute(t *testing.T) {
+	alice := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 50000}
+	bob := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 50000}
+	room := addAdminTestClients(t, map[string]*net.UDPAddr{"alice": alice, "bob": bob})
+	conn := &recordingConn{sent: make(map[string][]byte)}
+
+	resp := handleAdminRequest(conn, adminRequest{Command: "mute", Target: "bob", Text: "шум"})
+	if !resp.OK || !clients[bob.String()].serverMuted {
+		t.Fatalf("mute: %+v", resp)
+	}
+	if n := sentNotice(t, conn, bob); n.Kind != protocol.NoticeMuted || n.Text != "шум" {
+		t.Errorf("bob получил %+v", n)
+	}
+
+	resp = handleAdminRequest(conn, adminRequest{Command: "kick", Target: "alice", Text: "флуд"})
+	if !resp.OK {
+		t.Fatalf("kick: %+v", resp)
+	}
+	if n := sentNotice(t, conn, alice); n.Kind != protocol.NoticeKicked || n.Text != "флуд" {
+		t.Errorf("alice получила %+v", n)
+	}
+	if _, ok := clients[alice.String()]; ok || room.members[alice.String()] != nil {
+		t.Error("исключенный клиент остался на сервере")
+	}
+	// Оставшиеся участники узнают о выходе
+	if msg, _ := protocol.Unmarshal(conn.sent[bob.String()]); !isLeave(msg, "alice") {
+		t.Errorf("bob получил %#v вместо Leave", msg)
+	}
+
+	if resp := handleAdminRequest(conn, adminRequest{Command: "kick", Target: "alice"}); resp.OK {
+		t.Error("повторное исключение прошло")
+	}
+	if resp := handleAdminRequest(conn, adminRequest{Command: "reboot"}); resp.OK || resp.Error == "" {
+		t.Errorf("неизвестная команда: %+v", resp)
+	}
+}
+
+func isLeave(msg protocol.Message, username string) bool {
+	leave, ok := msg.(*protocol.Leave)
+	return ok && leave.Username == username
+}
+
+func TestAdminBan(t *testing.T) {
+	alice := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 50000}
+	carol := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 50001} // За тем же NAT
+	bob := &net.UDPAddr{IP: net.ParseIP("2001:db8::2"), Port: 50000}
+	addAdminTestClients(t, map[string]*net.UDPAddr{"alice": alice, "carol": carol, "bob": bob})
+	conn := &recordingConn{sent: make(map[string][]byte)}
+
+	resp := handleAdminRequest(conn, adminRequest{Command: "ban", Target: "10.0.0.1", Text: "спам"})
+	if !resp.OK || resp.Affected != 2 {
+		t.Fatalf("ban по IP: %+v", resp)
+	}
+	for _, addr := range []*net.UDPAddr{alice, carol} {
+		if n := sentNotice(t, conn, addr); n.Kind != protocol.NoticeBanned {
+			t.Errorf("%s получил %+v", addr, n)
+		}
+	}
+
+	resp = handleAdminRequest(conn, adminRequest{Command: "ban", Target: "bob"})
+	if !resp.OK || resp.Affected != 1 {
+		t.Fatalf("ban по имени: %+v", resp)
+	}
+
+	clientsMux.Lock()
+	// IPv4 через сокет двойного стека приходит как ::ffff:10.0.0.1
+	byMappedIP := bannedLocked("dave", "[::ffff:10.0.0.1]:6000")
+	byName := bannedLocked("bob", "192.0.2.7:6000")
+	other := bannedLocked("dave", "192.0.2.7:6000")
+	clientsMux.Unlock()
+	if !byMappedIP || !byName || other {
+		t.Errorf("блокировки: по IP %v, по имени %v, посторонний %v", byMappedIP, byName, other)
+	}
+
+	list := handleAdminRequest(conn, adminRequest{Command: "list"})
+	if len(list.Clients) != 0 || len(list.Bans) != 2 {
+		t.Errorf("list после блокировок: %+v", list)
+	}
+
+	if resp := handleAdminRequest(conn, adminRequest{Command: "unban", Target: "bob"}); !resp.OK {
+		t.Errorf("unban: %+v", resp)
+	}
+	if resp := handleAdminRequest(conn, adminRequest{Command: "unban", Target: "bob"}); resp.OK {
+		t.Error("повторное снятие блокировки прошло")
+	}
+}
+
+func TestAdminSocket(t *testing.T) {
+	alice := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 50000}
+	addAdminTestClients(t, map[string]*net.UDPAddr{"alice": alice})
+	conn := &recordingConn{sent: make(map[string][]byte)}
+
+	path := filepath.Join(t.TempDir(), "admin.sock")
+	ln, err := listenAdmin(path)
+	if err != nil {
+		t.Skipf("Unix-сокеты недоступны: %v", err)
+	}
+	defer ln.Close()
+	go serveAdmin(ln, conn)
+
+	resp, err := adminCall(path, adminRequest{Command: "list"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !resp.OK || len(resp.Clients) != 1 || resp.Clients[0].Username != "alice" || resp.Clients[0].Room != "test" {
+		t.Fatalf("list: %+v", resp)
+	}
+
+	var out bytes.Buffer
+	printAdminResponse(&out, adminRequest{Command: "list"}, resp, time.Now())
+	if !strings.Contains(out.String(), alice.String()) {
+		t.Errorf("в выводе нет адреса:\n%s", out.String())
+	}
+
+	resp, err = adminCall(path, adminRequest{Command: "broadcast", Text: "перезапуск в 22:00"})
+	if err != nil || !resp.OK || resp.Affected != 1 {
+		t.Fatalf("broadcast: %+v, %v", resp, err)
+	}
+	if n := sentNotice(t, conn, alice); n.Kind != protocol.NoticeAnnouncement || n.Text != "перезапуск в 22:00" {
+		t.Errorf("alice получила %+v", n)
+	}
+}
+
+func TestParseAdminArgs(t *testing.T) {
+	tests := []struct {
+		args []string
+		want adminRequest
+		err  bool
+	}{
+		{args: []string{"list"}, want: adminRequest{Command: "list"}},
+		{args: []string{"kick", "alice", "флуд", "в", "чате"}, want: adminRequest{Command: "kick", Target: "alice", Text: "флуд в чате"}},
+		{args: []string{"ban", "10.0.0.1"}, want: adminRequest{Command: "ban", Target: "10.0.0.1"}},
+		{args: []string{"broadcast", "сервер", "обновится"}, want: adminRequest{Command: "broadcast", Text: "сервер обновится"}},
+		{args: nil, err: true},
+		{args: []string{"kick"}, err: true},
+		{args: []string{"broadcast"}, err: true},
+		{args: []string{"list", "всех"}, err: true},
+		{args: []string{"shutdown"}, want: adminRequest{Command: "shutdown"}},
+		{args: []string{"shutdown", "-restart", "30s", "обновление", "сервера"}, want: adminRequest{Command: "shutdown", Text: "обновление сервера", RestartIn: 30 * time.Second}},
+		{args: []string{"shutdown", "-restart", "скоро"}, err: true},
+		{args: []string{"reboot"}, err: true},
+	}
+	for _, tt := range tests {
+		got, err := parseAdminArgs(tt.args)
+		if tt.err {
+			if err == nil {
+				t.Errorf("%q: ошибки нет", tt.args)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("%q: %+v, %v", tt.args, got, err)
+		}
+	}
+}
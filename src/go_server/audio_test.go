@@ -0,0 +1,68 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// frame возвращает кадр, заполненный значением v
+func frame(v float32) []float32 {
+	f := make([]float32, frameSize)
+	for i := range f {
+		f[i] = v
+	}
+	return f
+}
+
+func TestAudioProcessorOneFramePerTick(t *testing.T) {
+	ap := NewAudioProcessor()
+
+	// Пачка из трех кадров не должна затирать друг друга
+	ap.AddBuffer("alice", frame(0.1))
+	ap.AddBuffer("alice", frame(0.2))
+	ap.AddBuffer("alice", frame(0.3))
+
+	now := time.Now()
+	for _, want := range []float32{0.1, 0.2, 0.3} {
+		frames := ap.NextFrames(now)
+		if got := frames["alice"]; got == nil || got[0] != want {
+			t.Fatalf("ожидался кадр %v, получено %v", want, got)
+		}
+	}
+
+	// Очередь пуста: отправитель молчит, а не повторяет последний кадр
+	if frames := ap.NextFrames(now); len(frames) != 0 {
+		t.Errorf("после опустошения получены кадры %v", frames)
+	}
+}
+
+func TestAudioProcessorDropsStaleFrames(t *testing.T) {
+	ap := NewAudioProcessor()
+	ap.AddBuffer("bob", frame(0.5))
+
+	frames := ap.NextFrames(time.Now().Add(maxBufferAge + time.Millisecond))
+	if len(frames) != 0 {
+		t.Errorf("устаревший кадр не выброшен: %v", frames)
+	}
+}
+
+func TestAudioProcessorQueueLimit(t *testing.T) {
+	ap := NewAudioProcessor()
+	for i := 0; i < maxQueuedFrames+3; i++ {
+		ap.AddBuffer("carol", frame(float32(i)))
+	}
+
+	// Первые три кадра вытеснены более новыми
+	frames := ap.NextFrames(time.Now())
+	if got := frames["carol"][0]; got != 3 {
+		t.Errorf("первым в очереди кадр %v, ожидался 3", got)
+	}
+}
+
+func TestAudioProcessorRejectsWrongSize(t *testing.T) {
+	ap := NewAudioProcessor()
+	ap.AddBuffer("dave", make([]float32, frameSize/2))
+	if frames := ap.NextFrames(time.Now()); len(frames) != 0 {
+		t.Errorf("кадр неверного размера принят: %v", frames)
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"airchat/protocol"
+	"airchat/protocol/flagfile"
+)
+
+// Config - настройки сервера. Значения по умолчанию перекрывает файл
+// конфигурации (-config), а его - флаги командной строки.
+type Config struct {
+	Bind              string        // Адрес сокетов, пустой - все интерфейсы IPv4 и IPv6
+	ControlPort       int           // Порт управляющего канала
+	VoicePort         int           // Порт голосового трафика
+	Mode              VoiceMode     // Режим доставки голоса
+	MaxClients        int           // Максимальное количество участников
+	MaxRooms          int           // Максимальное количество комнат вместе с общей
+	ClientTimeout     time.Duration // Через сколько без пакетов клиент выбывает из войса
+	ControlTimeout    time.Duration // Через сколько без сообщений клиент удаляется из чата
+	ShutdownTimeout   time.Duration // Сколько при остановке ждать, пока клиенты подтвердят доставку
+	RestartHint       time.Duration // Через сколько сервер ожидается снова после остановки сигналом, 0 - не ожидается
+	HeartbeatInterval time.Duration // Интервал heartbeat сервера клиентам в войсе
+	Bitrate           int           // Битрейт кодировщика Opus, бит/с
+	ReadBuffer        int           // Размер буфера приема сокетов, 0 - системный
+	IdentityKey       string        // Файл долговременного ключа сервера, создается при первом запуске
+	AdminSocket       string        // Unix-сокет администратора, пустой - выключен
+	MetricsAddr       string        // host:port HTTP-эндпоинта /metrics, пустой - выключен
+}
+
+// config - действующие настройки, задаются в main до запуска сервера
+var config = defaultConfig()
+
+func defaultConfig() Config {
+	return Config{
+		ControlPort:       6000,
+		VoicePort:         6001,
+		Mode:              ModeMCU,
+		MaxClients:        64,
+		MaxRooms:          32,
+		ClientTimeout:     30 * time.Second,
+		ControlTimeout:    30 * time.Second,
+		ShutdownTimeout:   5 * time.Second,
+		HeartbeatInterval: 5 * time.Second,
+		Bitrate:           96000,
+		IdentityKey:       "server_identity.key",
+		AdminSocket:       "server_admin.sock",
+	}
+}
+
+// newFlagSet описывает параметры сервера, они же ключи файла конфигурации:
+// -client-timeout задается в файле как client_timeout.
+func newFlagSet(cfg *Config) *flag.FlagSet {
+	fs := flag.NewFlagSet("server", flag.ContinueOnError)
+	fs.StringVar(&cfg.Bind, "bind", cfg.Bind, "адрес для сокетов сервера, пустой - все интерфейсы IPv4 и IPv6")
+	fs.IntVar(&cfg.ControlPort, "control-port", cfg.ControlPort, "порт управляющего канала")
+	fs.IntVar(&cfg.VoicePort, "voice-port", cfg.VoicePort, "порт голосового трафика")
+	fs.Var(&cfg.Mode, "mode", "режим голоса: mcu - сведение на сервере, sfu - пересылка пакетов без перекодирования")
+	fs.IntVar(&cfg.MaxClients, "max-clients", cfg.MaxClients, "максимальное количество участников")
+	fs.IntVar(&cfg.MaxRooms, "max-rooms", cfg.MaxRooms, "максимальное количество комнат вместе с общей")
+	fs.DurationVar(&cfg.ClientTimeout, "client-timeout", cfg.ClientTimeout, "через сколько без пакетов клиент выбывает из войса")
+	fs.DurationVar(&cfg.ControlTimeout, "control-timeout", cfg.ControlTimeout, "через сколько без сообщений клиент удаляется из чата")
+	fs.DurationVar(&cfg.ShutdownTimeout, "shutdown-timeout", cfg.ShutdownTimeout, "сколько при остановке ждать, пока клиенты подтвердят уведомление и недоставленные сообщения")
+	fs.DurationVar(&cfg.RestartHint, "restart-hint", cfg.RestartHint, "через сколько сервер ожидается снова после SIGTERM (например, под systemd с Restart=always), клиенты переподключатся; 0 - сессия окончена")
+	fs.DurationVar(&cfg.HeartbeatInterval, "heartbeat-interval", cfg.HeartbeatInterval, "интервал heartbeat клиентам в войсе")
+	fs.IntVar(&cfg.Bitrate, "bitrate", cfg.Bitrate, "битрейт Opus, бит/с")
+	fs.IntVar(&cfg.ReadBuffer, "read-buffer", cfg.ReadBuffer, "размер буфера приема сокетов в байтах, 0 - системный")
+	fs.StringVar(&cfg.IdentityKey, "identity-key", cfg.IdentityKey, "файл ключа сервера для шифрования, создается при первом запуске")
+	fs.StringVar(&cfg.MetricsAddr, "metrics-addr", cfg.MetricsAddr, "адрес HTTP для метрик Prometheus (/metrics), например 127.0.0.1:9100; пустой - выключено")
+	fs.StringVar(&cfg.AdminSocket, "admin-socket", cfg.AdminSocket, "Unix-сокет для команд администратора (server admin), пустой - выключен")
+	return fs
+}
+
+// loadConfig разбирает аргументы командной строки и файл конфигурации
+// из -config. Флаги, заданные явно, важнее значений из файла.
+func loadConfig(args []string) (Config, error) {
+	cfg := defaultConfig()
+	fs := newFlagSet(&cfg)
+	fs.String("config", "", "файл конфигурации (подмножество TOML, см. server.example.toml)")
+	if err := flagfile.Parse(fs, args, "config"); err != nil {
+		return cfg, err
+	}
+	return cfg, cfg.validate()
+}
+
+func (c Config) validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	check(validPort(c.ControlPort), "control_port %d вне диапазона 1-65535", c.ControlPort)
+	check(validPort(c.VoicePort), "voice_port %d вне диапазона 1-65535", c.VoicePort)
+	check(c.ControlPort != c.VoicePort, "control_port и voice_port совпадают: %d", c.ControlPort)
+	check(c.MaxClients > 0, "max_clients должен быть больше 0")
+	check(c.MaxRooms > 0, "max_rooms должен быть больше 0")
+	check(c.ClientTimeout > 0, "client_timeout должен быть больше 0")
+	check(c.ControlTimeout >= 2*protocol.KeepaliveInterval,
+		"control_timeout должен быть не меньше %s: клиенты шлют keepalive каждые %s", 2*protocol.KeepaliveInterval, protocol.KeepaliveInterval)
+	check(c.ShutdownTimeout >= 0, "shutdown_timeout не может быть отрицательным")
+	check(c.RestartHint >= 0, "restart_hint не может быть отрицательным")
+	check(c.HeartbeatInterval > 0 && c.HeartbeatInterval < c.ClientTimeout,
+		"heartbeat_interval должен быть больше 0 и меньше client_timeout (%s)", c.ClientTimeout)
+	check(c.Bitrate >= 6000 && c.Bitrate <= 510000, "bitrate %d вне диапазона Opus 6000-510000", c.Bitrate)
+	check(c.ReadBuffer >= 0, "read_buffer не может быть отрицательным")
+	check(c.IdentityKey != "", "не указан identity_key")
+	if c.MetricsAddr != "" {
+		_, port, err := net.SplitHostPort(c.MetricsAddr)
+		p, _ := strconv.Atoi(port)
+		check(err == nil && validPort(p), "metrics_addr %q должен быть вида host:port", c.MetricsAddr)
+	}
+	return errors.Join(errs...)
+}
+
+func validPort(port int) bool {
+	return port > 0 && port <= 65535
+}
+
+// ControlAddr и VoiceAddr - адреса для net.ListenPacket
+func (c Config) ControlAddr() string {
+	return net.JoinHostPort(c.Bind, strconv.Itoa(c.ControlPort))
+}
+
+func (c Config) VoiceAddr() string {
+	return net.JoinHostPort(c.Bind, strconv.Itoa(c.VoicePort))
+}
+
+func (c Config) String() string {
+	return fmt.Sprintf("bind=%q control_port=%d voice_port=%d mode=%s max_clients=%d max_rooms=%d "+
+		"client_timeout=%s control_timeout=%s shutdown_timeout=%s restart_hint=%s heartbeat_interval=%s bitrate=%d read_buffer=%d identity_key=%q admin_socket=%q metrics_addr=%q",
+		c.Bind, c.ControlPort, c.VoicePort, c.Mode, c.MaxClients, c.MaxRooms,
+		c.ClientTimeout, c.ControlTimeout, c.ShutdownTimeout, c.RestartHint, c.HeartbeatInterval, c.Bitrate, c.ReadBuffer, c.IdentityKey, c.AdminSocket, c.MetricsAddr)
+}
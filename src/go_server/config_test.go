@@ -0,0 +1,92 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "server.toml")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfigFileAndFlags(t *testing.T) {
+	path := writeConfig(t, `
+# второй сервер на этом же хосте
+bind = "::1"
+control_port = 7000   # управляющий канал
+voice_port = 7001
+mode = "sfu"
+client_timeout = "1m"
+bitrate = 64000
+`)
+
+	cfg, err := loadConfig([]string{"-config", path, "-voice-port", "7101"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := defaultConfig()
+	want.Bind = "::1"
+	want.ControlPort = 7000
+	want.VoicePort = 7101 // флаг важнее файла
+	want.Mode = ModeSFU
+	want.ClientTimeout = time.Minute
+	want.Bitrate = 64000
+	if cfg != want {
+		t.Errorf("получено %s\nожидалось %s", cfg, want)
+	}
+	if got := cfg.ControlAddr(); got != "[::1]:7000" {
+		t.Errorf("ControlAddr() = %q", got)
+	}
+}
+
+func TestLoadConfigDefaults(t *testing.T) {
+	cfg, err := loadConfig(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg != defaultConfig() {
+		t.Errorf("без аргументов получено %s", cfg)
+	}
+	if got := cfg.VoiceAddr(); got != ":6001" {
+		t.Errorf("VoiceAddr() = %q", got)
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+		args []string
+		want string
+	}{
+		{"неизвестный ключ", "voice_prot = 7001", nil, "неизвестный параметр"},
+		{"не число", `max_clients = "много"`, nil, "max_clients"},
+		{"режим", `mode = "p2p"`, nil, "неизвестный режим"},
+		{"одинаковые порты", "", []string{"-voice-port", "6000"}, "совпадают"},
+		{"порт", "", []string{"-control-port", "70000"}, "вне диапазона"},
+		{"control_timeout", `control_timeout = "5s"`, nil, "control_timeout"},
+		{"restart_hint", "", []string{"-restart-hint", "-1s"}, "restart_hint"},
+		{"heartbeat", `heartbeat_interval = "1m"`, nil, "heartbeat_interval"},
+		{"битрейт", "bitrate = 1000", nil, "bitrate"},
+		{"адрес метрик", `metrics_addr = "9100"`, nil, "metrics_addr"},
+	}
+	for _, tt := range tests {
+		args := tt.args
+		if tt.file != "" {
+			args = append([]string{"-config", writeConfig(t, tt.file)}, args...)
+		}
+		_, err := loadConfig(args)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: ошибка %v, ожидалась с %q", tt.name, err, tt.want)
+		}
+	}
+}
@@ -1,15 +1,26 @@
 package main
 
 import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"flag"
 	"log"
-	"math"
 	"net"
 	"os"
 	"os/signal"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"airchat/protocol"
+	"airchat/protocol/reliable"
+	"airchat/protocol/secure"
+	"airchat/protocol/token"
 
 	"github.com/hraban/opus"
 )
@@ -20,21 +31,49 @@ const (
 	frameSize     = 960  // 20ms at 48kHz
 	maxPacketSize = 1275 // Максимальный размер пакета Opus
 
-	// Увеличиваем таймауты
-	clientTimeout     = 30 * time.Second       // Увеличиваем до 30 секунд
-	heartbeatInterval = 5 * time.Second        // Увеличиваем интервал
-	maxBufferAge      = 500 * time.Millisecond // Увеличиваем время жизни буфера
+	// Микшер сводит по кадру за такт, поэтому его период - длительность кадра
+	mixInterval = frameSize * time.Second / sampleRate
+
+	// Таймауты и интервалы, задаваемые при запуске, см. config.go
+	maxBufferAge     = 500 * time.Millisecond // Кадры старше этого выбрасываются из очереди микшера
+	maxQueuedFrames  = 10                     // Очередь кадров одного отправителя, 200мс
+	maxConcealFrames = 5                      // Сколько потерянных подряд кадров маскировать PLC
+
+	// Ограничения на вход, число участников задается в config.go
+	minUsernameLen = 2
+	maxUsernameLen = 32
 )
 
 type Client struct {
 	addr         net.Addr
 	username     string
 	inVoice      bool
-	voiceAddr    string
+	voiceAddr    string // Адрес голосового сокета, известен после VoiceHello
 	decoder      *opus.Decoder
 	encoder      *opus.Encoder
-	lastActivity time.Time
+	lastActivity time.Time // Последний голосовой пакет
+	lastSeen     time.Time // Последнее сообщение по управляющему каналу
 	active       bool
+	room         *Room // Текущая комната, nil до входа
+
+	voiceStreamID   uint32                // Поток, объявленный клиентом при входе в войс, уникален на сервере
+	lastVoiceSeq    uint16                // Номер последнего принятого аудиопакета
+	voiceSeqStarted bool                  // Был ли уже принят пакет этого потока
+
+	// Состояние микса слушателя. Микшер работает без clientsMux, а при
+	// переходе между комнатами такт могут делать два микшера сразу,
+	// поэтому оно под своим mixMux.
+	mixMux    sync.Mutex
+	mixStream *protocol.VoiceStream // Нумерация микса, который слушает клиент
+	limiter   *Limiter              // Лимитер микса этого слушателя
+
+	voiceToken  [protocol.VoiceTokenSize]byte  // Токен голосовой сессии из JoinResult
+	identityKey [protocol.IdentityKeySize]byte // Открытый ключ сквозного шифрования из Join
+	serverMuted bool                           // Голос заглушен администратором
+
+	voiceBytes     int64   // Принято байт голоса от клиента
+	lastVoiceBytes int64   // voiceBytes на прошлом пересчете битрейта
+	bitrate        float64 // Входящий битрейт голоса, бит/с, см. updateBitrates
 }
 
 // AudioBuffer больше не используется глобально, AudioProcessor управляет этим
@@ -46,66 +85,44 @@ type Client struct {
 var (
 	clients    = make(map[string]*Client)
 	clientsMux sync.RWMutex
+	// Клиенты по токену голосовой сессии, защищен clientsMux
+	voiceSessions = make(map[[protocol.VoiceTokenSize]byte]*Client)
 	// audioBuffers    = make(map[string][]AudioBuffer) // Удалено
 	// audioSenders    = make(map[string]string) // Это поле не использовалось, удаляем
 	// audioBuffersMux sync.RWMutex // Удалено
-	mixInterval = 20 * time.Millisecond
-	// audioProcessor будет инициализирован в handleVoiceData
-)
-
-// Улучшенная функция микширования аудио с улучшенной обработкой буферов
-func mixAudio(buffers [][]float32) []float32 {
-	if len(buffers) == 0 {
-		return nil
-	}
-
-	// Проверяем размеры буферов
-	frameLen := len(buffers[0])
-	for i, buf := range buffers {
-		if len(buf) != frameLen {
-			log.Printf("Неверный размер буфера %d: %d (ожидалось %d)", i, len(buf), frameLen)
-			return nil
-		}
-	}
 
-	// Создаем выходной буфер
-	mixed := make([]float32, frameLen)
+	// Открытый ключ, которым проверяются сессионные токены. Закрытый есть
+	// только у Electron, проверяющего пароли.
+	authKey ed25519.PublicKey
 
-	// Вычисляем коэффициент масштабирования для микширования
-	scale := float32(1.0) / float32(len(buffers))
+	// Сессии шифрования, задается в main. Через него забываются сессии
+	// ушедших клиентов.
+	transport *secure.Server
 
-	// Микшируем все буферы с масштабированием
-	for _, buf := range buffers {
-		for i := range buf {
-			mixed[i] += buf[i] * scale
-		}
-	}
-
-	// Применяем компрессию динамического диапазона
-	maxAmplitude := float32(0)
-	for _, sample := range mixed {
-		if abs := float32(math.Abs(float64(sample))); abs > maxAmplitude {
-			maxAmplitude = abs
-		}
-	}
+	// Сервер завершает работу и больше не принимает вход
+	shuttingDown atomic.Bool
 
-	// Мягкое ограничение и нормализация
-	if maxAmplitude > 1.0 {
-		// Применяем кривую мягкого ограничения
-		for i := range mixed {
-			mixed[i] = float32(math.Tanh(float64(mixed[i])))
-		}
-	}
+	// Остановка по команде администратора, обрабатывается в main
+	shutdownRequests = make(chan shutdownRequest, 1)
+	// У каждой комнаты свой AudioProcessor, см. rooms.go
+	// Счетчики голосового трафика - в metrics.go
+)
 
-	return mixed
+// timedFrame - декодированный кадр отправителя и время его поступления
+type timedFrame struct {
+	samples []float32
+	added   time.Time
 }
 
-// AudioProcessor обрабатывает аудиопотоки
+// AudioProcessor держит для каждого отправителя комнаты небольшую очередь
+// кадров. Микшер на каждом такте забирает из каждой очереди ровно один
+// кадр, поэтому пачка пакетов не затирает друг друга, а замолчавший
+// отправитель дает тишину, а не повтор последнего кадра.
 type AudioProcessor struct {
 	sampleRate int
 	channels   int
 	frameSize  int
-	buffers    map[string][]float32
+	queues     map[string][]timedFrame
 	mutex      sync.RWMutex
 }
 
@@ -114,10 +131,12 @@ func NewAudioProcessor() *AudioProcessor {
 		sampleRate: sampleRate,
 		channels:   channels,
 		frameSize:  frameSize,
-		buffers:    make(map[string][]float32),
+		queues:     make(map[string][]timedFrame),
 	}
 }
 
+// AddBuffer ставит кадр в очередь отправителя. Если очередь переполнена,
+// самый старый кадр отбрасывается.
 func (ap *AudioProcessor) AddBuffer(clientID string, buffer []float32) {
 	ap.mutex.Lock()
 	defer ap.mutex.Unlock()
@@ -125,56 +144,100 @@ func (ap *AudioProcessor) AddBuffer(clientID string, buffer []float32) {
 	if len(buffer) != ap.frameSize {
 		return
 	}
-	
-	// Заменяем старый буфер новым
-	ap.buffers[clientID] = buffer
+
+	queue := ap.queues[clientID]
+	if len(queue) >= maxQueuedFrames {
+		queue = queue[1:]
+		framesDropped.Add(1)
+	}
+	ap.queues[clientID] = append(queue, timedFrame{samples: buffer, added: time.Now()})
 }
 
-func (ap *AudioProcessor) RemoveClient(clientID string) {
+// NextFrames забирает по одному кадру из очереди каждого отправителя.
+// Кадры старше maxBufferAge отбрасываются, отправителей без кадров в
+// результате нет - на этом такте они молчат.
+func (ap *AudioProcessor) NextFrames(now time.Time) map[string][]float32 {
 	ap.mutex.Lock()
 	defer ap.mutex.Unlock()
-	delete(ap.buffers, clientID)
-}
 
-func (ap *AudioProcessor) GetMixedAudioForClient(excludeClientID string) []float32 {
-	ap.mutex.RLock()
-	defer ap.mutex.RUnlock()
-
-	var buffers [][]float32
-	
-	for clientID, buffer := range ap.buffers {
-		if clientID != excludeClientID {
-			buffers = append(buffers, buffer)
+	frames := make(map[string][]float32, len(ap.queues))
+	for clientID, queue := range ap.queues {
+		for len(queue) > 0 && now.Sub(queue[0].added) > maxBufferAge {
+			queue = queue[1:]
+			framesDropped.Add(1)
 		}
+		if len(queue) == 0 {
+			delete(ap.queues, clientID)
+			continue
+		}
+		frames[clientID] = queue[0].samples
+		ap.queues[clientID] = queue[1:]
 	}
-	
-	if len(buffers) > 0 {
-		return mixAudio(buffers)
-	}
+	return frames
+}
 
-	return nil
+// Reset очищает очереди всех отправителей
+func (ap *AudioProcessor) Reset() {
+	ap.mutex.Lock()
+	defer ap.mutex.Unlock()
+	ap.queues = make(map[string][]timedFrame)
+}
+
+func (ap *AudioProcessor) RemoveClient(clientID string) {
+	ap.mutex.Lock()
+	defer ap.mutex.Unlock()
+	delete(ap.queues, clientID)
 }
 
-func cleanup(pc, voiceConn net.PacketConn) {
-	log.Println("Завершение работы сервера...")
+// shutdownRequest - причина остановки и через сколько сервер ожидается
+// снова, 0 - не ожидается
+type shutdownRequest struct {
+	reason    string
+	restartIn time.Duration
+}
 
+// requestShutdown просит main остановить сервер. false - остановка уже
+// идет.
+func requestShutdown(req shutdownRequest) bool {
+	select {
+	case shutdownRequests <- req:
+		return true
+	default:
+		return false
+	}
+}
+
+// cleanup завершает работу сервера: новые входы отклоняются, клиенты
+// получают Shutdown, а сокеты закрываются, когда клиенты подтвердят все
+// отправленное им, но не позже config.ShutdownTimeout. Подтверждения
+// разбирает главный цикл, поэтому он должен работать до закрытия pc.
+func cleanup(pc, voiceConn net.PacketConn, req shutdownRequest) {
+	log.Printf("Завершение работы сервера... %s", req.reason)
+	shuttingDown.Store(true)
+
+	// Клиенту нужны целые секунды, округляем вверх, чтобы он не пришел раньше
+	msg := &protocol.Shutdown{
+		Reason:    req.reason,
+		RestartIn: uint32((req.restartIn + time.Second - 1) / time.Second),
+	}
 	clientsMux.RLock()
 	for _, client := range clients {
-		pc.WriteTo([]byte("Сервер завершает работу"), client.addr)
+		sendMessage(pc, client.addr, msg)
 	}
 	clientsMux.RUnlock()
 
-	if pc != nil {
-		pc.Close()
-	}
-	if voiceConn != nil {
-		voiceConn.Close()
+	if conn, ok := pc.(*reliable.Conn); ok && !conn.Flush(config.ShutdownTimeout) {
+		log.Printf("⚠️ За %s клиенты подтвердили не все, неподтвержденных пакетов: %d",
+			config.ShutdownTimeout, conn.Pending())
 	}
+
+	pc.Close()
+	voiceConn.Close()
 }
 
 // New function to clean up inactive clients
-func cleanupInactiveClients(ap *AudioProcessor) { // Передаем AudioProcessor
-	ticker := time.NewTicker(clientTimeout / 2)
+func cleanupInactiveClients() {
+	ticker := time.NewTicker(config.ClientTimeout / 2)
 	defer ticker.Stop()
 
 	for {
@@ -189,7 +252,7 @@ func cleanupInactiveClients(ap *AudioProcessor) { // Передаем AudioProce
 			}
 
 			timeSinceLastActivity := now.Sub(client.lastActivity)
-			if timeSinceLastActivity > clientTimeout {
+			if timeSinceLastActivity > config.ClientTimeout {
 				log.Printf("Отключаем неактивного клиента %s из войса (не было активности %.1f секунд)",
 					client.username, timeSinceLastActivity.Seconds())
 
@@ -197,8 +260,8 @@ func cleanupInactiveClients(ap *AudioProcessor) { // Передаем AudioProce
 				client.inVoice = false
 				client.active = false
 
-				ap.RemoveClient(client.username) // Удаляем из AudioProcessor
-			} else if timeSinceLastActivity > clientTimeout/2 {
+				client.room.audioProcessor.RemoveClient(client.username) // Удаляем из AudioProcessor комнаты
+			} else if timeSinceLastActivity > config.ClientTimeout/2 {
 				log.Printf("Предупреждение: клиент %s неактивен в войсе %.1f секунд",
 					client.username, timeSinceLastActivity.Seconds())
 			}
@@ -209,19 +272,21 @@ func cleanupInactiveClients(ap *AudioProcessor) { // Передаем AudioProce
 
 // New function to send heartbeats
 func sendHeartbeats(voiceConn net.PacketConn) {
-	ticker := time.NewTicker(heartbeatInterval)
+	ticker := time.NewTicker(config.HeartbeatInterval)
 	defer ticker.Stop()
 
-	heartbeat := []byte{0} // Single byte heartbeat packet
-
 	for {
 		<-ticker.C
 		clientsMux.RLock()
 		for _, client := range clients {
-			if client.inVoice {
+			if client.inVoice && client.voiceAddr != "" {
 				voiceAddr, err := net.ResolveUDPAddr("udp", client.voiceAddr)
 				if err == nil {
-					voiceConn.WriteTo(heartbeat, voiceAddr)
+					// Heartbeat - заголовок потока микса без нагрузки
+					client.mixMux.Lock()
+					header := client.mixStream.Heartbeat()
+					client.mixMux.Unlock()
+					voiceConn.WriteTo(protocol.AppendVoicePacket(nil, header, nil), voiceAddr)
 				}
 			}
 		}
@@ -230,215 +295,111 @@ func sendHeartbeats(voiceConn net.PacketConn) {
 }
 
 func handleVoiceData(voiceConn net.PacketConn) {
-	buffer := make([]byte, maxPacketSize)
-	audioProcessor := NewAudioProcessor()
+	buffer := make([]byte, protocol.VoiceHeaderSize+maxPacketSize)
 
 	log.Println("Обработчик голосовых данных запущен")
-	
-	// Счетчики для статистики
-	var packetsReceived int64
-	var packetsProcessed int64
-	var packetsSent int64 // Добавляем счетчик отправленных пакетов
-	var lastStatsTime = time.Now()
 
 	// Запускаем горутину очистки
-	go cleanupInactiveClients(audioProcessor) // Передаем audioProcessor
+	go cleanupInactiveClients()
 
 	// Запускаем горутину для отправки heartbeat
 	go sendHeartbeats(voiceConn)
 	
-	// Горутина для периодических логов статистики
-	go func() {
-		ticker := time.NewTicker(5 * time.Second)
-		defer ticker.Stop()
-		
-		for {
-			<-ticker.C
-			
-			clientsMux.RLock()
-			voiceClientsCount := 0
-			for _, client := range clients {
-				if client.inVoice && client.active {
-					voiceClientsCount++
-				}
-			}
-			clientsMux.RUnlock()
-			
-			currentTime := time.Now()
-			duration := currentTime.Sub(lastStatsTime).Seconds()
-			packetsPerSec := float64(packetsReceived) / duration
-			processedPerSec := float64(packetsProcessed) / duration
-			sentPerSec := float64(packetsSent) / duration
-			
-			if voiceClientsCount > 0 {
-				log.Printf("🎙️ Голосовой чат: %d активных клиентов | Получено: %.1f пак/сек | Обработано: %.1f пак/сек | Отправлено: %.1f пак/сек", 
-					voiceClientsCount, packetsPerSec, processedPerSec, sentPerSec)
-			}
-			
-			// Сбрасываем счетчики
-			packetsReceived = 0
-			packetsProcessed = 0
-			packetsSent = 0
-			lastStatsTime = currentTime
-		}
-	}()
-
-	// Горутина микшера с восстановлением после паники
-	go func() {
-		defer func() {
-			if r := recover(); r != nil {
-				log.Printf("Восстановление после паники микшера: %v", r)
-				go handleVoiceData(voiceConn) // Перезапускаем обработчик, передавая тот же voiceConn
-			}
-		}()
-
-		ticker := time.NewTicker(mixInterval)
-		defer ticker.Stop()
-
-		for {
-			<-ticker.C
-
-			clientsMux.RLock() // Блокируем для чтения списка клиентов
-
-			// Получаем список всех клиентов в голосовом чате
-			var voiceClients []*Client
-			for _, client := range clients {
-				if client.inVoice && client.encoder != nil {
-					voiceClients = append(voiceClients, client)
-				}
-			}
-			clientsMux.RUnlock()
-
-			// Если нет клиентов в войсе, очищаем буферы и продолжаем
-			if len(voiceClients) == 0 {
-				audioProcessor.mutex.Lock()
-				audioProcessor.buffers = make(map[string][]float32)
-				audioProcessor.mutex.Unlock()
-				continue
-			}
-
-			// Проверяем количество буферов для отладки
-			audioProcessor.mutex.RLock()
-			bufferCount := len(audioProcessor.buffers)
-			audioProcessor.mutex.RUnlock()
-			
-			// Пропускаем цикл если нет буферов для обработки
-			if bufferCount == 0 {
-				continue
-			}
-
-			// Процессируем аудио для каждого клиента
-			for _, client := range voiceClients {
-				var mixed []float32
-				
-				// ПЕРЕКРЕСТНОЕ ВОСПРОИЗВЕДЕНИЕ: клиент слышит ДРУГИХ, не себя
-				audioProcessor.mutex.RLock()
-				for clientID, clientBuffer := range audioProcessor.buffers {
-					if clientID != client.username { // Исключаем самого клиента
-						if mixed == nil {
-							mixed = make([]float32, len(clientBuffer))
-							copy(mixed, clientBuffer)
-						} else {
-							// Микшируем если несколько источников
-							for i := range mixed {
-								mixed[i] = (mixed[i] + clientBuffer[i]) * 0.5
-							}
-						}
-					}
-				}
-				audioProcessor.mutex.RUnlock()
-				
-				// Если нет данных от других клиентов, отправляем тишину
-				if mixed == nil {
-					mixed = make([]float32, frameSize)
-				}
-
-				// Convert to PCM
-				pcm := make([]int16, len(mixed))
-				for i, sample := range mixed {
-					// Ограничиваем диапазон значений
-					if sample > 1.0 {
-						sample = 1.0
-					} else if sample < -1.0 {
-						sample = -1.0
-					}
-					pcm[i] = int16(sample * 32767.0)
-				}
-
-				// Encode with Opus
-				encoded := make([]byte, maxPacketSize)
-				n, err := client.encoder.Encode(pcm, encoded)
-				if err != nil {
-					log.Printf("❌ Ошибка кодирования Opus для %s: %v", client.username, err)
-					continue
-				}
-
-				// Send to client
-				if n > 0 {
-					// Отправляем данные без шифрования
-					voiceAddr, err := net.ResolveUDPAddr("udp", client.voiceAddr)
-					if err == nil {
-						_, writeErr := voiceConn.WriteTo(encoded[:n], voiceAddr)
-						if writeErr != nil {
-							log.Printf("❌ Ошибка отправки пакета %s: %v", client.username, writeErr)
-						} else {
-							packetsSent++
-						}
-					} else {
-						log.Printf("❌ Ошибка разрешения адреса %s: %v", client.voiceAddr, err)
-					}
-				} else {
-					log.Printf("⚠️ Кодировщик вернул 0 байт для %s", client.username)
-				}
-			}
-		}
-	}()
+	// Битрейт клиентов для метрик
+	go updateBitrates()
 
 	// Main audio processing loop
 	for {
 		n, remoteAddr, err := voiceConn.ReadFrom(buffer)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
 		if err != nil {
 			log.Printf("Error reading voice data: %v", err)
 			continue
 		}
 		
-		packetsReceived++
+		packetsReceived.Add(1)
+
+		header, payload, err := protocol.ParseVoicePacket(buffer[:n])
+		if err != nil {
+			datagramsDropped.Inc(dropMalformed) // Пакеты без заголовка (старые клиенты) отбрасываем
+			continue
+		}
 
-		// Update client activity
 		clientsMux.Lock()
-		var sender *Client
-		for _, client := range clients {
-			if client.voiceAddr == remoteAddr.String() {
-				client.lastActivity = time.Now()
-				client.active = true
-				sender = client
-				break
-			}
+
+		// VoiceHello привязывает адрес к сессии по токену
+		if header.Kind == protocol.VoiceHello {
+			bindVoiceAddrLocked(remoteAddr, payload)
+			clientsMux.Unlock()
+			continue
 		}
 
-		if sender == nil {
-			senderIP := strings.Split(remoteAddr.String(), ":")[0]
-			for _, client := range clients {
-				if client.inVoice && strings.Split(client.addr.String(), ":")[0] == senderIP {
-					client.voiceAddr = remoteAddr.String()
-					sender = client
-					break
-				}
-			}
+		// Update client activity: остальные пакеты принимаем только с
+		// адресов, предъявивших токен
+		sender := voiceSenderLocked(remoteAddr)
+		if sender != nil {
+			sender.lastActivity = time.Now()
+			sender.active = true
 		}
 
 		if sender == nil || !sender.inVoice || sender.decoder == nil {
+			datagramsDropped.Inc(dropUnknownSender)
 			clientsMux.Unlock()
 			continue
 		}
 
-		// Handle heartbeat packets (если они приходят на голосовой порт)
-		if n == 1 && buffer[0] == 0 {
+		// Пакеты чужого потока не принимаем
+		if header.StreamID != sender.voiceStreamID {
+			datagramsDropped.Inc(dropWrongStream)
 			clientsMux.Unlock()
-			continue // Пропускаем heartbeat пакеты
+			continue
+		}
+
+		// Heartbeat только обновляет активность
+		if header.Kind == protocol.VoiceHeartbeat {
+			clientsMux.Unlock()
+			continue
+		}
+		sender.voiceBytes += int64(n)
+
+		// Голос заглушенного администратором клиента дальше не идет
+		if sender.serverMuted {
+			datagramsDropped.Inc(dropMuted)
+			clientsMux.Unlock()
+			continue
+		}
+
+		if len(payload) == 0 || len(payload) > maxPacketSize { // Проверка размера пакета
+			datagramsDropped.Inc(dropBadSize)
+			clientsMux.Unlock()
+			continue
+		}
+
+		// Дубликаты и опоздавшие пакеты отбрасываем, пропуски считаем потерями
+		if sender.voiceSeqStarted {
+			diff := protocol.SeqDiff(header.Seq, sender.lastVoiceSeq)
+			if diff <= 0 {
+				datagramsDropped.Inc(dropLate)
+				clientsMux.Unlock()
+				continue
+			}
+			if diff > 1 {
+				packetsLost.Add(int64(diff - 1))
+				// В режиме SFU потери восстанавливают слушатели
+				if config.Mode == ModeMCU {
+					concealLostFrames(sender, payload, diff-1)
+				}
+			}
 		}
+		sender.lastVoiceSeq = header.Seq
+		sender.voiceSeqStarted = true
 
-		if n > maxPacketSize { // Проверка размера пакета
+		// В режиме SFU пакет уходит остальным как есть, без декодирования
+		if config.Mode == ModeSFU {
+			forwardVoicePacket(voiceConn, sender, header, payload)
+			packetsProcessed.Add(1)
 			clientsMux.Unlock()
 			continue
 		}
@@ -446,11 +407,12 @@ func handleVoiceData(voiceConn net.PacketConn) {
 		// Decode audio
 		pcm := make([]int16, frameSize)
 		
-		// Декодируем полученные данные без расшифровки
-		samplesDecoded, err := sender.decoder.Decode(buffer[:n], pcm)
+		// Пакет уже расшифрован при приеме, декодируем
+		samplesDecoded, err := sender.decoder.Decode(payload, pcm)
 		if err != nil {
+			decodeErrors.Add(1)
 			log.Printf("❌ Ошибка декодирования Opus для %s: %v (размер: %d)", 
-				sender.username, err, len(buffer[:n]))
+				sender.username, err, len(payload))
 			clientsMux.Unlock()
 			continue
 		}
@@ -462,191 +424,588 @@ func handleVoiceData(voiceConn net.PacketConn) {
 			continue
 		}
 
-		// Convert to float32
-		floatPCM := make([]float32, frameSize)
-		for i, sample := range pcm {
-			floatPCM[i] = float32(sample) / 32767.0
-		}
-
-		// Add to audio processor
-		audioProcessor.AddBuffer(sender.username, floatPCM)
-		packetsProcessed++
+		// Add to audio processor комнаты отправителя
+		sender.room.audioProcessor.AddBuffer(sender.username, pcmToFloat32(pcm))
+		packetsProcessed.Add(1)
 		
 		clientsMux.Unlock()
 	}
 }
 
-func mainLoop(pc net.PacketConn, voiceConn net.PacketConn, audioProcessor *AudioProcessor) { // Передаем audioProcessor
+// voiceSenderLocked возвращает участника, от которого пришел голосовой
+// пакет. Пакет защищенного канала приписывается участнику сессии, ключом
+// которой он подтвержден, без шифрования (в тестах) - по привязанному
+// адресу. Вызывающий должен удерживать clientsMux.
+func voiceSenderLocked(remoteAddr net.Addr) *Client {
+	if session, ok := remoteAddr.(secure.SessionAddr); ok {
+		client, ok := clients[session.Control]
+		if !ok || client.voiceAddr != session.String() {
+			return nil
+		}
+		return client
+	}
+	for _, client := range clients {
+		if client.voiceAddr == remoteAddr.String() {
+			return client
+		}
+	}
+	return nil
+}
+
+// bindVoiceAddrLocked запоминает адрес голосового сокета клиента,
+// предъявившего токен голосовой сессии. Повторный VoiceHello с другого
+// адреса (например, после смены NAT) переносит привязку. Токен
+// принимается только из сессии его владельца.
+// Вызывающий должен удерживать clientsMux на запись.
+func bindVoiceAddrLocked(remoteAddr net.Addr, token []byte) {
+	var key [protocol.VoiceTokenSize]byte
+	if len(token) != len(key) {
+		return
+	}
+	copy(key[:], token)
+
+	client, ok := voiceSessions[key]
+	if !ok {
+		datagramsDropped.Inc(dropUnknownToken)
+		log.Printf("⚠️ Неизвестный токен голосовой сессии от %s", remoteAddr)
+		return
+	}
+	if session, ok := remoteAddr.(secure.SessionAddr); ok && clients[session.Control] != client {
+		datagramsDropped.Inc(dropUnknownToken)
+		log.Printf("⚠️ Токен голосовой сессии %s предъявлен из чужой сессии %s", client.username, session.Control)
+		return
+	}
+
+	addr := remoteAddr.String()
+	client.lastActivity = time.Now()
+	client.active = true
+	if client.voiceAddr == addr {
+		return
+	}
+
+	// Адрес мог достаться от другой сессии, у нее привязку снимаем
+	for _, other := range clients {
+		if other != client && other.voiceAddr == addr {
+			other.voiceAddr = ""
+		}
+	}
+	client.voiceAddr = addr
+	log.Printf("🔗 Голосовой адрес %s: %s", client.username, addr)
+}
+
+// listenUDP открывает UDP сокет и задает ему буфер приема из конфигурации
+func listenUDP(addr string) (net.PacketConn, error) {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if config.ReadBuffer > 0 {
+		if err := conn.(*net.UDPConn).SetReadBuffer(config.ReadBuffer); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// addrHost возвращает хост из адреса вида "host:port" или "[host]:port"
+func addrHost(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+// newVoiceToken создает случайный токен голосовой сессии
+func newVoiceToken() [protocol.VoiceTokenSize]byte {
+	var token [protocol.VoiceTokenSize]byte
+	if _, err := rand.Read(token[:]); err != nil {
+		log.Fatalf("Ошибка генерации токена голосовой сессии: %v", err)
+	}
+	return token
+}
+
+// concealLostFrames восстанавливает lost кадров, пропущенных перед пакетом
+// next: последний из них по FEC из next, предыдущие PLC декодера, если
+// пропуск не длиннее maxConcealFrames. Декодер должен получить кадры по
+// порядку, поэтому вызывается до декодирования next.
+// Вызывающий должен удерживать clientsMux.
+func concealLostFrames(sender *Client, next []byte, lost int) {
+	if lost-1 <= maxConcealFrames {
+		for i := 0; i < lost-1; i++ {
+			pcm := make([]int16, frameSize)
+			if err := sender.decoder.DecodePLC(pcm); err != nil {
+				break
+			}
+			sender.room.audioProcessor.AddBuffer(sender.username, pcmToFloat32(pcm))
+			packetsConcealed.Add(1)
+		}
+	}
+
+	pcm := make([]int16, frameSize)
+	if err := sender.decoder.DecodeFEC(next, pcm); err != nil {
+		return
+	}
+	sender.room.audioProcessor.AddBuffer(sender.username, pcmToFloat32(pcm))
+	packetsRecovered.Add(1)
+}
+
+// pcmToFloat32 переводит кадр PCM в диапазон [-1, 1]
+func pcmToFloat32(pcm []int16) []float32 {
+	floatPCM := make([]float32, len(pcm))
+	for i, sample := range pcm {
+		floatPCM[i] = float32(sample) / 32767.0
+	}
+	return floatPCM
+}
+
+// sendMessage упаковывает сообщение в кадр и отправляет его одному адресату
+func sendMessage(pc net.PacketConn, addr net.Addr, m protocol.Message) {
+	frame, err := protocol.Marshal(m)
+	if err != nil {
+		log.Printf("❌ Ошибка упаковки кадра %s: %v", m.Type(), err)
+		return
+	}
+	pc.WriteTo(frame, addr)
+}
+
+// broadcastMessage рассылает сообщение клиентам из members (всем clients
+// или участникам комнаты), кроме exclude.
+// Вызывающий должен удерживать clientsMux.
+func broadcastMessage(pc net.PacketConn, members map[string]*Client, m protocol.Message, exclude net.Addr) {
+	frame, err := protocol.Marshal(m)
+	if err != nil {
+		log.Printf("❌ Ошибка упаковки кадра %s: %v", m.Type(), err)
+		return
+	}
+	for _, client := range members {
+		if exclude != nil && client.addr.String() == exclude.String() {
+			continue
+		}
+		pc.WriteTo(frame, client.addr)
+	}
+}
+
+// validUsername проверяет имя пользователя: от minUsernameLen до
+// maxUsernameLen символов, только буквы, цифры, '_', '-', '.' и пробелы
+// внутри имени
+func validUsername(username string) bool {
+	length := utf8.RuneCountInString(username)
+	if length < minUsernameLen || length > maxUsernameLen {
+		return false
+	}
+	if strings.TrimSpace(username) != username {
+		return false
+	}
+	for _, r := range username {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) && !strings.ContainsRune("_-. ", r) {
+			return false
+		}
+	}
+	return true
+}
+
+// checkJoinLocked решает, можно ли впустить username с адреса clientKey.
+// Токен должен быть подписан ключом входа и выпущен на то же имя.
+// Повторный вход с того же адреса не считается занятым именем. Без
+// ключа сквозного шифрования участники не смогут писать клиенту.
+// Вызывающий должен удерживать clientsMux.
+func checkJoinLocked(clientKey, username, sessionToken string, identityKey [protocol.IdentityKeySize]byte) protocol.RejectReason {
+	if err := token.Verify(authKey, sessionToken, username, time.Now()); err != nil {
+		log.Printf("🔒 Токен %q (%s) не принят: %v", username, clientKey, err)
+		return protocol.RejectUnauthorized
+	}
+
+	if shuttingDown.Load() {
+		return protocol.RejectShuttingDown
+	}
+
+	if bannedLocked(username, clientKey) {
+		log.Printf("🔒 Вход %q (%s) заблокирован администратором", username, clientKey)
+		return protocol.RejectBanned
+	}
+
+	if !validUsername(username) {
+		return protocol.RejectInvalidName
+	}
+	if identityKey == ([protocol.IdentityKeySize]byte{}) {
+		return protocol.RejectNoIdentity
+	}
+
+	for key, client := range clients {
+		if key != clientKey && client.username == username {
+			return protocol.RejectNameTaken
+		}
+	}
+
+	if _, rejoin := clients[clientKey]; !rejoin && len(clients) >= config.MaxClients {
+		return protocol.RejectServerFull
+	}
+	return protocol.RejectNone
+}
+
+// removeClientLocked удаляет клиента с сервера: участники комнаты
+// получают Leave, токен голосовой сессии больше не действует.
+// Вызывающий должен удерживать clientsMux на запись.
+func removeClientLocked(pc net.PacketConn, client *Client) {
+	leaveRoomLocked(pc, client)
+	delete(voiceSessions, client.voiceToken)
+	delete(clients, client.addr.String())
+}
+
+// forgetPeer забывает состояние надежной доставки и сессию шифрования
+// ушедшего клиента. Вернувшись, он заново выполнит рукопожатие.
+func forgetPeer(pc net.PacketConn, addr net.Addr) {
+	if conn, ok := pc.(*reliable.Conn); ok {
+		conn.Forget(addr)
+	}
+	if transport != nil {
+		transport.Forget(addr)
+	}
+}
+
+// evictSilentClients раз в четверть config.ControlTimeout удаляет
+// клиентов, которые перестали выходить на связь
+func evictSilentClients(pc net.PacketConn) {
+	ticker := time.NewTicker(config.ControlTimeout / 4)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		evictSilent(pc, now)
+	}
+}
+
+// evictSilent удаляет клиентов, от которых дольше config.ControlTimeout
+// не было ни одного сообщения: процесс клиента завершился, не успев
+// отправить Leave, или пропала сеть. Участники комнаты получают Leave.
+func evictSilent(pc net.PacketConn, now time.Time) []*Client {
+	var evicted []*Client
+	clientsMux.Lock()
+	for _, client := range clients {
+		if now.Sub(client.lastSeen) > config.ControlTimeout {
+			removeClientLocked(pc, client)
+			evicted = append(evicted, client)
+		}
+	}
+	clientsMux.Unlock()
+
+	for _, client := range evicted {
+		forgetPeer(pc, client.addr)
+		log.Printf("⌛ %s (%s) не выходил на связь %s, удален из чата",
+			client.username, client.addr, now.Sub(client.lastSeen).Round(time.Second))
+	}
+	return evicted
+}
+
+func mainLoop(pc net.PacketConn, voiceConn net.PacketConn) {
 	log.Println("🚀 Главный цикл сервера запущен, ожидаем подключения...")
-	
+	go evictSilentClients(pc)
+
+	// Изображения приходят фрагментами, поэтому хватает буфера на один датаграм
+	buffer := make([]byte, 64*1024)
 	for {
-		buffer := make([]byte, 12*1024*1024) // Увеличиваем буфер до 12MB для изображений
 		n, addr, err := pc.ReadFrom(buffer)
+		if errors.Is(err, net.ErrClosed) || errors.Is(err, reliable.ErrClosed) {
+			return
+		}
 		if err != nil {
 			log.Printf("Ошибка чтения: %v", err)
 			continue
 		}
 
-		msg := string(buffer[:n])
 		clientKey := addr.String()
 
-		// Обработка нового подключения
-		if strings.Contains(msg, " joined the chat") {
-			username := strings.Split(msg, " joined the chat")[0]
-			clientIP := strings.Split(clientKey, ":")[0]
+		msg, err := protocol.Unmarshal(buffer[:n])
+		if err != nil {
+			datagramsDropped.Inc(dropMalformed)
+			log.Printf("⚠️ Некорректный кадр от %s: %v", clientKey, err)
+			continue
+		}
+
+		// Любое сообщение подтверждает, что клиент на связи
+		clientsMux.Lock()
+		if client, ok := clients[clientKey]; ok {
+			client.lastSeen = time.Now()
+		}
+		clientsMux.Unlock()
+
+		switch m := msg.(type) {
+		case *protocol.Keepalive:
+			// Отвечаем, чтобы клиент тоже знал, что сервер на связи
+			sendMessage(pc, addr, &protocol.Keepalive{})
+
+		case *protocol.Leave:
+			clientsMux.Lock()
+			client, ok := clients[clientKey]
+			if ok {
+				removeClientLocked(pc, client)
+			}
+			clientsMux.Unlock()
+			if ok {
+				forgetPeer(pc, addr)
+				log.Printf("👋 %s (%s) вышел из чата", client.username, clientKey)
+			}
+
+		case *protocol.Join:
+			// Обработка нового подключения
+			username := m.Username
+
+			clientsMux.Lock()
+			if reason := checkJoinLocked(clientKey, username, m.Token, m.IdentityKey); reason != protocol.RejectNone {
+				clientsMux.Unlock()
+				sendMessage(pc, addr, &protocol.JoinResult{Accepted: false, Reason: reason})
+				log.Printf("🚫 Отклонен вход %q (%s): %s", username, clientKey, reason)
+				continue
+			}
 
 			// Создаем кодеки Opus
 			decoder, err := opus.NewDecoder(sampleRate, channels)
 			if err != nil {
+				clientsMux.Unlock()
 				log.Printf("Ошибка создания декодера Opus: %v", err)
 				continue
 			}
 
 			encoder, err := opus.NewEncoder(sampleRate, channels, opus.AppVoIP)
 			if err != nil {
+				clientsMux.Unlock()
 				log.Printf("Ошибка создания энкодера Opus: %v", err)
 				continue
 			}
 
 			// Настраиваем энкодер для лучшего качества
-			encoder.SetBitrate(96000)     // Увеличиваем битрейт до 96 кбит/с
+			encoder.SetBitrate(config.Bitrate)
 			encoder.SetComplexity(10)     // Максимальное качество
 			encoder.SetPacketLossPerc(10) // Уменьшаем ожидаемые потери
 			encoder.SetInBandFEC(true)    // Включаем коррекцию ошибок
 
-			clientsMux.Lock()
-			
-			// Сначала отправляем новому пользователю список существующих участников
-			for _, existingClient := range clients {
-				joinMessage := existingClient.username + " joined the chat"
-				pc.WriteTo([]byte(joinMessage), addr)
-				log.Printf("📋 Отправляем новому пользователю %s информацию об участнике: %s", username, existingClient.username)
-				
-				// Если существующий участник в голосовом чате, тоже уведомляем
-				if existingClient.inVoice {
-					voiceMessage := existingClient.username + " подключился к голосовому чату"
-					pc.WriteTo([]byte(voiceMessage), addr)
-					log.Printf("🎤 Отправляем новому пользователю %s информацию о голосовом участнике: %s", username, existingClient.username)
-				}
+			// Повторный вход с того же адреса: убираем старую запись из
+			// комнаты, старый токен голосовой сессии больше не действует
+			if old, rejoin := clients[clientKey]; rejoin {
+				leaveRoomLocked(pc, old)
+				delete(voiceSessions, old.voiceToken)
 			}
-			
+
+			// Подтверждаем вход до списка участников, чтобы клиент получил
+			// ответ первым. Адрес голосового сокета клиент сообщит сам,
+			// предъявив токен в VoiceHello.
+			voiceToken := newVoiceToken()
+			sendMessage(pc, addr, &protocol.JoinResult{Accepted: true, VoiceToken: voiceToken})
+
 			// Теперь добавляем нового клиента
-			clients[clientKey] = &Client{
+			client := &Client{
 				addr:         addr,
 				username:     username,
 				inVoice:      false,
-				voiceAddr:    clientIP + ":6001",
 				decoder:      decoder,
 				encoder:      encoder,
 				lastActivity: time.Now(),
+				lastSeen:     time.Now(),
 				active:       true,
+				mixStream:    protocol.NewVoiceStream(protocol.MixStreamID),
+				limiter:      NewLimiter(limiterThreshold, limiterLookahead, limiterRelease),
+				voiceToken:   voiceToken,
+				identityKey:  m.IdentityKey,
 			}
-			
+			clients[clientKey] = client
+			voiceSessions[voiceToken] = client
+
+			// Каждый вошедший начинает с общей комнаты
+			joinRoomLocked(pc, client, rooms[defaultRoomName])
 			clientsMux.Unlock()
-			log.Printf("✨ Новый клиент: %s (%s) -> %s", username, clientIP, clientIP+":6001")
+			log.Printf("✨ Новый клиент: %s (%s)", username, clientKey)
 
-			// Уведомляем всех остальных о новом пользователе
-			clientsMux.RLock()
-			for _, client := range clients {
-				// Не отправляем самому себе
-				if client.addr.String() != addr.String() {
-					pc.WriteTo([]byte(msg), client.addr)
-				}
+		case *protocol.VoiceState:
+			// Обработка голосовых уведомлений
+			clientsMux.Lock()
+			client, ok := clients[clientKey]
+			if !ok {
+				log.Printf("❌ Изменение голосового состояния от неизвестного: %s", clientKey)
+				clientsMux.Unlock()
+				continue
 			}
-			clientsMux.RUnlock()
-			continue
-		}
 
-		// Обработка голосовых уведомлений
-		if msg == "VOICE_CONNECT" {
-			clientsMux.Lock()
-			if client, ok := clients[clientKey]; ok {
+			if m.Connected && !validStreamIDLocked(client, m.StreamID) {
+				// Чужой поток слушатели приписали бы не тому участнику
+				log.Printf("🚫 %s (%s) объявил недопустимый или занятый поток %d",
+					client.username, addrHost(clientKey), m.StreamID)
+				sendMessage(pc, client.addr, &protocol.Error{Message: "Недопустимый идентификатор голосового потока, переподключитесь к голосовому чату"})
+				clientsMux.Unlock()
+				continue
+			}
+
+			if m.Connected {
 				client.inVoice = true
 				client.lastActivity = time.Now()
-				notification := client.username + " подключился к голосовому чату"
+				client.voiceStreamID = m.StreamID
+				client.voiceSeqStarted = false
 				log.Printf("🎤 %s (%s) вошёл в голосовой чат",
-					client.username, strings.Split(clientKey, ":")[0])
-
-				// Уведомляем всех о подключении к голосовому чату
-				for _, c := range clients {
-					pc.WriteTo([]byte(notification), c.addr)
-				}
+					client.username, addrHost(clientKey))
 			} else {
-				log.Printf("❌ Попытка подключения от неизвестного: %s", clientKey)
+				client.inVoice = false
+				client.voiceStreamID = 0
+				client.room.audioProcessor.RemoveClient(client.username) // Удаляем из AudioProcessor комнаты
+				log.Printf("🔇 %s (%s) вышел из голосового чата",
+					client.username, addrHost(clientKey))
 			}
+
+			// Уведомляем комнату об изменении голосового состояния
+			broadcastMessage(pc, client.room.members, &protocol.VoiceState{
+				Username:  client.username,
+				Connected: m.Connected,
+				StreamID:  client.voiceStreamID,
+			}, nil)
 			clientsMux.Unlock()
-			continue
-		}
 
-		if msg == "VOICE_DISCONNECT" {
-			clientsMux.Lock()
-			if client, ok := clients[clientKey]; ok {
-				client.inVoice = false
-				audioProcessor.RemoveClient(client.username) // Удаляем из AudioProcessor
-				notification := client.username + " отключился от голосового чата"
-				log.Printf("🔇 %s (%s) вышел из голосового чата",
-					client.username, strings.Split(clientKey, ":")[0])
+		case *protocol.Chat:
+			// Рассылаем обычные сообщения участникам комнаты отправителя
+			clientsMux.RLock()
+			sender, ok := clients[clientKey]
+			if !ok {
+				clientsMux.RUnlock()
+				log.Printf("⚠️ Сообщение от неподключенного адреса %s отброшено", clientKey)
+				continue
+			}
 
-				// Уведомляем всех об отключении от голосового чата
-				for _, c := range clients {
-					pc.WriteTo([]byte(notification), c.addr)
-				}
+			// Имя отправителя берем из записи клиента, а не из кадра.
+			// Текст зашифрован для участников, сервер его не видит.
+			m.Sender = sender.username
+			log.Printf("Сообщение от %s (%s) в %q: %d байт шифротекста", m.Sender, clientKey, sender.room.name, len(m.Ciphertext))
+			broadcastMessage(pc, sender.room.members, m, nil)
+			clientsMux.RUnlock()
+
+		case *protocol.ImageChunk:
+			// Фрагменты пересылаются сразу, без сборки изображения на сервере
+			clientsMux.RLock()
+			sender, ok := clients[clientKey]
+			if !ok {
+				clientsMux.RUnlock()
+				log.Printf("⚠️ Фрагмент изображения от неподключенного адреса %s отброшен", clientKey)
+				continue
 			}
-			clientsMux.Unlock()
-			continue
-		}
 
-		// Рассылаем обычные сообщения всем клиентам
-		log.Printf("Сообщение от %s: %s", clientKey, msg)
-		
-		// Проверяем, является ли это сообщением с изображением
-		if strings.Contains(msg, "]: IMAGE_DATA:") {
-			log.Printf("📷 Обрабатываем изображение от %s, размер: %d байт", clientKey, len(msg))
-		}
-		
-		clientsMux.RLock()
-		for _, client := range clients {
-			pc.WriteTo([]byte(msg), client.addr)
+			m.Sender = sender.username
+			if m.Index == 0 {
+				log.Printf("📷 Пересылаем изображение от %s: %d байт, %d фрагментов", m.Sender, m.TotalSize, m.Count)
+			}
+			broadcastMessage(pc, sender.room.members, m, nil)
+			clientsMux.RUnlock()
+
+		case *protocol.Room:
+			clientsMux.RLock()
+			client, ok := clients[clientKey]
+			clientsMux.RUnlock()
+			if !ok {
+				log.Printf("⚠️ Запрос комнат от неподключенного адреса %s отброшен", clientKey)
+				continue
+			}
+			handleRoomRequest(pc, voiceConn, client, m)
+
+		default:
+			log.Printf("⚠️ Неожиданный кадр %s от %s", msg.Type(), clientKey)
 		}
-		clientsMux.RUnlock()
 	}
 }
 
 func main() {
+	// Подкоманда для администратора работающего сервера
+	if len(os.Args) > 1 && os.Args[1] == "admin" {
+		os.Exit(runAdmin(os.Args[2:]))
+	}
+
+	var err error
+	config, err = loadConfig(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		log.Fatalf("Ошибка конфигурации: %v", err)
+	}
+	log.Printf("⚙️ Конфигурация: %s", config)
+
 	// Создаем канал для обработки сигналов завершения
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 
-	pc, err := net.ListenPacket("udp", ":6000")
+	// Без ключа невозможно проверить ни один токен, а вход без токена запрещен
+	authKey, err = token.ParsePublicKey(os.Getenv("AIRCHAT_AUTH_PUBLIC_KEY"))
+	if err != nil {
+		log.Fatalf("Не задан ключ для проверки сессионных токенов (переменная окружения AIRCHAT_AUTH_PUBLIC_KEY): %v", err)
+	}
+
+	// Долговременным ключом сервер подписывает рукопожатия, по его
+	// отпечатку клиенты узнают сервер
+	identity, err := secure.LoadOrCreateIdentity(config.IdentityKey)
+	if err != nil {
+		log.Fatalf("Ошибка загрузки ключа сервера: %v", err)
+	}
+	transport = secure.NewServer(identity)
+	log.Printf("🔑 Отпечаток ключа сервера: %s", secure.Fingerprint(transport.PublicKey()))
+
+	// Пустой хост - сокет двойного стека: принимает и IPv6, и IPv4 клиентов
+	rawConn, err := listenUDP(config.ControlAddr())
 	if err != nil {
 		log.Fatalf("Ошибка запуска сервера: %v", err)
 	}
+
+	// Управляющий канал с надежной упорядоченной доставкой поверх
+	// шифрования, голосовой трафик шифруется, но остается ненадежным
+	pc := reliable.New(transport.Control(rawConn))
 	defer pc.Close()
 
-	voiceConn, err := net.ListenPacket("udp", ":6001")
+	rawVoiceConn, err := listenUDP(config.VoiceAddr())
 	if err != nil {
 		pc.Close()
 		log.Fatal("Ошибка запуска голосового сервера:", err)
 	}
+	voiceConn := transport.Voice(rawVoiceConn)
+	defer voiceConn.Close()
 
-	// Отложенная очистка ресурсов
-	defer cleanup(pc, voiceConn)
+	log.Printf("Сервер запущен на %s", rawConn.LocalAddr())
+	log.Printf("Голосовой сервер запущен на %s в режиме %s", voiceConn.LocalAddr(), config.Mode)
 
-	log.Println("Сервер запущен на порту :6000")
-	log.Println("Голосовой сервер запущен на порту :6001")
-
-	audioProcessor := NewAudioProcessor() // Создаем AudioProcessor здесь
+	// Общая комната существует всегда, у нее свой микшер
+	clientsMux.Lock()
+	createRoomLocked(defaultRoomName, voiceConn)
+	clientsMux.Unlock()
 
 	// Запускаем обработку голосовых данных в отдельной горутине
-	go handleVoiceData(voiceConn) // AudioProcessor будет создан внутри handleVoiceData
+	go handleVoiceData(voiceConn)
+
+	// Метрики для Prometheus
+	if config.MetricsAddr != "" {
+		go serveMetrics(config.MetricsAddr)
+		log.Printf("📈 Метрики: http://%s/metrics", config.MetricsAddr)
+	}
 
-	// Горутина для обработки сигналов завершения
+	// Команды администратора: server admin list, kick, mute, ban...
+	var adminListener net.Listener
+	if config.AdminSocket != "" {
+		adminListener, err = listenAdmin(config.AdminSocket)
+		if err != nil {
+			log.Fatalf("Ошибка запуска сокета администратора: %v", err)
+		}
+		defer adminListener.Close()
+		go serveAdmin(adminListener, pc)
+		log.Printf("👮 Сокет администратора: %s", config.AdminSocket)
+	}
+
+	// Горутина для остановки по сигналу или команде администратора
 	go func() {
-		<-sigChan
-		cleanup(pc, voiceConn)
+		req := shutdownRequest{restartIn: config.RestartHint}
+		select {
+		case sig := <-sigChan:
+			log.Printf("Получен сигнал %s", sig)
+		case req = <-shutdownRequests:
+		}
+		if adminListener != nil {
+			adminListener.Close() // Удаляет файл сокета
+		}
+		cleanup(pc, voiceConn, req)
 		os.Exit(0)
 	}()
 
-	mainLoop(pc, voiceConn, audioProcessor) // Передаем audioProcessor в mainLoop
+	mainLoop(pc, voiceConn)
 }
 
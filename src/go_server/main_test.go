@@ -0,0 +1,207 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"testing"
+	"time"
+
+	"airchat/protocol"
+	"airchat/protocol/reliable"
+	"airchat/protocol/secure"
+	"airchat/protocol/token"
+)
+
+// listenLoopback открывает UDP сокет на ::1 или пропускает тест, если
+// IPv6 на машине выключен
+func listenLoopback(t *testing.T) net.PacketConn {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "[::1]:0")
+	if err != nil {
+		t.Skipf("IPv6 недоступен: %v", err)
+	}
+	return conn
+}
+
+// useTestAuthKey задает ключ проверки токенов на время теста и
+// возвращает закрытый ключ для их выпуска
+func useTestAuthKey(t *testing.T) ed25519.PrivateKey {
+	t.Helper()
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authKey = public
+	t.Cleanup(func() { authKey = nil })
+	return private
+}
+
+func TestSecureJoinAndVoiceOverIPv6(t *testing.T) {
+	authPrivate := useTestAuthKey(t)
+
+	_, identity, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport := secure.NewServer(identity)
+
+	pc := reliable.New(transport.Control(listenLoopback(t)))
+	defer pc.Close()
+	voiceConn := transport.Voice(listenLoopback(t))
+	defer voiceConn.Close()
+
+	clientsMux.Lock()
+	if _, ok := rooms[defaultRoomName]; !ok {
+		createRoomLocked(defaultRoomName, voiceConn)
+	}
+	clientsMux.Unlock()
+
+	go mainLoop(pc, voiceConn)
+
+	secureConn, err := secure.Dial(listenLoopback(t), pc.LocalAddr(), nil, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientConn := reliable.New(secureConn)
+	defer clientConn.Close()
+	clientKey := clientConn.LocalAddr().String()
+	defer func() {
+		clientsMux.Lock()
+		if client, ok := clients[clientKey]; ok {
+			leaveRoomLocked(pc, client)
+			delete(voiceSessions, client.voiceToken)
+			delete(clients, clientKey)
+		}
+		clientsMux.Unlock()
+	}()
+
+	sessionToken, err := token.Sign(authPrivate, "alice", time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sendMessage(clientConn, pc.LocalAddr(), &protocol.Join{Username: "alice", Token: sessionToken, IdentityKey: [protocol.IdentityKeySize]byte{1}})
+
+	// Первым сервер присылает ответ на вход
+	clientConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 64*1024)
+	n, _, err := clientConn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := protocol.Unmarshal(buf[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, ok := msg.(*protocol.JoinResult)
+	if !ok || !result.Accepted {
+		t.Fatalf("ответ на вход: %#v", msg)
+	}
+
+	// Голосовой сокет клиента предъявляет токен с адреса ::1
+	voiceUDP, err := net.DialUDP("udp", nil, voiceConn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer voiceUDP.Close()
+	voiceClient := secureConn.Voice(voiceUDP)
+	hello := protocol.AppendVoicePacket(nil, protocol.NewVoiceStream(1).Hello(), result.VoiceToken[:])
+	if _, err := voiceClient.Write(hello); err != nil {
+		t.Fatal(err)
+	}
+
+	voiceConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, remoteAddr, err := voiceConn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, payload, err := protocol.ParseVoicePacket(buf[:n])
+	if err != nil || header.Kind != protocol.VoiceHello {
+		t.Fatalf("пакет %+v: %v", header, err)
+	}
+
+	clientsMux.Lock()
+	bindVoiceAddrLocked(remoteAddr, payload)
+	client := clients[clientKey]
+	clientsMux.Unlock()
+
+	if client == nil {
+		t.Fatalf("клиент %s не зарегистрирован", clientKey)
+	}
+	if got := addrHost(client.voiceAddr); got != "::1" {
+		t.Errorf("голосовой адрес %q, ожидался хост ::1", client.voiceAddr)
+	}
+	if _, err := net.ResolveUDPAddr("udp", client.voiceAddr); err != nil {
+		t.Errorf("голосовой адрес не разбирается: %v", err)
+	}
+}
+
+func TestEvictSilent(t *testing.T) {
+	alice := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 50000}
+	bob := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 50000}
+	room := addAdminTestClients(t, map[string]*net.UDPAddr{"alice": alice, "bob": bob})
+	conn := &recordingConn{sent: make(map[string][]byte)}
+
+	now := time.Now()
+	clientsMux.Lock()
+	clients[alice.String()].lastSeen = now.Add(-config.ControlTimeout - time.Second)
+	clients[bob.String()].lastSeen = now.Add(-protocol.KeepaliveInterval)
+	clientsMux.Unlock()
+
+	evicted := evictSilent(conn, now)
+	if len(evicted) != 1 || evicted[0].username != "alice" {
+		t.Fatalf("удалены %v, ожидалась только alice", evicted)
+	}
+	if _, ok := clients[alice.String()]; ok || room.members[alice.String()] != nil {
+		t.Error("молчащий клиент остался на сервере")
+	}
+	if msg, _ := protocol.Unmarshal(conn.sent[bob.String()]); !isLeave(msg, "alice") {
+		t.Errorf("bob получил %#v вместо Leave", msg)
+	}
+}
+
+func TestCleanupNotifiesClients(t *testing.T) {
+	authPrivate := useTestAuthKey(t)
+	defer shuttingDown.Store(false)
+
+	alice := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 50000}
+	bob := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 50000}
+	addAdminTestClients(t, map[string]*net.UDPAddr{"alice": alice, "bob": bob})
+	conn := &recordingConn{sent: make(map[string][]byte)}
+
+	cleanup(conn, &recordingConn{}, shutdownRequest{reason: "обновление", restartIn: 1500 * time.Millisecond})
+
+	for _, addr := range []*net.UDPAddr{alice, bob} {
+		msg, err := protocol.Unmarshal(conn.sent[addr.String()])
+		shutdown, ok := msg.(*protocol.Shutdown)
+		if err != nil || !ok || shutdown.Reason != "обновление" || shutdown.RestartIn != 2 {
+			t.Errorf("%s получил %#v, %v", addr, msg, err)
+		}
+	}
+
+	// Новые входы после начала остановки отклоняются
+	sessionToken, err := token.Sign(authPrivate, "carol", time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientsMux.Lock()
+	reason := checkJoinLocked("10.0.0.3:50000", "carol", sessionToken, [protocol.IdentityKeySize]byte{1})
+	clientsMux.Unlock()
+	if reason != protocol.RejectShuttingDown {
+		t.Errorf("вход во время остановки: %s", reason)
+	}
+}
+
+func TestAddrHost(t *testing.T) {
+	tests := []struct{ addr, want string }{
+		{"192.168.1.5:6000", "192.168.1.5"},
+		{"[::1]:6000", "::1"},
+		{"[fe80::1%eth0]:6001", "fe80::1%eth0"},
+		{"нет порта", "нет порта"},
+	}
+	for _, tt := range tests {
+		if got := addrHost(tt.addr); got != tt.want {
+			t.Errorf("addrHost(%q) = %q, ожидалось %q", tt.addr, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Метрики сервера отдаются на /metrics в текстовом формате Prometheus.
+// Счетчики атомарные: их меняют обработчик приема голоса, микшеры всех
+// комнат и главный цикл.
+
+// bitrateWindow - период пересчета битрейта клиентов
+const bitrateWindow = 5 * time.Second
+
+// Причины, по которым сервер отбрасывает датаграммы
+const (
+	dropMalformed     = "malformed"      // Не разбирается заголовок пакета или кадр
+	dropUnknownToken  = "unknown_token"  // VoiceHello с неизвестным токеном
+	dropUnknownSender = "unknown_sender" // Голос с непривязанного адреса или не из войса
+	dropWrongStream   = "wrong_stream"   // Пакет не того потока, что объявлен клиентом
+	dropBadSize       = "bad_size"       // Пустая или слишком большая нагрузка Opus
+	dropLate          = "late"           // Дубликат или пакет после более нового
+	dropMuted         = "muted"          // Голос заглушен администратором
+)
+
+var (
+	packetsReceived  atomic.Int64
+	packetsProcessed atomic.Int64
+	packetsSent      atomic.Int64
+	packetsLost      atomic.Int64 // Пропуски в номерах пакетов
+	packetsRecovered atomic.Int64 // Потерянные кадры, восстановленные по FEC
+	packetsConcealed atomic.Int64 // Потерянные кадры, замаскированные PLC
+	framesDropped    atomic.Int64 // Кадры, выброшенные из очередей микшера: устарели или очередь полна
+	decodeErrors     atomic.Int64
+	encodeErrors     atomic.Int64
+
+	datagramsDropped = newLabeledCounter(dropMalformed, dropUnknownToken, dropUnknownSender,
+		dropWrongStream, dropBadSize, dropLate, dropMuted)
+
+	// Длительность такта микшера: при 20мс на такт все, что дольше,
+	// означает отставание
+	mixerTickSeconds = newHistogram(0.0005, 0.001, 0.002, 0.005, 0.01, 0.02, 0.05)
+)
+
+// labeledCounter - счетчики с одной меткой из набора, известного заранее.
+// Карта после создания только читается, поэтому блокировка не нужна.
+type labeledCounter map[string]*atomic.Int64
+
+func newLabeledCounter(labels ...string) labeledCounter {
+	c := make(labeledCounter, len(labels))
+	for _, label := range labels {
+		c[label] = new(atomic.Int64)
+	}
+	return c
+}
+
+func (c labeledCounter) Inc(label string) {
+	c[label].Add(1)
+}
+
+// histogram - гистограмма с фиксированными границами корзин
+type histogram struct {
+	bounds []float64
+
+	mu     sync.Mutex
+	counts []uint64 // По корзинам, не накопительно; последняя - +Inf
+	sum    float64
+	count  uint64
+}
+
+func newHistogram(bounds ...float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]uint64, len(bounds)+1)}
+}
+
+func (h *histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.bounds, v) // Первая граница >= v
+	h.mu.Lock()
+	h.counts[i]++
+	h.sum += v
+	h.count++
+	h.mu.Unlock()
+}
+
+func (h *histogram) write(w io.Writer, name, help string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+	var cumulative uint64
+	for i, bound := range h.bounds {
+		cumulative += h.counts[i]
+		fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", name, formatFloat(bound), cumulative)
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, h.count)
+	fmt.Fprintf(w, "%s_sum %s\n%s_count %d\n", name, formatFloat(h.sum), name, h.count)
+}
+
+func writeMetric(w io.Writer, kind, name, help string, value float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %s\n", name, help, name, kind, name, formatFloat(value))
+}
+
+// writeLabeled пишет метрику с одной меткой, значения отсортированы по
+// метке
+func writeLabeled(w io.Writer, kind, name, help, label string, values map[string]float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(w, "%s{%s=\"%s\"} %s\n", name, label, escapeLabel(key), formatFloat(values[key]))
+	}
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return fmt.Sprint(v)
+}
+
+// writeMetrics пишет все метрики сервера
+func writeMetrics(w io.Writer) {
+	clientsMux.RLock()
+	connected, voice := len(clients), 0
+	roomCount := len(rooms)
+	bitrates := make(map[string]float64)
+	for _, client := range clients {
+		if client.inVoice {
+			voice++
+			bitrates[client.username] = client.bitrate
+		}
+	}
+	clientsMux.RUnlock()
+
+	writeMetric(w, "gauge", "airchat_clients", "Подключенные клиенты.", float64(connected))
+	writeMetric(w, "gauge", "airchat_voice_clients", "Клиенты в голосовом чате.", float64(voice))
+	writeMetric(w, "gauge", "airchat_rooms", "Комнаты, включая общую.", float64(roomCount))
+
+	writeMetric(w, "counter", "airchat_voice_packets_received_total", "Принятые голосовые датаграммы.", float64(packetsReceived.Load()))
+	writeMetric(w, "counter", "airchat_voice_packets_processed_total", "Голосовые пакеты, переданные в микшер или переотправленные (SFU).", float64(packetsProcessed.Load()))
+	writeMetric(w, "counter", "airchat_voice_packets_sent_total", "Отправленные голосовые пакеты.", float64(packetsSent.Load()))
+	writeMetric(w, "counter", "airchat_voice_packets_lost_total", "Пропуски в номерах голосовых пакетов.", float64(packetsLost.Load()))
+	writeMetric(w, "counter", "airchat_voice_frames_recovered_total", "Потерянные кадры, восстановленные по FEC.", float64(packetsRecovered.Load()))
+	writeMetric(w, "counter", "airchat_voice_frames_concealed_total", "Потерянные кадры, замаскированные PLC.", float64(packetsConcealed.Load()))
+	writeMetric(w, "counter", "airchat_mixer_frames_dropped_total", "Кадры, выброшенные из очередей микшера.", float64(framesDropped.Load()))
+	writeMetric(w, "counter", "airchat_opus_decode_errors_total", "Ошибки декодирования Opus.", float64(decodeErrors.Load()))
+	writeMetric(w, "counter", "airchat_opus_encode_errors_total", "Ошибки кодирования Opus.", float64(encodeErrors.Load()))
+
+	dropped := make(map[string]float64, len(datagramsDropped))
+	for reason, c := range datagramsDropped {
+		dropped[reason] = float64(c.Load())
+	}
+	writeLabeled(w, "counter", "airchat_datagrams_dropped_total", "Отброшенные датаграммы по причине.", "reason", dropped)
+
+	mixerTickSeconds.write(w, "airchat_mixer_tick_seconds", "Длительность такта микшера комнаты.")
+	writeLabeled(w, "gauge", "airchat_client_bitrate_bits_per_second", "Входящий битрейт голоса клиента за последние 5 секунд.", "username", bitrates)
+}
+
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	writeMetrics(w)
+}
+
+// serveMetrics отдает /metrics на addr
+func serveMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", metricsHandler)
+	server := &http.Server{Addr: addr, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	if err := server.ListenAndServe(); err != nil {
+		log.Printf("❌ Сервер метрик остановлен: %v", err)
+	}
+}
+
+// updateBitrates раз в bitrateWindow пересчитывает входящий битрейт голоса
+// каждого клиента по принятым байтам
+func updateBitrates() {
+	ticker := time.NewTicker(bitrateWindow)
+	defer ticker.Stop()
+
+	last := time.Now()
+	for now := range ticker.C {
+		elapsed := now.Sub(last).Seconds()
+		last = now
+
+		clientsMux.Lock()
+		for _, client := range clients {
+			client.bitrate = float64(client.voiceBytes-client.lastVoiceBytes) * 8 / elapsed
+			client.lastVoiceBytes = client.voiceBytes
+		}
+		clientsMux.Unlock()
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHistogramBuckets(t *testing.T) {
+	h := newHistogram(0.001, 0.01)
+	for _, v := range []float64{0.0005, 0.001, 0.005, 0.5} {
+		h.Observe(v)
+	}
+
+	var out strings.Builder
+	h.write(&out, "tick_seconds", "Такт.")
+	for _, want := range []string{
+		`tick_seconds_bucket{le="0.001"} 2`, // Граница входит в корзину
+		`tick_seconds_bucket{le="0.01"} 3`,
+		`tick_seconds_bucket{le="+Inf"} 4`,
+		"tick_seconds_sum 0.5065",
+		"tick_seconds_count 4",
+	} {
+		if !strings.Contains(out.String(), want+"\n") {
+			t.Errorf("нет строки %q в\n%s", want, out.String())
+		}
+	}
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	clientsMux.Lock()
+	alice := &Client{addr: &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1}, username: `al"ice`, inVoice: true, bitrate: 32000}
+	clients["metrics-test"] = alice
+	clientsMux.Unlock()
+	defer func() {
+		clientsMux.Lock()
+		delete(clients, "metrics-test")
+		clientsMux.Unlock()
+	}()
+	datagramsDropped.Inc(dropWrongStream)
+
+	rec := httptest.NewRecorder()
+	metricsHandler(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body := rec.Body.String()
+
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("Content-Type %q", ct)
+	}
+	for _, want := range []string{
+		"# TYPE airchat_clients gauge",
+		"# TYPE airchat_voice_packets_received_total counter",
+		"# TYPE airchat_mixer_tick_seconds histogram",
+		`airchat_client_bitrate_bits_per_second{username="al\"ice"} 32000`,
+		`airchat_datagrams_dropped_total{reason="muted"} `,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("нет %q в выводе:\n%s", want, body)
+		}
+	}
+	if strings.Contains(body, `reason="wrong_stream"} 0`) {
+		t.Error("счетчик отброшенных датаграмм не вырос")
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"math"
+	"time"
+)
+
+const (
+	limiterThreshold = 0.89                  // Потолок выхода микшера, около -1 dBFS
+	limiterLookahead = 96                    // Упреждение лимитера в сэмплах, 2мс
+	limiterRelease   = 50 * time.Millisecond // Время восстановления усиления после пика
+)
+
+// mixAudio складывает кадры источников с одинаковым весом в out.
+// Без источников out заполняется тишиной. Перегрузку суммы убирает
+// Limiter слушателя.
+func mixAudio(out []float32, sources [][]float32) {
+	clear(out)
+	for _, src := range sources {
+		for i := range out {
+			if i < len(src) {
+				out[i] += src[i]
+			}
+		}
+	}
+}
+
+// gainAt - требуемое усиление для сэмпла с номером n
+type gainAt struct {
+	n    int64
+	gain float32
+}
+
+// Limiter - лимитер с упреждением. Сигнал задерживается на lookahead
+// сэмплов, а усиление заранее плавно снижается так, чтобы к выходу пика
+// амплитуда не превышала threshold. После пика усиление возвращается к
+// единице с постоянной времени release. У каждого слушателя свой
+// Limiter: состояние переходит из кадра в кадр.
+type Limiter struct {
+	threshold float32
+	attack    float32 // Коэффициент сглаживания при снижении усиления
+	release   float32 // Коэффициент сглаживания при восстановлении
+
+	delay []float32 // Линия задержки на lookahead сэмплов
+	pos   int
+
+	// Монотонная очередь минимумов требуемого усиления по окну упреждения
+	window []gainAt
+	n      int64
+
+	gain float32
+}
+
+func NewLimiter(threshold float32, lookahead int, release time.Duration) *Limiter {
+	return &Limiter{
+		threshold: threshold,
+		// За время упреждения усиление проходит 99% пути до требуемого
+		attack:  float32(math.Pow(0.01, 1/float64(lookahead))),
+		release: float32(math.Exp(-1 / (release.Seconds() * sampleRate))),
+		delay:   make([]float32, lookahead),
+		gain:    1,
+	}
+}
+
+// Process ограничивает кадр на месте. Выход задержан на lookahead сэмплов.
+func (l *Limiter) Process(buf []float32) {
+	lookahead := int64(len(l.delay))
+
+	for i, x := range buf {
+		// Усиление, при котором этот сэмпл не превысит порог
+		required := float32(1)
+		if a := float32(math.Abs(float64(x))); a > l.threshold {
+			required = l.threshold / a
+		}
+
+		// Минимум требуемого усиления по сэмплам от выходящего до входящего
+		for len(l.window) > 0 && l.window[len(l.window)-1].gain >= required {
+			l.window = l.window[:len(l.window)-1]
+		}
+		l.window = append(l.window, gainAt{n: l.n, gain: required})
+		for l.window[0].n < l.n-lookahead {
+			l.window = l.window[1:]
+		}
+		target := l.window[0].gain
+
+		if target < l.gain {
+			l.gain = target + (l.gain-target)*l.attack
+		} else {
+			l.gain = target + (l.gain-target)*l.release
+		}
+
+		delayed := l.delay[l.pos]
+		l.delay[l.pos] = x
+		l.pos = (l.pos + 1) % len(l.delay)
+
+		// Остаток сглаживания срезаем жестко, выше порога выход не уходит
+		y := delayed * l.gain
+		if y > l.threshold {
+			y = l.threshold
+		} else if y < -l.threshold {
+			y = -l.threshold
+		}
+		buf[i] = y
+		l.n++
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+// sine возвращает кадр синусоиды с амплитудой amp и частотой freq
+func sine(amp, freq float64, offset int) []float32 {
+	f := make([]float32, frameSize)
+	for i := range f {
+		f[i] = float32(amp * math.Sin(2*math.Pi*freq*float64(offset+i)/sampleRate))
+	}
+	return f
+}
+
+func TestMixAudioEqualWeights(t *testing.T) {
+	// Три говорящих: каждый должен войти в микс с одинаковым весом,
+	// независимо от порядка источников
+	a, b, c := frame(0.1), frame(0.2), frame(0.3)
+
+	for _, order := range [][][]float32{{a, b, c}, {c, a, b}, {b, c, a}} {
+		out := make([]float32, frameSize)
+		mixAudio(out, order)
+		for i, v := range out {
+			if math.Abs(float64(v)-0.6) > 1e-6 {
+				t.Fatalf("сэмпл %d: %v, ожидалось 0.6", i, v)
+			}
+		}
+	}
+}
+
+func TestMixAudioSilence(t *testing.T) {
+	out := frame(0.7) // Старые данные должны быть затерты
+	mixAudio(out, nil)
+	for i, v := range out {
+		if v != 0 {
+			t.Fatalf("сэмпл %d: %v, ожидалась тишина", i, v)
+		}
+	}
+}
+
+func TestLimiterPassesQuietSignal(t *testing.T) {
+	l := NewLimiter(limiterThreshold, limiterLookahead, limiterRelease)
+
+	var in, out []float32
+	for k := 0; k < 5; k++ {
+		f := sine(0.5, 440, k*frameSize)
+		in = append(in, f...)
+		processed := append([]float32(nil), f...)
+		l.Process(processed)
+		out = append(out, processed...)
+	}
+
+	// Сигнал ниже порога только задерживается на время упреждения
+	for i := limiterLookahead; i < len(out); i++ {
+		if math.Abs(float64(out[i]-in[i-limiterLookahead])) > 1e-6 {
+			t.Fatalf("сэмпл %d изменен: %v вместо %v", i, out[i], in[i-limiterLookahead])
+		}
+	}
+}
+
+func TestLimiterCapsLoudMix(t *testing.T) {
+	l := NewLimiter(limiterThreshold, limiterLookahead, limiterRelease)
+
+	// Три громких голоса в сумме дают амплитуду около 2.4
+	for k := 0; k < 50; k++ {
+		sources := [][]float32{
+			sine(0.8, 220, k*frameSize),
+			sine(0.8, 330, k*frameSize),
+			sine(0.8, 550, k*frameSize),
+		}
+		out := make([]float32, frameSize)
+		mixAudio(out, sources)
+		l.Process(out)
+
+		for i, v := range out {
+			if math.Abs(float64(v)) > limiterThreshold+1e-6 {
+				t.Fatalf("кадр %d, сэмпл %d: %v выше порога %v", k, i, v, limiterThreshold)
+			}
+		}
+	}
+}
+
+func TestLimiterAttacksBeforePeak(t *testing.T) {
+	l := NewLimiter(limiterThreshold, limiterLookahead, limiterRelease)
+
+	// Одиночный скачок до 2.0 на ровном сигнале 0.5: благодаря упреждению
+	// усиление плавно снижено еще до выхода пика, а не срезано в последний
+	// момент
+	f := frame(0.5)
+	spike := 400
+	f[spike] = 2.0
+	l.Process(f)
+
+	got := f[spike+limiterLookahead]
+	if math.Abs(float64(got)-limiterThreshold) > 0.02 {
+		t.Errorf("пик на выходе %v, ожидалось около %v", got, limiterThreshold)
+	}
+	before := f[spike+limiterLookahead-1]
+	if before > 0.5*limiterThreshold/2.0*1.05 {
+		t.Errorf("сэмпл перед пиком %v не ослаблен заранее", before)
+	}
+	if early := f[spike-1]; early < 0.49 {
+		t.Errorf("сэмпл задолго до пика %v ослаблен раньше упреждения", early)
+	}
+}
+
+func TestLimiterReleases(t *testing.T) {
+	l := NewLimiter(limiterThreshold, limiterLookahead, limiterRelease)
+
+	loud := frame(2.0)
+	l.Process(loud)
+
+	// Через полсекунды тихого сигнала усиление вернулось к единице
+	var out []float32
+	for k := 0; k < 25; k++ {
+		out = frame(0.25)
+		l.Process(out)
+	}
+	if math.Abs(float64(out[frameSize-1])-0.25) > 1e-3 {
+		t.Errorf("усиление не восстановилось: %v вместо 0.25", out[frameSize-1])
+	}
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"log"
+	"net"
+	"sort"
+	"time"
+
+	"airchat/protocol"
+)
+
+const defaultRoomName = "general" // Общая комната, в которую попадают все при входе
+
+// Room - комната со своим текстовым чатом и своим голосовым микшером
+type Room struct {
+	name           string
+	members        map[string]*Client // ключ - адрес управляющего канала
+	audioProcessor *AudioProcessor
+	stop           chan struct{} // закрывается при удалении комнаты
+}
+
+// rooms защищен clientsMux, как и clients
+var rooms = make(map[string]*Room)
+
+// createRoomLocked создает комнату и в режиме MCU запускает ее микшер.
+// Вызывающий должен удерживать clientsMux на запись.
+func createRoomLocked(name string, voiceConn net.PacketConn) *Room {
+	room := &Room{
+		name:           name,
+		members:        make(map[string]*Client),
+		audioProcessor: NewAudioProcessor(),
+		stop:           make(chan struct{}),
+	}
+	rooms[name] = room
+	// В режиме SFU сводить нечего, пакеты пересылает handleVoiceData
+	if config.Mode == ModeMCU {
+		go room.runMixer(voiceConn)
+	}
+	log.Printf("🏠 Создана комната %q", name)
+	return room
+}
+
+// joinRoomLocked добавляет клиента в комнату: отправляет ему состав
+// комнаты с ключами участников и уведомляет участников о новом
+// пользователе.
+// Вызывающий должен удерживать clientsMux на запись.
+func joinRoomLocked(pc net.PacketConn, client *Client, room *Room) {
+	sendMessage(pc, client.addr, &protocol.RoomJoined{Name: room.name})
+
+	// Сначала отправляем новому пользователю список участников комнаты
+	for _, member := range room.members {
+		sendMessage(pc, client.addr, &protocol.Join{Username: member.username, IdentityKey: member.identityKey})
+
+		// Если участник в голосовом чате, тоже уведомляем
+		if member.inVoice {
+			sendMessage(pc, client.addr, &protocol.VoiceState{Username: member.username, Connected: true, StreamID: member.voiceStreamID})
+		}
+	}
+
+	// Уведомляем участников о новом пользователе
+	broadcastMessage(pc, room.members, &protocol.Join{Username: client.username, IdentityKey: client.identityKey}, nil)
+	if client.inVoice {
+		broadcastMessage(pc, room.members, &protocol.VoiceState{Username: client.username, Connected: true, StreamID: client.voiceStreamID}, nil)
+	}
+
+	room.members[client.addr.String()] = client
+	client.room = room
+	log.Printf("🏠 %s вошёл в комнату %q (%d участников)", client.username, room.name, len(room.members))
+}
+
+// leaveRoomLocked убирает клиента из текущей комнаты и удаляет опустевшую
+// комнату, кроме общей. Вызывающий должен удерживать clientsMux на запись.
+func leaveRoomLocked(pc net.PacketConn, client *Client) {
+	room := client.room
+	if room == nil {
+		return
+	}
+
+	delete(room.members, client.addr.String())
+	room.audioProcessor.RemoveClient(client.username)
+	client.room = nil
+
+	broadcastMessage(pc, room.members, &protocol.Leave{Username: client.username}, nil)
+	log.Printf("🏠 %s вышел из комнаты %q", client.username, room.name)
+
+	if len(room.members) == 0 && room.name != defaultRoomName {
+		delete(rooms, room.name)
+		close(room.stop)
+		log.Printf("🏠 Комната %q удалена: в ней никого не осталось", room.name)
+	}
+}
+
+// moveToRoomLocked переводит клиента в другую комнату. Клиенту приходят
+// Leave для участников старой комнаты, чтобы он очистил список.
+// Вызывающий должен удерживать clientsMux на запись.
+func moveToRoomLocked(pc net.PacketConn, client *Client, room *Room) {
+	if old := client.room; old != nil {
+		for key, member := range old.members {
+			if key != client.addr.String() {
+				sendMessage(pc, client.addr, &protocol.Leave{Username: member.username})
+			}
+		}
+		leaveRoomLocked(pc, client)
+	}
+	joinRoomLocked(pc, client, room)
+}
+
+// handleRoomRequest выполняет команды /rooms, /create, /join и /part
+func handleRoomRequest(pc, voiceConn net.PacketConn, client *Client, m *protocol.Room) {
+	clientsMux.Lock()
+	defer clientsMux.Unlock()
+
+	switch m.Action {
+	case protocol.RoomActionList:
+		list := &protocol.RoomList{Rooms: make([]protocol.RoomInfo, 0, len(rooms))}
+		for _, room := range rooms {
+			list.Rooms = append(list.Rooms, protocol.RoomInfo{Name: room.name, Members: uint32(len(room.members))})
+		}
+		sort.Slice(list.Rooms, func(i, j int) bool { return list.Rooms[i].Name < list.Rooms[j].Name })
+		sendMessage(pc, client.addr, list)
+
+	case protocol.RoomActionCreate:
+		if !validUsername(m.Name) {
+			sendMessage(pc, client.addr, &protocol.Error{Message: "Недопустимое название комнаты"})
+			return
+		}
+		if _, exists := rooms[m.Name]; exists {
+			sendMessage(pc, client.addr, &protocol.Error{Message: "Комната " + m.Name + " уже существует"})
+			return
+		}
+		if len(rooms) >= config.MaxRooms {
+			sendMessage(pc, client.addr, &protocol.Error{Message: "Достигнут лимит комнат на сервере"})
+			return
+		}
+		moveToRoomLocked(pc, client, createRoomLocked(m.Name, voiceConn))
+
+	case protocol.RoomActionJoin:
+		room, exists := rooms[m.Name]
+		if !exists {
+			sendMessage(pc, client.addr, &protocol.Error{Message: "Комната " + m.Name + " не найдена"})
+			return
+		}
+		if room == client.room {
+			sendMessage(pc, client.addr, &protocol.Error{Message: "Вы уже в комнате " + m.Name})
+			return
+		}
+		moveToRoomLocked(pc, client, room)
+
+	case protocol.RoomActionLeave:
+		if client.room != nil && client.room.name == defaultRoomName {
+			sendMessage(pc, client.addr, &protocol.Error{Message: "Вы уже в общей комнате"})
+			return
+		}
+		moveToRoomLocked(pc, client, rooms[defaultRoomName])
+
+	default:
+		log.Printf("⚠️ Неизвестное действие с комнатами %d от %s", m.Action, client.username)
+	}
+}
+
+// runMixer микширует голос участников комнаты каждые mixInterval и
+// рассылает каждому участнику микс остальных
+func (r *Room) runMixer(voiceConn net.PacketConn) {
+	// Восстановление после паники микшера
+	defer func() {
+		if rec := recover(); rec != nil {
+			log.Printf("Восстановление после паники микшера комнаты %q: %v", r.name, rec)
+			go r.runMixer(voiceConn) // Перезапускаем микшер, передавая тот же voiceConn
+		}
+	}()
+
+	ticker := time.NewTicker(mixInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.stop:
+			return
+		case <-ticker.C:
+		}
+
+		start := time.Now()
+		if r.mixTick(voiceConn) {
+			mixerTickSeconds.Observe(time.Since(start).Seconds())
+		}
+	}
+}
+
+// mixTick сводит один кадр для каждого слушателя комнаты. Возвращает
+// false, если сводить было нечего.
+func (r *Room) mixTick(voiceConn net.PacketConn) bool {
+	// Слушатели и их голосовые адреса копируем под clientsMux: адрес
+	// меняет каждый VoiceHello
+	type listener struct {
+		client    *Client
+		voiceAddr string
+	}
+	clientsMux.RLock()
+	var voiceClients []listener
+	for _, client := range r.members {
+		if client.inVoice && client.encoder != nil && client.voiceAddr != "" {
+			voiceClients = append(voiceClients, listener{client: client, voiceAddr: client.voiceAddr})
+		}
+	}
+	clientsMux.RUnlock()
+
+	// Если нет клиентов в войсе, очищаем очереди и продолжаем
+	if len(voiceClients) == 0 {
+		r.audioProcessor.Reset()
+		return false
+	}
+
+	// По одному кадру от каждого говорящего на этот такт
+	frames := r.audioProcessor.NextFrames(time.Now())
+
+	// Пропускаем такт, если никто не говорит
+	if len(frames) == 0 {
+		return false
+	}
+
+	// Процессируем аудио для каждого клиента
+	sources := make([][]float32, 0, len(frames))
+	for _, listener := range voiceClients {
+		client := listener.client
+		// ПЕРЕКРЕСТНОЕ ВОСПРОИЗВЕДЕНИЕ: клиент слышит ДРУГИХ, не себя
+		sources = sources[:0]
+		for clientID, clientBuffer := range frames {
+			if clientID != client.username { // Исключаем самого клиента
+				sources = append(sources, clientBuffer)
+			}
+		}
+
+		// Все говорящие с одинаковым весом, перегрузку убирает лимитер
+		// слушателя. Без других говорящих получается тишина.
+		mixed := make([]float32, frameSize)
+		mixAudio(mixed, sources)
+		client.mixMux.Lock()
+		client.limiter.Process(mixed)
+
+		// Convert to PCM
+		pcm := make([]int16, len(mixed))
+		for i, sample := range mixed {
+			// Ограничиваем диапазон значений
+			if sample > 1.0 {
+				sample = 1.0
+			} else if sample < -1.0 {
+				sample = -1.0
+			}
+			pcm[i] = int16(sample * 32767.0)
+		}
+
+		// Encode with Opus
+		encoded := make([]byte, maxPacketSize)
+		n, err := client.encoder.Encode(pcm, encoded)
+		var header protocol.VoiceHeader
+		if err == nil && n > 0 {
+			header = client.mixStream.Next(frameSize)
+		}
+		client.mixMux.Unlock()
+		if err != nil {
+			encodeErrors.Add(1)
+			log.Printf("❌ Ошибка кодирования Opus для %s: %v", client.username, err)
+			continue
+		}
+
+		// Send to client
+		if n > 0 {
+			// Отправляем микс, voiceConn шифрует его ключом сессии слушателя
+			voiceAddr, err := net.ResolveUDPAddr("udp", listener.voiceAddr)
+			if err == nil {
+				packet := protocol.AppendVoicePacket(nil, header, encoded[:n])
+				_, writeErr := voiceConn.WriteTo(packet, voiceAddr)
+				if writeErr != nil {
+					log.Printf("❌ Ошибка отправки пакета %s: %v", client.username, writeErr)
+				} else {
+					packetsSent.Add(1)
+				}
+			} else {
+				log.Printf("❌ Ошибка разрешения адреса %s: %v", listener.voiceAddr, err)
+			}
+		} else {
+			log.Printf("⚠️ Кодировщик вернул 0 байт для %s", client.username)
+		}
+	}
+	return true
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+
+	"airchat/protocol"
+)
+
+// VoiceMode - способ доставки голоса слушателям
+type VoiceMode string
+
+const (
+	// ModeMCU - сервер декодирует всех говорящих, сводит микс для каждого
+	// слушателя и кодирует его заново
+	ModeMCU VoiceMode = "mcu"
+
+	// ModeSFU - сервер не трогает звук и пересылает пакеты каждого
+	// говорящего остальным участникам комнаты. Пакет сохраняет заголовок
+	// с идентификатором потока отправителя, декодирует и сводит клиент.
+	ModeSFU VoiceMode = "sfu"
+)
+
+func parseVoiceMode(s string) (VoiceMode, error) {
+	switch mode := VoiceMode(s); mode {
+	case ModeMCU, ModeSFU:
+		return mode, nil
+	}
+	return "", fmt.Errorf("неизвестный режим голоса %q (ожидается %s или %s)", s, ModeMCU, ModeSFU)
+}
+
+// String и Set позволяют задавать режим флагом -mode
+func (m *VoiceMode) String() string {
+	return string(*m)
+}
+
+func (m *VoiceMode) Set(s string) error {
+	mode, err := parseVoiceMode(s)
+	if err != nil {
+		return err
+	}
+	*m = mode
+	return nil
+}
+
+// validStreamIDLocked проверяет поток, который client объявляет при входе
+// в голосовой чат: он не совпадает с потоком микса и не занят другим
+// клиентом. Потоки уникальны на всем сервере, чтобы не совпасть и после
+// перехода в другую комнату. Вызывающий должен удерживать clientsMux.
+func validStreamIDLocked(client *Client, id uint32) bool {
+	if id == protocol.MixStreamID {
+		return false
+	}
+	for _, other := range clients {
+		if other != client && other.inVoice && other.voiceStreamID == id {
+			return false
+		}
+	}
+	return true
+}
+
+// forwardVoicePacket пересылает пакет sender всем остальным участникам
+// его комнаты, которые сейчас в голосовом чате. Поток в заголовке уже
+// проверен handleVoiceData: пакеты с чужим потоком сюда не доходят.
+// Вызывающий должен удерживать clientsMux.
+func forwardVoicePacket(voiceConn net.PacketConn, sender *Client, header protocol.VoiceHeader, payload []byte) {
+	packet := protocol.AppendVoicePacket(nil, header, payload)
+
+	for _, member := range sender.room.members {
+		if member == sender || !member.inVoice || member.voiceAddr == "" {
+			continue
+		}
+
+		voiceAddr, err := net.ResolveUDPAddr("udp", member.voiceAddr)
+		if err != nil {
+			log.Printf("❌ Ошибка разрешения адреса %s: %v", member.voiceAddr, err)
+			continue
+		}
+		if _, err := voiceConn.WriteTo(packet, voiceAddr); err != nil {
+			log.Printf("❌ Ошибка пересылки пакета %s -> %s: %v", sender.username, member.username, err)
+			continue
+		}
+		packetsSent.Add(1)
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"airchat/protocol"
+)
+
+// recordingConn запоминает, кому и что отправлено
+type recordingConn struct {
+	sent map[string][]byte
+}
+
+func (c *recordingConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	c.sent[addr.String()] = append([]byte(nil), p...)
+	return len(p), nil
+}
+
+func (c *recordingConn) ReadFrom(p []byte) (int, net.Addr, error) { return 0, nil, net.ErrClosed }
+func (c *recordingConn) Close() error                             { return nil }
+func (c *recordingConn) LocalAddr() net.Addr                      { return &net.UDPAddr{} }
+func (c *recordingConn) SetDeadline(time.Time) error              { return nil }
+func (c *recordingConn) SetReadDeadline(time.Time) error          { return nil }
+func (c *recordingConn) SetWriteDeadline(time.Time) error         { return nil }
+
+func TestForwardVoicePacket(t *testing.T) {
+	room := &Room{name: "test", members: make(map[string]*Client)}
+	add := func(name, voiceAddr string, inVoice bool) *Client {
+		c := &Client{username: name, voiceAddr: voiceAddr, inVoice: inVoice, room: room}
+		room.members[name] = c
+		return c
+	}
+	sender := add("alice", "127.0.0.1:7001", true)
+	sender.voiceStreamID = 42
+	add("bob", "127.0.0.1:7002", true)
+	add("carol", "127.0.0.1:7003", false)
+
+	header := protocol.VoiceHeader{Kind: protocol.VoiceAudio, Seq: 7, Timestamp: 960, StreamID: 42}
+	conn := &recordingConn{sent: make(map[string][]byte)}
+	forwardVoicePacket(conn, sender, header, []byte{1, 2, 3})
+
+	if len(conn.sent) != 1 {
+		t.Fatalf("пакет отправлен %d адресатам: %v", len(conn.sent), conn.sent)
+	}
+	want := protocol.AppendVoicePacket(nil, header, []byte{1, 2, 3})
+	got, ok := conn.sent["127.0.0.1:7002"]
+	if !ok || !bytes.Equal(got, want) {
+		t.Errorf("bob получил %v, ожидался %v", got, want)
+	}
+}
+
+func TestValidStreamID(t *testing.T) {
+	alice := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 50000}
+	bob := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 50000}
+	addAdminTestClients(t, map[string]*net.UDPAddr{"alice": alice, "bob": bob})
+
+	clientsMux.Lock()
+	defer clientsMux.Unlock()
+	a, b := clients[alice.String()], clients[bob.String()]
+	a.inVoice, a.voiceStreamID = true, 42
+
+	if validStreamIDLocked(b, protocol.MixStreamID) {
+		t.Error("принят поток микса")
+	}
+	if validStreamIDLocked(b, 42) {
+		t.Error("принят поток другого участника")
+	}
+	if !validStreamIDLocked(a, 42) || !validStreamIDLocked(b, 43) {
+		t.Error("не принят свободный поток")
+	}
+}
+
+func TestParseVoiceMode(t *testing.T) {
+	for _, s := range []string{"mcu", "sfu"} {
+		if mode, err := parseVoiceMode(s); err != nil || string(mode) != s {
+			t.Errorf("parseVoiceMode(%q) = %q, %v", s, mode, err)
+		}
+	}
+	if _, err := parseVoiceMode("p2p"); err == nil {
+		t.Error("неизвестный режим принят")
+	}
+}
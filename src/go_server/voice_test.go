@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"airchat/protocol/secure"
+)
+
+func TestBindVoiceAddr(t *testing.T) {
+	clientsMux.Lock()
+	defer clientsMux.Unlock()
+
+	alice := &Client{username: "alice", voiceToken: newVoiceToken()}
+	bob := &Client{username: "bob", voiceToken: newVoiceToken()}
+	clients["alice"], clients["bob"] = alice, bob
+	voiceSessions[alice.voiceToken] = alice
+	voiceSessions[bob.voiceToken] = bob
+	defer func() {
+		delete(clients, "alice")
+		delete(clients, "bob")
+		delete(voiceSessions, alice.voiceToken)
+		delete(voiceSessions, bob.voiceToken)
+	}()
+
+	// Оба клиента за одним NAT: IP совпадает, различаются только токены
+	first := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 50000}
+	second := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 50001}
+
+	bindVoiceAddrLocked(first, alice.voiceToken[:])
+	bindVoiceAddrLocked(second, bob.voiceToken[:])
+	if alice.voiceAddr != first.String() || bob.voiceAddr != second.String() {
+		t.Fatalf("адреса alice=%q bob=%q", alice.voiceAddr, bob.voiceAddr)
+	}
+
+	// Неизвестный или обрезанный токен ничего не привязывает
+	unknown := newVoiceToken()
+	third := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 50002}
+	bindVoiceAddrLocked(third, unknown[:])
+	bindVoiceAddrLocked(third, alice.voiceToken[:4])
+	if alice.voiceAddr != first.String() {
+		t.Errorf("привязка без действительного токена: %q", alice.voiceAddr)
+	}
+
+	// NAT отдал порт alice клиенту bob: привязка переезжает
+	bindVoiceAddrLocked(first, bob.voiceToken[:])
+	if bob.voiceAddr != first.String() || alice.voiceAddr != "" {
+		t.Errorf("после переезда alice=%q bob=%q", alice.voiceAddr, bob.voiceAddr)
+	}
+}
+
+func TestVoiceSenderBySession(t *testing.T) {
+	alice := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 50000}
+	bob := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 50000}
+	addAdminTestClients(t, map[string]*net.UDPAddr{"alice": alice, "bob": bob})
+
+	clientsMux.Lock()
+	defer clientsMux.Unlock()
+	aliceClient, bobClient := clients[alice.String()], clients[bob.String()]
+
+	voice := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 50001}
+	fromAlice := secure.SessionAddr{Addr: voice, Control: alice.String()}
+	fromBob := secure.SessionAddr{Addr: voice, Control: bob.String()}
+
+	// Токен alice из сессии bob не принимается
+	bindVoiceAddrLocked(fromBob, aliceClient.voiceToken[:])
+	if aliceClient.voiceAddr != "" {
+		t.Fatalf("токен alice привязан из сессии bob: %q", aliceClient.voiceAddr)
+	}
+
+	bindVoiceAddrLocked(fromAlice, aliceClient.voiceToken[:])
+	if got := voiceSenderLocked(fromAlice); got != aliceClient {
+		t.Fatalf("голос alice приписан %v", got)
+	}
+
+	// Даже если адреса разошлись с сессиями, голос сессии bob не
+	// достается alice
+	bobClient.voiceAddr = voice.String()
+	if got := voiceSenderLocked(fromBob); got != bobClient {
+		t.Errorf("голос bob приписан %v", got)
+	}
+	if got := voiceSenderLocked(secure.SessionAddr{Addr: voice, Control: "10.0.0.3:50000"}); got != nil {
+		t.Errorf("голос неизвестной сессии приписан %s", got.username)
+	}
+}
@@ -14,6 +14,7 @@ if (require("electron-squirrel-startup")) {
 let mainWindow;
 let goClientProcess = null; // Переменная для хранения процесса Go клиента
 let goServerProcess = null; // Переменная для хранения процесса Go сервера
+let currentUsername = null; // Пользователь, вошедший по паролю, для обновления токена
 let db = null; // База данных SQLite
 
 // Инициализация базы данных
@@ -88,9 +89,52 @@ async function verifyPassword(password, salt, hash) {
   return await bcrypt.compare(password + salt, hash);
 }
 
-// Генерация токена сессии
-function generateSessionToken() {
-  return crypto.randomBytes(64).toString("hex");
+// Срок действия токена сессии
+const SESSION_TOKEN_TTL_SECONDS = 12 * 60 * 60;
+
+// Закрытый ключ Ed25519 для подписи токенов сессии. Он есть только у
+// стороны, которая проверяет пароли: файл в формате PEM задает
+// AIRCHAT_AUTH_KEY_FILE (например, openssl genpkey -algorithm ed25519).
+// Ключ не создается автоматически: серверу нужен открытый ключ того, кто
+// выпускает токены, а не свой у каждой установки.
+function getAuthKey() {
+  const keyPath = process.env.AIRCHAT_AUTH_KEY_FILE;
+  if (!keyPath) {
+    return null;
+  }
+  return crypto.createPrivateKey(require("fs").readFileSync(keyPath));
+}
+
+// Открытый ключ для проверки токенов Go сервером (AIRCHAT_AUTH_PUBLIC_KEY).
+// Задается явно или выводится из закрытого ключа, если он есть.
+function getAuthPublicKey() {
+  if (process.env.AIRCHAT_AUTH_PUBLIC_KEY) {
+    return process.env.AIRCHAT_AUTH_PUBLIC_KEY;
+  }
+  const key = getAuthKey();
+  if (!key) {
+    return null;
+  }
+  return crypto.createPublicKey(key).export({ format: "jwk" }).x;
+}
+
+// Генерация токена сессии: base64url(JSON) + "." + base64url(подпись Ed25519).
+// Формат проверяется Go сервером (src/go_protocol/token).
+function generateSessionToken(username) {
+  const key = getAuthKey();
+  if (!key) {
+    throw new Error("не задан ключ подписи токенов (AIRCHAT_AUTH_KEY_FILE)");
+  }
+  const payload = Buffer.from(
+    JSON.stringify({
+      sub: username,
+      exp: Math.floor(Date.now() / 1000) + SESSION_TOKEN_TTL_SECONDS,
+    })
+  ).toString("base64url");
+  const signature = crypto
+    .sign(null, Buffer.from(payload), key)
+    .toString("base64url");
+  return `${payload}.${signature}`;
 }
 
 // Функция для получения правильного пути к ресурсам
@@ -134,6 +178,75 @@ function getResourcePath(relativePath) {
   return finalPath;
 }
 
+// Обработка служебных строк Go клиента о результате входа на сервер и
+// о завершении сессии администратором.
+// Возвращает остальной вывод без служебных строк.
+function handleClientStatusLines(output) {
+  const rest = [];
+  for (const line of output.split("\n")) {
+    const trimmed = line.trim();
+    if (trimmed === "JOIN_ACCEPTED") {
+      console.log("✅ Сервер принял вход");
+      continue;
+    }
+    if (trimmed.startsWith("JOIN_REJECTED:")) {
+      const reason = trimmed.slice("JOIN_REJECTED:".length);
+      console.log("🚫 Сервер отклонил вход:", reason);
+      showJoinRejected(reason);
+      continue;
+    }
+    if (trimmed.startsWith("CONNECTION:")) {
+      // connecting, connected или reconnecting
+      const state = trimmed.slice("CONNECTION:".length);
+      console.log("🔌 Состояние подключения:", state);
+      if (mainWindow) {
+        mainWindow.webContents.send("connection-state", state);
+      }
+      continue;
+    }
+    if (trimmed === "TOKEN_EXPIRED") {
+      // Сервер не принял токен при переподключении: выпускаем новый для
+      // того же пользователя, клиент возьмет его в следующей попытке
+      refreshSessionToken();
+      continue;
+    }
+    if (trimmed.startsWith("DISCONNECTED:")) {
+      const reason = trimmed.slice("DISCONNECTED:".length);
+      console.log("🚫 Сервер завершил сессию:", reason);
+      showJoinRejected(reason);
+      continue;
+    }
+    rest.push(line);
+  }
+  return rest.join("\n").trim();
+}
+
+// Передает Go клиенту новый токен сессии взамен истекшего. Без ключа
+// подписи обновить токен нельзя, пользователь входит заново.
+function refreshSessionToken() {
+  if (!goClientProcess || !currentUsername) return;
+  try {
+    const token = generateSessionToken(currentUsername);
+    goClientProcess.stdin.write(`/token ${token}\n`);
+    console.log("🔑 Токен сессии обновлен");
+  } catch (error) {
+    console.error("Не удалось обновить токен сессии:", error);
+    goClientProcess.stdin.write("/exit\n");
+    showJoinRejected("срок действия входа истек, войдите снова");
+  }
+}
+
+// Возвращаемся на страницу входа и показываем причину отказа
+function showJoinRejected(reason) {
+  if (!mainWindow) return;
+  mainWindow.loadFile(path.join(__dirname, "register.html"));
+  mainWindow.webContents.once("did-finish-load", () => {
+    if (mainWindow) {
+      mainWindow.webContents.send("join-rejected", reason);
+    }
+  });
+}
+
 const createWindow = () => {
   // Create the browser window.
   mainWindow = new BrowserWindow({
@@ -189,115 +302,17 @@ app.on("activate", () => {
   }
 });
 
-// Обработка событий от страницы регистрации
-ipcMain.on("create-room", (event, data) => {
-  console.log("Creating room:", data);
-
-  // Запускаем Go сервер
-  const serverPath = getResourcePath("bin/server.exe");
-  goServerProcess = spawn(serverPath, [], {
-    detached: true,
-    stdio: "pipe",
-  });
-
-  goServerProcess.stdout.on("data", (data) => {
-    console.log(`[SERVER] ${data.toString()}`);
-  });
-
-  goServerProcess.stderr.on("data", (data) => {
-    console.error(`[SERVER ERROR] ${data.toString()}`);
-  });
-
-  goServerProcess.on("error", (err) => {
-    console.error(`Failed to start Go server: ${err}`);
-    goServerProcess = null;
-  });
-
-  goServerProcess.on("close", (code) => {
-    console.log(`Go server process exited with code ${code}`);
-    goServerProcess = null;
-  });
-
-  // Небольшая задержка для запуска сервера, затем запускаем клиент
-  setTimeout(() => {
-    // Проверяем, что клиент не запущен уже
-    if (goClientProcess) {
-      console.log("Go client already running.");
-      mainWindow.loadFile(path.join(__dirname, "index.html"));
-      return;
-    }
-
-    const clientPath = getResourcePath("bin/client.exe");
-
-    // Устанавливаем переменные окружения для дочернего процесса
-    const env = { ...process.env, SERVER_IP: data.ip, USERNAME: data.name };
-
-    console.log(`🔧 [DEBUG] Запускаем клиент с параметрами:`);
-    console.log(`   SERVER_IP: ${data.ip}`);
-    console.log(`   USERNAME: ${data.name}`);
-
-    // Запускаем Go клиент с использованием spawn
-    goClientProcess = spawn(clientPath, [], { env: env });
-
-    // Обработка вывода Go клиента
-    goClientProcess.stdout.on("data", (data) => {
-      console.log("[DEBUG] Go client stdout (raw):", data);
-      console.log("[DEBUG] Go client stdout (string):", data.toString());
-      console.log("[DEBUG] Go client stdout (length):", data.length);
-      console.log("[DEBUG] Go client stdout (hex):", data.toString("hex"));
-
-      const message = data.toString().trim(); // Добавим trim для очистки
-      console.log("[DEBUG] Message after trim:", `"${message}"`);
-
-      // Фильтруем отладочные сообщения
-      if (message.includes("[DEBUG]")) {
-        console.log("🔧 [CLIENT DEBUG]:", message);
-        return; // Не отправляем отладочные сообщения в UI
-      }
-
-      // Проверяем, что сообщение не пустое
-      if (message.length === 0) {
-        console.log("[DEBUG] Empty message, skipping");
-        return;
-      }
-
-      console.log("[DEBUG] Sending message to renderer:", `"${message}"`);
-
-      // Отправляем только обычные сообщения в рендерер-процесс
-      if (mainWindow) {
-        mainWindow.webContents.send("display-chat-message", message);
-      }
-    });
-
-    goClientProcess.stderr.on("data", (data) => {
-      console.error(`Go client stderr: ${data}`);
-    });
-
-    goClientProcess.on("error", (err) => {
-      console.error(`Failed to start Go client process: ${err}`);
-      goClientProcess = null;
-    });
-
-    goClientProcess.on("close", (code) => {
-      console.log(`Go client process exited with code ${code}`);
-      goClientProcess = null;
-    });
-
-    // После запуска клиента переходим на страницу чата
-    mainWindow.loadFile(path.join(__dirname, "index.html"));
-
-    // Отправляем имя пользователя в рендерер-процесс
-    setTimeout(() => {
-      if (mainWindow) {
-        mainWindow.webContents.send("set-username", data.name);
-      }
-    }, 1000); // Небольшая задержка, чтобы страница успела загрузиться
-  }, 2000); // Даем серверу 2 секунды на запуск
-});
-
 // Новый обработчик 'join-room' для запуска Go клиента через spawn
 ipcMain.on("join-room", (event, data) => {
-  console.log("Joining room:", data);
+  console.log("Joining room:", data.ip, data.name);
+
+  // Сервер впускает только с токеном, выданным после входа по паролю
+  if (!data.token) {
+    console.error("join-room без токена сессии, нужен вход по паролю");
+    showJoinRejected("сначала войдите по паролю");
+    return;
+  }
+  currentUsername = data.name;
 
   // Получаем локальный IP для сравнения
   const interfaces = os.networkInterfaces();
@@ -319,11 +334,12 @@ ipcMain.on("join-room", (event, data) => {
   if (isLocalServer && !goServerProcess) {
     console.log("Запускаем локальный сервер для подключения...");
 
-    // Запускаем Go сервер
+    // Запускаем Go сервер. Ключ подписи токенов уже проверен при входе.
     const serverPath = getResourcePath("bin/server.exe");
     goServerProcess = spawn(serverPath, [], {
       detached: true,
       stdio: "pipe",
+      env: { ...process.env, AIRCHAT_AUTH_PUBLIC_KEY: getAuthPublicKey() },
     });
 
     goServerProcess.stdout.on("data", (data) => {
@@ -371,7 +387,12 @@ ipcMain.on("join-room", (event, data) => {
     }
 
     // Устанавливаем переменные окружения для дочернего процесса
-    const env = { ...process.env, SERVER_IP: connectIP, USERNAME: data.name };
+    const env = {
+      ...process.env,
+      SERVER_IP: connectIP,
+      USERNAME: data.name,
+      SESSION_TOKEN: data.token || "",
+    };
 
     console.log(`🔧 [DEBUG] Запускаем клиент с параметрами:`);
     console.log(`   SERVER_IP: ${connectIP}`);
@@ -404,7 +425,8 @@ ipcMain.on("join-room", (event, data) => {
       console.log("[DEBUG] Go client stdout (length):", data.length);
       console.log("[DEBUG] Go client stdout (hex):", data.toString("hex"));
 
-      const message = data.toString().trim(); // Добавим trim для очистки
+      // Служебные строки о результате входа обрабатываем здесь
+      const message = handleClientStatusLines(data.toString());
       console.log("[DEBUG] Message after trim:", `"${message}"`);
 
       // Фильтруем отладочные сообщения
@@ -707,7 +729,17 @@ ipcMain.on("auth-login", async (event, loginData) => {
         ]);
 
         // Генерируем токен сессии
-        const sessionToken = generateSessionToken();
+        let sessionToken;
+        try {
+          sessionToken = generateSessionToken(username);
+        } catch (error) {
+          console.error("Session token error:", error);
+          event.reply("auth-login-response", {
+            success: false,
+            error: "Вход на сервер не настроен: " + error.message,
+          });
+          return;
+        }
 
         console.log("User logged in successfully:", username);
         event.reply("auth-login-response", {
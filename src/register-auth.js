@@ -21,53 +21,12 @@ function showRegistrationForm() {
   initializeRegistrationForm();
 }
 
-function showQuickJoinForm() {
-  hideAllForms();
-  const quickForm = document.getElementById("main-form");
-  quickForm.classList.remove("hidden-form");
-  quickForm.classList.add("active");
-}
-
 function hideAllForms() {
   // Скрываем все формы
-  document
-    .querySelectorAll("#login-form, #register-form, #main-form")
-    .forEach((form) => {
-      form.classList.remove("active", "main-form");
-      form.classList.add("hidden-form");
-    });
-}
-
-// Создание комнаты (быстрое подключение)
-function createRoom() {
-  const name = document.getElementById("userName").value.trim();
-  const ip = document.getElementById("serverIP").value.trim();
-
-  // Валидация
-  let hasErrors = false;
-
-  if (name.length < 2) {
-    showError("userName", "Имя должно содержать минимум 2 символа");
-    hasErrors = true;
-  } else {
-    hideError("userName");
-  }
-
-  if (!validateIP(ip)) {
-    showError("serverIP", "Введите корректный IP адрес");
-    hasErrors = true;
-  } else {
-    hideError("serverIP");
-  }
-
-  if (!hasErrors) {
-    // Отправляем данные для быстрого подключения
-    ipcRenderer.send("join-room", {
-      ip: ip,
-      name: name,
-      quickJoin: true,
-    });
-  }
+  document.querySelectorAll("#login-form, #register-form").forEach((form) => {
+    form.classList.remove("active", "main-form");
+    form.classList.add("hidden-form");
+  });
 }
 
 // Переключение между вкладками (устаревшая функция, но оставляем для совместимости)
@@ -291,7 +250,6 @@ document.addEventListener("DOMContentLoaded", () => {
 // Обработчики IPC сообщений
 ipcRenderer.on("local-ip-response", (event, ip) => {
   document.getElementById("loginServerIP").value = ip;
-  document.getElementById("serverIP").value = ip;
 });
 
 ipcRenderer.on("auth-login-response", (event, response) => {
@@ -331,9 +289,12 @@ ipcRenderer.on("auth-register-response", (event, response) => {
   }
 });
 
+// Сервер отклонил вход (имя занято, недопустимо или сервер заполнен)
+ipcRenderer.on("join-rejected", (event, reason) => {
+  alert("❌ Не удалось войти в чат: " + reason);
+});
+
 // Глобальные функции для кнопок
 window.switchTab = switchTab;
 window.showLoginForm = showLoginForm;
 window.showRegistrationForm = showRegistrationForm;
-window.showQuickJoinForm = showQuickJoinForm;
-window.createRoom = createRoom;
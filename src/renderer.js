@@ -249,8 +249,14 @@ function handleUserMessage(message) {
     users.map((u) => u.name)
   );
 
-  if (message.includes(" joined the chat")) {
-    const username = message.split(" joined the chat")[0];
+  // Сообщения участников начинаются с "[имя]: " и событиями не бывают,
+  // даже если текст похож на событие
+  if (message.startsWith("[")) {
+    return;
+  }
+
+  if (message.endsWith(" joined the chat")) {
+    const username = message.slice(0, -" joined the chat".length);
     console.log(`[DEBUG] Processing join for user: "${username}"`);
 
     // Проверяем, что пользователь не существует уже
@@ -275,8 +281,8 @@ function handleUserMessage(message) {
     } else {
       console.log(`[DEBUG] Пользователь ${username} уже существует в списке`);
     }
-  } else if (message.includes(" подключился к голосовому чату")) {
-    const username = message.split(" подключился к голосовому чату")[0];
+  } else if (message.endsWith(" подключился к голосовому чату")) {
+    const username = message.slice(0, -" подключился к голосовому чату".length);
     console.log(`[DEBUG] Processing voice connect for user: "${username}"`);
     const user = users.find((user) => user.name === username);
     if (user) {
@@ -290,8 +296,8 @@ function handleUserMessage(message) {
         `[DEBUG] Пользователь ${username} не найден для подключения к голосовому чату`
       );
     }
-  } else if (message.includes(" отключился от голосового чата")) {
-    const username = message.split(" отключился от голосового чата")[0];
+  } else if (message.endsWith(" отключился от голосового чата")) {
+    const username = message.slice(0, -" отключился от голосового чата".length);
     console.log(`[DEBUG] Processing voice disconnect for user: "${username}"`);
     const user = users.find((user) => user.name === username);
     if (user) {
@@ -305,12 +311,24 @@ function handleUserMessage(message) {
         `[DEBUG] Пользователь ${username} не найден для отключения от голосового чата`
       );
     }
+  } else if (message.endsWith(" left the chat")) {
+    // Приходит при выходе пользователя и при смене комнаты
+    const username = message.slice(0, -" left the chat".length);
+    console.log(`[DEBUG] Processing leave for user: "${username}"`);
+    const index = users.findIndex((user) => user.name === username);
+    if (index !== -1) {
+      users.splice(index, 1);
+      updateUsersList();
+      updateParticipantsCount();
+      console.log(
+        `[DEBUG] Удален пользователь: ${username}, всего пользователей: ${users.length}`
+      );
+    }
   } else {
     console.log(
       `[DEBUG] Message doesn't match any user patterns: "${message}"`
     );
   }
-  // Можно добавить обработку выхода пользователей, если это будет реализовано на сервере
 }
 
 // Функция для обновления состояния кнопки звонка
@@ -677,6 +695,25 @@ ipcRenderer.on("voice-state-changed", (event, isConnected) => {
   }
 });
 
+// Состояние подключения Go клиента к серверу
+ipcRenderer.on("connection-state", (event, state) => {
+  console.log("[DEBUG] Connection state:", state);
+  const stateElement = document.getElementById("connectionState");
+  if (state === "reconnecting") {
+    // После переподключения сервер заново пришлет список участников
+    users = [];
+    updateUsersList();
+    updateParticipantsCount();
+  }
+  if (stateElement) {
+    const labels = {
+      connecting: "Подключение к серверу...",
+      reconnecting: "Связь потеряна, переподключение...",
+    };
+    stateElement.textContent = labels[state] || "";
+  }
+});
+
 // Обработчик входящих сообщений чата от основного процесса
 ipcRenderer.on("display-chat-message", (event, message) => {
   console.log("Received message from main process:", message);
@@ -692,14 +729,19 @@ ipcRenderer.on("display-chat-message", (event, message) => {
 
     if (singleMessage) {
       // Проверяем, является ли это сообщением с изображением
-      if (singleMessage.includes("]: IMAGE_DATA:")) {
-        const parts = singleMessage.split("]: IMAGE_DATA:");
-        if (parts.length === 2) {
+      // Отправитель - в начале строки: "[adam1]: IMAGE_DATA:..."
+      const imageMarker = singleMessage.indexOf("]: IMAGE_DATA:");
+      if (singleMessage.startsWith("[") && imageMarker !== -1) {
+        const parts = [
+          singleMessage.slice(0, imageMarker),
+          singleMessage.slice(imageMarker + "]: IMAGE_DATA:".length),
+        ];
+        if (!parts[0].includes("]")) {
           const senderInfo = parts[0] + "]:"; // Например "[adam1]:"
           const imageData = parts[1];
 
           // Определяем, является ли сообщение собственным
-          const isOwnMessage = senderInfo.includes(`[${currentUsername}]:`);
+          const isOwnMessage = senderInfo === `[${currentUsername}]:`;
 
           // Добавляем изображение в чат
           addMessage(imageData, isOwnMessage, true);
@@ -709,9 +751,7 @@ ipcRenderer.on("display-chat-message", (event, message) => {
       }
 
       // Определяем, является ли сообщение собственным
-      const isOwnMessage =
-        singleMessage.includes(`[${currentUsername}]:`) ||
-        singleMessage.startsWith(`[${currentUsername}]:`);
+      const isOwnMessage = singleMessage.startsWith(`[${currentUsername}]:`);
       console.log(
         "[DEBUG] Is own message:",
         isOwnMessage,